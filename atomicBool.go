@@ -21,3 +21,11 @@ func (b *aBool) Set(v bool) {
 	b.value = v
 	b.mu.Unlock()
 }
+
+func (b *aBool) Swap(v bool) bool {
+	b.mu.Lock()
+	var result = b.value
+	b.value = v
+	b.mu.Unlock()
+	return result
+}
@@ -0,0 +1,55 @@
+package apns
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// auditLog описывает очередь фреймов, ожидающих записи в журнал аудита клиента.
+type auditLog struct {
+	frames  chan []byte // фреймы, ожидающие записи
+	dropped uint64      // количество отброшенных фреймов
+	once    sync.Once   // однократный запуск записи журнала
+}
+
+// writeAudit помещает копию отправленного фрейма в очередь на запись в журнал аудита. Если очередь
+// переполнена, то фрейм отбрасывается и увеличивается счетчик отброшенных фреймов.
+func (client *Client) writeAudit(frame []byte) {
+	client.audit.once.Do(func() {
+		client.audit.frames = make(chan []byte, AuditQueueSize)
+		go client.handleAudit() // запускаем запись журнала
+	})
+	select {
+	case client.audit.frames <- frame:
+	default:
+		atomic.AddUint64(&client.audit.dropped, 1)
+	}
+}
+
+// handleAudit записывает фреймы из очереди в журнал аудита, пока клиент не будет закрыт. При
+// закрытии клиента в журнал дописываются все уже находящиеся в очереди фреймы.
+func (client *Client) handleAudit() {
+	for {
+		select {
+		case frame := <-client.audit.frames:
+			if _, err := client.Audit.Write(frame); err != nil {
+				client.currentConfig().logger().Println("Audit error:", err)
+			}
+		case <-client.done:
+			for {
+				select {
+				case frame := <-client.audit.frames:
+					client.Audit.Write(frame)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// AuditDropped возвращает количество фреймов, не попавших в журнал аудита из-за того, что он
+// не успевал их записывать.
+func (client *Client) AuditDropped() uint64 {
+	return atomic.LoadUint64(&client.audit.dropped)
+}
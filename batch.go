@@ -0,0 +1,249 @@
+package apns
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// BatchItem описывает одно уведомление из пакета, отправляемого с помощью SendBatch.
+type BatchItem struct {
+	Notification *Notification // уведомление
+	Token        string        // токен устройства в шестнадцатеричном виде
+}
+
+// SendItemResult описывает результат помещения в очередь одного уведомления из пакета.
+type SendItemResult struct {
+	Token string // токен устройства
+	Valid bool   // флаг корректного формата токена устройства
+	ID    uint32 // идентификатор, присвоенный уведомлению при помещении в очередь
+	Err   error  // ошибка, из-за которой уведомление не было помещено в очередь
+}
+
+// SendBatch помещает в очередь на отправку пакет уведомлений, каждое из которых может иметь
+// собственное содержимое, и возвращает список результатов, соответствующий по порядку переданному
+// пакету. Ошибка в одном уведомлении не мешает помещению в очередь остальных: для уведомлений,
+// не попавших в очередь, в результате указывается ошибка, а для остальных — присвоенный им
+// идентификатор. Результаты самой отправки передаются, как обычно, в канал Results.
+//
+// Одно и то же уведомление, указанное в пакете несколько раз, проверяется и сериализуется только
+// однажды. Уведомление с идентификатором, заданным в Notification.ID, помещается в очередь
+// только один раз: для повторов, как и для уже используемых идентификаторов, в результате
+// указывается ошибка ErrDuplicateID.
+//
+// Место в очереди (см. MaxQueueSize) проверяется сразу для всего пакета: если его нет, то ни одно
+// уведомление не помещается в очередь, а для всех них в результате указывается ошибка ErrQueueFull.
+func (client *Client) SendBatch(items []BatchItem) []SendItemResult {
+	var err error
+	if client.closed.Is() {
+		err = ErrClientIsClosed
+	} else {
+		err = client.waitQueue(context.Background(), len(items))
+	}
+	if err != nil {
+		var results = make([]SendItemResult, len(items))
+		for i, item := range items {
+			results[i] = SendItemResult{Token: item.Token, Err: err}
+		}
+		return results
+	}
+	return client.sendBatch(items, make(map[*Notification]batchTemplate))
+}
+
+// SendTokens помещает уведомление для указанных токенов устройств в очередь на отправку и, в
+// отличие от Send, возвращает результат для каждого токена в порядке их следования. Для токенов
+// с неверным форматом и пропущенных токенов (ErrTokenSkipped) в результате указывается ошибка, а
+// для остальных — присвоенный уведомлению идентификатор. Ошибка в самом уведомлении возвращается
+// сразу, и ни одного уведомления при этом в очередь не добавляется. Как и SendBatch, вызов
+// начинает новый пакет для LastBatchSummary.
+func (client *Client) SendTokens(ntf *Notification, tokens []string) ([]SendItemResult, error) {
+	client.warnIgnored(ntf.CollapseID)
+	template, err := ntf.convert() // конвертируем сообщение во внутреннее представление
+	if err != nil {
+		return nil, err
+	}
+	if client.closed.Is() {
+		return nil, ErrClientIsClosed
+	}
+	if !fitsFrame(template, maxTokenLen(client.normalizeTokens(tokens))) {
+		return nil, ErrNotificationTooLarge
+	}
+	if err := client.waitQueue(context.Background(), len(tokens)); err != nil {
+		return nil, err
+	}
+	var items = make([]BatchItem, len(tokens))
+	for i, token := range tokens {
+		items[i] = BatchItem{Notification: ntf, Token: token}
+	}
+	if template, err = client.prepare(template); err != nil {
+		return nil, err
+	}
+	var templates = map[*Notification]batchTemplate{ntf: {template: template}}
+	return client.sendBatch(items, templates), nil
+}
+
+// batchTemplate описывает результат проверки и сериализации уведомления из пакета.
+type batchTemplate struct {
+	template *notification // внутреннее представление уведомления
+	err      error         // ошибка в уведомлении
+}
+
+// sendBatch помещает пакет уведомлений в очередь, используя уже сериализованные уведомления из
+// templates и дополняя его остальными.
+func (client *Client) sendBatch(items []BatchItem, templates map[*Notification]batchTemplate) []SendItemResult {
+	var (
+		results = make([]SendItemResult, len(items))
+		list    = make([]*notification, 0, len(items))
+		queued  = make([]*notification, len(items)) // уведомления, помещаемые в очередь
+	)
+	for i, item := range items {
+		var result = &results[i]
+		result.Token = item.Token
+		var token = item.Token
+		if client.NormalizeTokens {
+			token = NormalizeToken(token)
+		}
+		btoken, err := decodeToken(token)
+		if err != nil {
+			result.Err = err
+			continue
+		}
+		result.Valid = true
+		entry, ok := templates[item.Notification]
+		if !ok {
+			client.warnIgnored(item.Notification.CollapseID)
+			entry.template, entry.err = item.Notification.convert()
+			if entry.err == nil {
+				entry.template, entry.err = client.prepare(entry.template)
+			}
+			templates[item.Notification] = entry
+		}
+		if entry.err != nil {
+			result.Err = entry.err
+			continue
+		}
+		if !fitsFrame(entry.template, len(btoken)) {
+			result.Err = ErrNotificationTooLarge
+			continue
+		}
+		if !client.checkToken(btoken) {
+			result.Err = ErrTokenSkipped
+			continue
+		}
+		queued[i] = entry.template.WithToken(btoken)
+		list = append(list, queued[i])
+	}
+	// идентификаторы присваиваются при помещении в очередь
+	var duplicates = make(map[*notification]bool)
+	for _, ntf := range client.queue.Put(list...) {
+		duplicates[ntf] = true
+	}
+	var ids = make([]uint32, 0, len(list))
+	for i, ntf := range queued {
+		switch {
+		case ntf == nil:
+		case duplicates[ntf]:
+			results[i].Err = ErrDuplicateID
+		default:
+			results[i].ID = ntf.ID
+			ids = append(ids, ntf.ID)
+		}
+	}
+	if len(ids) > 0 {
+		client.summary.reset(ids)
+	}
+	client.start(context.Background())
+	return results
+}
+
+// BatchSummary описывает итоги отправки пакета уведомлений.
+type BatchSummary struct {
+	Attempted int           // количество уведомлений пакета, помещенных в очередь
+	Delivered int           // количество уведомлений, считающихся доставленными
+	Rejected  map[uint8]int // количество уведомлений, отклоненных сервером, по кодам статуса
+	Dropped   int           // количество уведомлений, не отправленных из-за истечения времени жизни
+}
+
+// Состояния уведомлений пакета.
+const (
+	batchPending  uint8 = iota // уведомление еще не отправлено
+	batchSent                  // уведомление отправлено на сервер
+	batchRejected              // уведомление отклонено сервером
+	batchDropped               // уведомление не отправлено
+)
+
+// batchSummary собирает итоги отправки последнего пакета уведомлений на основании результатов
+// отправки каждого из них.
+type batchSummary struct {
+	index    map[uint32]int // индексы уведомлений пакета по их идентификаторам
+	states   []uint8        // состояния уведомлений пакета
+	sended   []time.Time    // время последней отправки уведомлений пакета
+	rejected map[uint8]int  // количество отклоненных уведомлений по кодам статуса
+	mu       sync.Mutex
+}
+
+// reset начинает сбор итогов для нового пакета из уведомлений с указанными идентификаторами.
+// Идентификаторы пакета не обязательно идут подряд: они могут быть заданы в Notification.ID.
+func (s *batchSummary) reset(ids []uint32) {
+	var index = make(map[uint32]int, len(ids))
+	for i, id := range ids {
+		index[id] = i
+	}
+	s.mu.Lock()
+	s.index = index
+	s.states = make([]uint8, len(ids))
+	s.sended = make([]time.Time, len(ids))
+	s.rejected = make(map[uint8]int)
+	s.mu.Unlock()
+}
+
+// record учитывает результат отправки уведомления, если оно относится к текущему пакету.
+func (s *batchSummary) record(result SendResult) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i, ok := s.index[result.ID]
+	if !ok {
+		return // уведомление не из пакета
+	}
+	switch err := result.Err.(type) {
+	case nil:
+		s.states[i] = batchSent
+		s.sended[i] = result.Sended
+	case APNsError:
+		s.states[i] = batchRejected
+		s.rejected[err.Status]++
+	default:
+		s.states[i] = batchDropped
+	}
+}
+
+// LastBatchSummary возвращает итоги отправки последнего пакета, помещенного в очередь с помощью
+// SendBatch. Отправленное уведомление считается доставленным, если с момента его отправки прошло
+// TimeoutDelivered, а сервер не вернул на него ошибку. Поэтому окончательные итоги доступны не
+// раньше, чем через TimeoutDelivered после отправки последнего уведомления пакета.
+func (client *Client) LastBatchSummary() BatchSummary {
+	var s = &client.summary
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var (
+		since   = time.Now().Add(-TimeoutDelivered)
+		summary = BatchSummary{
+			Attempted: len(s.states),
+			Rejected:  make(map[uint8]int, len(s.rejected)),
+		}
+	)
+	for status, count := range s.rejected {
+		summary.Rejected[status] = count
+	}
+	for i, state := range s.states {
+		switch state {
+		case batchSent:
+			if !s.sended[i].After(since) {
+				summary.Delivered++
+			}
+		case batchDropped:
+			summary.Dropped++
+		}
+	}
+	return summary
+}
@@ -0,0 +1,141 @@
+package apns
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestClientSendBatch(t *testing.T) {
+	var (
+		tokens = testTokens(4)
+		client = newOfflineClient(t, new(Config))
+		ntf    = &Notification{Payload: NewPayload().Sound(DefaultSound)}
+		empty  = &Notification{}
+	)
+	client.Blocklist = testBlocklist{tokens[2]: true}
+	var items = []BatchItem{
+		{ntf, tokens[0]},
+		{ntf, "not a token"},
+		{ntf, ""},
+		{ntf, tokens[2]},
+		{empty, tokens[3]},
+		{ntf, tokens[3]},
+	}
+	var expected = []SendItemResult{
+		{tokens[0], true, 1, nil},
+		{"not a token", false, 0, ErrTokenSize},
+		{"", false, 0, ErrTokenSize},
+		{tokens[2], true, 0, ErrTokenSkipped},
+		{tokens[3], true, 0, ErrPayloadEmpty},
+		{tokens[3], true, 2, nil},
+	}
+	var results = client.SendBatch(items)
+	if len(results) != len(expected) {
+		t.Fatalf("got %d results, expected %d", len(results), len(expected))
+	}
+	for i, result := range results {
+		if result != expected[i] {
+			t.Errorf("%d: result %+v, expected %+v", i, result, expected[i])
+		}
+	}
+	if len(client.queue.list) != 2 ||
+		client.queue.list[0].TokenString() != tokens[0] ||
+		client.queue.list[1].TokenString() != tokens[3] {
+		t.Errorf("bad queue: %v", client.queue.list)
+	}
+
+	client.Close(false)
+	for _, result := range client.SendBatch(items[:1]) {
+		if result.Err != ErrClientIsClosed {
+			t.Errorf("send to closed client: %v", result.Err)
+		}
+	}
+}
+
+func TestClientSendTokens(t *testing.T) {
+	var (
+		tokens = testTokens(3)
+		client = newOfflineClient(t, new(Config))
+		ntf    = &Notification{Payload: NewPayload().Sound(DefaultSound)}
+	)
+	defer client.Close(false)
+	client.Blocklist = testBlocklist{tokens[1]: true}
+	if _, err := client.SendTokens(&Notification{}, tokens); err != ErrPayloadEmpty {
+		t.Errorf("bad notification error %v", err)
+	}
+	if client.Pending() != 0 {
+		t.Fatalf("%d notifications queued with bad notification", client.Pending())
+	}
+	results, err := client.SendTokens(ntf, []string{tokens[0], "not a token", tokens[1], tokens[2]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expected = []SendItemResult{
+		{tokens[0], true, 1, nil},
+		{"not a token", false, 0, ErrTokenSize},
+		{tokens[1], true, 0, ErrTokenSkipped},
+		{tokens[2], true, 2, nil},
+	}
+	if len(results) != len(expected) {
+		t.Fatalf("got %d results, expected %d", len(results), len(expected))
+	}
+	for i, result := range results {
+		if result != expected[i] {
+			t.Errorf("%d: result %+v, expected %+v", i, result, expected[i])
+		}
+	}
+}
+
+func TestClientLastBatchSummary(t *testing.T) {
+	defer func(timeout time.Duration) { TimeoutDelivered = timeout }(TimeoutDelivered)
+	TimeoutDelivered = 50 * time.Millisecond
+
+	client, server := newTestClient(t)
+	client.ManualSend = true
+	var (
+		ntf   = &Notification{Payload: NewPayload().Sound(DefaultSound)}
+		items = make([]BatchItem, 4)
+	)
+	for i, token := range testTokens(len(items)) {
+		items[i] = BatchItem{ntf, token}
+	}
+	client.SendBatch(items)
+	client.queue.list[1].Expiration = 1 // время жизни второго уведомления истекло в очереди
+
+	// drain отправляет уведомления из очереди через установленное соединение и читает на сервере
+	// указанное количество фреймов
+	var drain = func(conn net.Conn, count int) {
+		for !client.conn.isConnected() { // ждем окончания установки соединения
+			time.Sleep(time.Millisecond)
+		}
+		var done = make(chan error)
+		go func() { done <- client.DrainOnce() }()
+		for i := 0; i < count; i++ {
+			if _, err := readFrame(conn); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	conn := server.Accept(t)
+	drain(conn, 3)
+	// сервер отклоняет третье уведомление: четвертое отправляется заново
+	if _, err := conn.Write([]byte{8, 8, 0, 0, 0, 3}); err != nil {
+		t.Fatal(err)
+	}
+	drain(server.Accept(t), 1)
+	time.Sleep(TimeoutDelivered)
+	client.Close(false)
+
+	var summary = client.LastBatchSummary()
+	if summary.Attempted != 4 || summary.Delivered != 2 || summary.Dropped != 1 ||
+		len(summary.Rejected) != 1 || summary.Rejected[8] != 1 {
+		t.Errorf("bad summary: %+v", summary)
+	}
+}
@@ -0,0 +1,152 @@
+package apns
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Capture описывает транспорт, который вместо отправки уведомлений на сервер APNS разбирает
+// записанные в соединение фреймы и сохраняет уведомления из них. Это позволяет увидеть, что именно
+// будет отправлено, без сертификата и соединения с сервером, например, в тестах или при локальной
+// разработке. Клиент, использующий такой транспорт, возвращает NewCaptureClient.
+//
+// Сервер при этом не эмулируется: ошибки для уведомлений не возвращаются, поэтому все уведомления
+// считаются успешно отправленными.
+type Capture struct {
+	list []CapturedNotification // разобранные уведомления
+	err  error                  // ошибка разбора фрейма
+	mu   sync.Mutex
+}
+
+// CapturedNotification описывает уведомление, разобранное из отправленного фрейма.
+type CapturedNotification struct {
+	ID         uint32    // идентификатор уведомления
+	Token      []byte    // токен устройства
+	Payload    []byte    // содержимое уведомления в формате JSON
+	Expiration time.Time // время жизни (нулевое, если не указано)
+	Priority   uint8     // приоритет (0, если не указан)
+}
+
+// NewCaptureClient возвращает клиента, который не соединяется с сервером APNS, а передает все
+// отправляемые уведомления в возвращаемый Capture. Конфигурация может быть nil: сертификат для
+// такого клиента не нужен.
+func NewCaptureClient(config *Config) (*Client, *Capture, error) {
+	if config == nil {
+		config = new(Config)
+	}
+	client, err := NewClient(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	var capture = new(Capture)
+	client.dialFunc = func(addr string) (net.Conn, error) {
+		return &captureConn{capture: capture, closed: make(chan struct{})}, nil
+	}
+	return client, capture, nil
+}
+
+// Notifications возвращает копию списка всех разобранных к этому моменту уведомлений в порядке
+// их отправки.
+func (c *Capture) Notifications() []CapturedNotification {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]CapturedNotification(nil), c.list...)
+}
+
+// Reset очищает список разобранных уведомлений и ошибку разбора.
+func (c *Capture) Reset() {
+	c.mu.Lock()
+	c.list, c.err = nil, nil
+	c.mu.Unlock()
+}
+
+// Err возвращает ошибку, если в соединение были записаны данные, которые не удалось разобрать как
+// фрейм уведомления. Это означает ошибку формирования фреймов клиентом.
+func (c *Capture) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// decode разбирает из буфера все полностью записанные фреймы, оставляя в нем незаконченный.
+func (c *Capture) decode(buf *bytes.Buffer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for buf.Len() >= 5 {
+		var header = buf.Bytes()[:5]
+		var size = int(binary.BigEndian.Uint32(header[1:]))
+		if header[0] != 2 || size > MaxFrameBuffer {
+			c.err = ErrCaptureFrame
+			buf.Reset() // дальнейшие данные разобрать невозможно
+			return
+		}
+		if buf.Len() < 5+size {
+			return // фрейм записан не полностью
+		}
+		buf.Next(5)
+		var ntf = decodeFrameItems(append([]byte(nil), buf.Next(size)...))
+		if ntf == nil {
+			c.err = ErrCaptureFrame
+			continue
+		}
+		var captured = CapturedNotification{
+			ID:       ntf.ID,
+			Token:    ntf.Token,
+			Payload:  ntf.Payload,
+			Priority: ntf.Priority,
+		}
+		if ntf.Expiration != 0 {
+			captured.Expiration = time.Unix(int64(ntf.Expiration), 0)
+		}
+		c.list = append(c.list, captured)
+	}
+}
+
+// captureConn описывает соединение, записанные в которое данные разбираются Capture. Чтение из
+// соединения блокируется до его закрытия, поскольку сервер не возвращает ошибок.
+type captureConn struct {
+	capture *Capture
+	buf     bytes.Buffer  // данные незаконченного фрейма
+	closed  chan struct{} // канал, закрываемый при закрытии соединения
+	once    sync.Once
+	mu      sync.Mutex
+}
+
+func (c *captureConn) Read(p []byte) (int, error) {
+	<-c.closed
+	return 0, io.EOF
+}
+
+func (c *captureConn) Write(p []byte) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.buf.Write(p)
+	c.capture.decode(&c.buf)
+	return len(p), nil
+}
+
+func (c *captureConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *captureConn) LocalAddr() net.Addr                { return captureAddr{} }
+func (c *captureConn) RemoteAddr() net.Addr               { return captureAddr{} }
+func (c *captureConn) SetDeadline(t time.Time) error      { return nil }
+func (c *captureConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *captureConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// captureAddr описывает адрес соединения Capture.
+type captureAddr struct{}
+
+func (captureAddr) Network() string { return "capture" }
+func (captureAddr) String() string  { return "capture" }
@@ -0,0 +1,77 @@
+package apns
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"testing"
+	"time"
+)
+
+func TestCaptureClient(t *testing.T) {
+	client, capture, err := NewCaptureClient(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close(false)
+	var (
+		tokens     = testTokens(3)
+		expiration = time.Now().Add(time.Hour).Truncate(time.Second)
+		ntf        = &Notification{
+			Payload:    NewPayload().Alert("test"),
+			Expiration: expiration,
+			Priority:   5,
+		}
+	)
+	if err := client.Send(ntf, tokens...); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := capture.Err(); err != nil {
+		t.Fatal(err)
+	}
+	var list = capture.Notifications()
+	if len(list) != len(tokens) {
+		t.Fatalf("%d notifications captured, expected %d", len(list), len(tokens))
+	}
+	for i, captured := range list {
+		if captured.ID != uint32(i+1) || hex.EncodeToString(captured.Token) != tokens[i] ||
+			string(captured.Payload) != `{"aps":{"alert":"test"}}` || captured.Priority != 5 ||
+			!captured.Expiration.Equal(expiration) {
+			t.Errorf("bad captured notification %d: %+v", i, captured)
+		}
+	}
+	capture.Reset()
+	if len(capture.Notifications()) != 0 {
+		t.Error("capture is not reset")
+	}
+}
+
+func TestCaptureFrames(t *testing.T) {
+	var (
+		capture = new(Capture)
+		conn    = &captureConn{capture: capture, closed: make(chan struct{})}
+		token   = bytes.Repeat([]byte{1}, 32)
+	)
+	frame, err := EncodeFrame(token, []byte(`{}`), 7, time.Time{}, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// фрейм может быть записан по частям
+	for _, b := range frame {
+		conn.Write([]byte{b})
+	}
+	var list = capture.Notifications()
+	if len(list) != 1 || list[0].ID != 7 || !bytes.Equal(list[0].Token, token) ||
+		list[0].Priority != 10 || !list[0].Expiration.IsZero() {
+		t.Errorf("bad captured frame: %+v", list)
+	}
+	conn.Write([]byte{1, 0, 0, 0, 0})
+	if capture.Err() != ErrCaptureFrame {
+		t.Errorf("bad frame error %v", capture.Err())
+	}
+}
@@ -1,36 +1,231 @@
 package apns
 
 import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // Client описывает клиента для соединения с APNS и отправки уведомлений.
 type Client struct {
-	conn    *apnsConn          // соединение с сервером
-	config  *Config            // конфигурация и сертификаты
-	host    string             // адрес сервера
-	queue   *notificationQueue // список уведомлений для отправки
-	sending aBool              // флаг активности отправки
-	closed  aBool              // флаг закрытия клиента
+	conn       connection         // соединение с сервером
+	config     *Config            // конфигурация и сертификаты
+	configMu   sync.RWMutex       // блокировка замены конфигурации (SetConfig)
+	host       string             // адрес сервера
+	queue      *notificationQueue // список уведомлений для отправки
+	sending    aBool              // флаг активности отправки
+	closed     aBool              // флаг закрытия клиента
+	errors     errorCounter       // статистика ошибок, полученных от сервера
+	blocked    uint64             // количество заблокированных токенов
+	mismatched uint64             // количество токенов для другого окружения
+	sent       uint64             // количество отправленных уведомлений
+	failed     uint64             // количество уведомлений, отклоненных сервером
+	requeued   uint64             // количество уведомлений, возвращенных в очередь
+	reconnects uint64             // количество повторных соединений с сервером
+	audit      auditLog           // очередь записи в журнал аудита
+	unreported uint64             // количество результатов, не попавших в канал Results
+	summary    batchSummary       // итоги отправки последнего пакета уведомлений
+	limiter    rateLimiter        // ограничение скорости отправки (RateLimit)
+	sendErrors uint64             // количество ошибок отправки данных на сервер
+	lastErr    error              // последняя ошибка отправки данных на сервер
+	errMu      sync.Mutex         // блокировка доступа к lastErr
+	done       chan struct{}      // канал, закрываемый при закрытии клиента
+	keeping    aBool              // флаг запущенной проверки соединения (KeepAlive)
+	warned     aBool              // флаг выведенного предупреждения о неподдерживаемых параметрах
+	once       sync.Once          // защита от повторного закрытия канала
+
+	// функция установки соединения, заменяющая стандартную (используется в тестах)
+	dialFunc func(addr string) (net.Conn, error)
+
+	// DefaultExpiration задает время жизни по умолчанию для уведомлений, у которых оно не указано
+	// явно. Если значение не задано, то такие уведомления отправляются без ограничения времени жизни.
+	DefaultExpiration time.Duration
+	// Audit задает журнал аудита, в который записываются копии всех фреймов, успешно отправленных
+	// на сервер. Запись ведется асинхронно и не задерживает отправку: если журнал не успевает
+	// записывать фреймы, то они отбрасываются, а их количество возвращает AuditDropped.
+	Audit io.Writer
+	// ThrottleUnconfirmed включает ограничение количества отправленных, но еще не считающихся
+	// доставленными уведомлений (см. TimeoutDelivered) размером кеша Config.CacheSize. При
+	// достижении этого ограничения отправка приостанавливается. Это гарантирует, что уведомление,
+	// на которое пришла ошибка, еще находится в кеше и отправка может быть продолжена после него.
+	ThrottleUnconfirmed bool
+	// MaxInFlight ограничивает количество отправленных, но еще не считающихся доставленными
+	// уведомлений (см. TimeoutDelivered), аналогично ThrottleUnconfirmed, но независимо от размера
+	// кеша. При достижении ограничения накопленный буфер отправляется, а отправка следующих
+	// уведомлений приостанавливается. Это сглаживает потребление памяти и нагрузку на сервер при
+	// отправке большого количества уведомлений сразу. Значение больше размера кеша
+	// (Config.CacheSize) ограничивается им. По умолчанию отправка не ограничивается.
+	MaxInFlight int
+	// RateLimit ограничивает скорость отправки уведомлений на сервер количеством уведомлений в
+	// секунду, чтобы сервер не ограничивал клиента из-за слишком интенсивной отправки. Ограничение
+	// проверяется перед отправкой каждого фрейма, а не каждого уведомления, поэтому уведомления
+	// по-прежнему объединяются во фреймы: после периода простоя без ожидания может быть отправлено
+	// до RateLimit уведомлений, а в дальнейшем за любой интервал T отправляется не больше
+	// RateLimit*(T+1с) уведомлений. Ожидание добавляется к SendDelay: уведомления, добавленные в
+	// очередь во время ожидания, попадают уже в следующий фрейм. По умолчанию (0) скорость не
+	// ограничивается.
+	RateLimit int
+	// RequireTokens указывает, что Send должен возвращать ошибку ErrNoTokens, если ему не передан
+	// ни один токен устройства. По умолчанию такой вызов просто ничего не делает.
+	RequireTokens bool
+	// Latency задает гистограмму, в которой учитываются задержки отправки каждого фрейма на сервер.
+	// По умолчанию задержки не учитываются.
+	Latency *LatencyHistogram
+	// Blocklist задает список токенов устройств, уведомления для которых не отправляются. Такие
+	// токены пропускаются при добавлении уведомлений в очередь, а их количество возвращает
+	// BlockedCount.
+	Blocklist Blocklist
+	// TokenEnvironment задает функцию, возвращающую окружение APNS, для которого был получен токен
+	// устройства. Токены, окружение которых известно и не совпадает с окружением клиента, при
+	// добавлении уведомлений в очередь пропускаются, а их количество возвращает MismatchedCount.
+	TokenEnvironment func(token []byte) Environment
+	// Results задает канал, в который передаются результаты отправки уведомлений: после успешной
+	// отправки на сервер и при получении от сервера ошибки для уведомления. Запись в канал не
+	// блокирует отправку: если канал заполнен, то результат отбрасывается, а количество таких
+	// результатов возвращает ResultsDropped.
+	Results chan<- SendResult
+	// ManualSend отключает автоматическую отправку уведомлений: уведомления только помещаются в
+	// очередь, а отправляются на сервер при вызове DrainOnce. Это позволяет полностью управлять
+	// моментом отправки, например, в тестах.
+	ManualSend bool
+	// PayloadWarningSize задает размер содержимого уведомления в байтах, при превышении которого в
+	// лог выводится предупреждение. Такое уведомление все равно отправляется, если его размер не
+	// превышает MaxPayloadSize: предупреждение помогает вовремя заметить неоправданно большие
+	// уведомления. По умолчанию предупреждение не выводится.
+	PayloadWarningSize int
+	// PayloadValidator задает функцию дополнительной проверки содержимого уведомлений, которой
+	// передается уже сериализованное в JSON содержимое. Если функция возвращает ошибку, то
+	// уведомление не помещается в очередь, а эта ошибка возвращается при отправке (для SendBatch и
+	// SendTokens — в результате каждого уведомления). Это позволяет централизованно проверять все
+	// отправляемые уведомления, например, на соответствие принятой схеме. Проверка выполняется при
+	// каждой отправке, в том числе подготовленных с помощью PrecompileNotification уведомлений, один
+	// раз на вызов, а не на каждый токен. Функция может вызываться одновременно из разных потоков.
+	PayloadValidator func(payload []byte) error
+	// NormalizeTokens включает приведение токенов устройств к стандартному виду перед их проверкой
+	// (см. NormalizeToken): из них удаляются пробелы и угловые скобки. Без этой опции такие токены
+	// считаются неверными и пропускаются.
+	NormalizeTokens bool
+	// DedupeTokens включает пропуск повторяющихся токенов устройств в пределах одного вызова Send
+	// (и аналогичных ему методов): токены сравниваются после декодирования, поэтому записи одного
+	// токена в разном регистре считаются одинаковыми. Для повторов уведомления в очередь не
+	// добавляются. SendBatch и SendTokens эта опция не затрагивает: в пакете одному токену могут
+	// намеренно отправляться разные уведомления, а SendTokens возвращает результат для каждого
+	// токена, включая повторы.
+	DedupeTokens bool
+	// IdleTimeout задает время простоя, после которого соединение с сервером закрывается. Время
+	// отсчитывается заново после каждой отправки уведомлений, поэтому при отправке уведомлений
+	// с небольшими перерывами соединение не разрывается. Следующая после закрытия соединения
+	// отправка автоматически установит новое соединение. По умолчанию используется TiemoutRead.
+	IdleTimeout time.Duration
+	// OnError задает функцию, которая вызывается, когда сервер возвращает ошибку для отправленного
+	// уведомления. Ей передаются идентификатор уведомления, токен устройства и код статуса ошибки,
+	// что позволяет, например, сразу удалить недействительный токен (StatusInvalidToken), не
+	// дожидаясь ответа feedback сервера. Функция вызывается до повторной отправки уведомлений,
+	// отправленных после ошибочного, поэтому она не должна надолго задерживать выполнение. Для
+	// ответа StatusShutdown функция не вызывается: он означает только закрытие соединения сервером,
+	// после которого клиент переподключается и отправляет заново уведомления после указанного в нем.
+	OnError func(id uint32, token []byte, status uint8)
+	// SendDelay задает время, в течение которого ожидается добавление новых уведомлений перед
+	// отправкой накопленного буфера на сервер. По умолчанию используется DurationSend.
+	SendDelay time.Duration
+	// ReconnectBase задает начальную максимальную задержку между попытками соединения с сервером,
+	// которая удваивается после каждой неудачной попытки. Сама задержка выбирается случайно от нуля
+	// до этой величины, чтобы много клиентов не соединялись с сервером одновременно после его
+	// недоступности. По умолчанию используется DurationReconnect.
+	ReconnectBase time.Duration
+	// ReconnectMax ограничивает рост максимальной задержки между попытками соединения с сервером.
+	// По умолчанию задержка не превышает 30 минут.
+	ReconnectMax time.Duration
+	// MaxQueueSize ограничивает количество неотправленных уведомлений в очереди, чтобы при долгой
+	// недоступности сервера очередь не росла бесконечно. Ограничение проверяется для всех
+	// уведомлений, добавляемых одним вызовом: Send, SendBatch, SendTokens и SendFromReader. Вызов,
+	// добавляющий больше уведомлений, чем MaxQueueSize, допускается только в пустую очередь. По
+	// умолчанию размер очереди не ограничен.
+	MaxQueueSize int
+	// BlockWhenFull задает поведение при заполненной очереди (см. MaxQueueSize). По умолчанию Send
+	// сразу возвращает ошибку ErrQueueFull, а с этим флагом — ждет, пока в очереди не освободится
+	// место, клиент не будет закрыт или, для SendContext, не будет отменен контекст. В режиме
+	// ManualSend в это время должен параллельно вызываться DrainOnce.
+	BlockWhenFull bool
+	// KeepAlive включает проверку соединения с сервером с указанным интервалом. Бинарный протокол
+	// не позволяет отправить на сервер пустое сообщение, поэтому для обнаружения оборванных
+	// соединений используются периодические проверки TCP (keepalive), а соединение, которое было
+	// закрыто, в том числе после простоя (см. IdleTimeout), с тем же интервалом восстанавливается
+	// заранее, не дожидаясь отправки следующего уведомления. По умолчанию проверка отключена.
+	KeepAlive time.Duration
+	// OnDelivered задает функцию, которая вызывается для уведомлений, считающихся доставленными:
+	// сервер APNS не подтверждает успешную доставку, а только возвращает ошибки, поэтому
+	// уведомление считается доставленным, если в течение DeliveredDelay после его отправки сервер
+	// не вернул ошибку. Это эвристика, а не гарантия доставки: ошибка может прийти и позже, а
+	// уведомления, отправленные непосредственно перед разрывом соединения, могут быть потеряны.
+	// Подтвержденные уведомления удаляются из кеша и больше не отправляются повторно. Функция
+	// вызывается в отдельном потоке со списком идентификаторов в порядке отправки.
+	OnDelivered func(ids []uint32)
+	// DeliveredDelay задает время после отправки уведомления, в течение которого ожидается ошибка
+	// от сервера, прежде чем уведомление считается доставленным (см. OnDelivered). По умолчанию
+	// используется TimeoutDelivered.
+	DeliveredDelay time.Duration
 }
 
 // NewClient возвращает инициализированный клиент для отправки уведомлений на APNS. Подключения
 // к APNS сервису при этом не происходит: оно произойдет автоматически, когда через него попытаются
 // отправить первое уведомление.
-func NewClient(config *Config) *Client {
-	var host string
-	if config.Sandbox {
-		host = ServerApnsSandbox
-	} else {
-		host = ServerApns
+//
+// Если текущие настройки пакета не позволяют отправлять уведомления (например, MaxFrameBuffer
+// меньше размера уведомления максимальной длины), то возвращается ошибка. Если сертификат выдан
+// для другого окружения APNS, чем задано в конфигурации, то выводится предупреждение или, при
+// установленном Config.StrictEnvironment, возвращается ошибка ErrEnvironmentMismatch. Задержки отправки
+// и переподключения клиента инициализируются текущими значениями DurationSend и DurationReconnect
+// и в дальнейшем от них не зависят.
+func NewClient(config *Config) (*Client, error) {
+	if MaxFrameBuffer < maxNotificationLen() {
+		return nil, ErrFrameBufferTooSmall
+	}
+	if err := config.checkHost(); err != nil {
+		return nil, err
+	}
+	if err := config.checkEnvironment(); err != nil {
+		return nil, err
+	}
+	var host = config.serverAddr()
+	var (
+		store    *queueStore
+		restored []*notification
+	)
+	if config.PersistPath != "" {
+		var err error
+		store, restored, err = openQueueStore(config.PersistPath, config.logger())
+		if err != nil {
+			return nil, err
+		}
 	}
 	var client = &Client{
-		config: config,
-		host:   host,
-		queue:  newNotificationQueue(),
+		config:        config,
+		host:          host,
+		queue:         newNotificationQueue(config.cacheSize(), config.cacheLifeTime()),
+		done:          make(chan struct{}),
+		SendDelay:     DurationSend,
+		ReconnectBase: DurationReconnect,
+		ReconnectMax:  30 * time.Minute,
 	}
 	client.conn = &apnsConn{client: client}
-	return client
+	client.queue.ready = func() { // наступило время отправки отложенных уведомлений
+		if !client.closed.Is() {
+			client.start(context.Background())
+		}
+	}
+	if store != nil {
+		client.queue.restore(store, restored)
+		if len(restored) > 0 {
+			config.logger().Printf("Restored %d unsent messages", len(restored))
+		}
+	}
+	return client, nil
 }
 
 // Connect осуществляет подключение к APNS и возвращает ошибку, если подключение установить
@@ -41,57 +236,555 @@ func NewClient(config *Config) *Client {
 // не использования сервиса, переподключение к серверу тоже произойдет автоматичеки, когда
 // потребуется отправить новые данные.
 func (client *Client) Connect() error {
-	client.config.log.Println("Connecting to server", client.host)
-	tlsConn, err := client.config.Dial(client.host)
+	netConn, err := client.dial()
 	if err != nil {
 		return err
 	}
-	client.config.log.Print(tlsConnectionStateString(tlsConn))
 	var conn = &apnsConn{
-		Conn:   tlsConn,
+		Conn:   netConn,
 		client: client,
 	}
 	conn.connected.Set(true)
-	go conn.handleReads() // запускаем чтение ошибок из соединения
+	go conn.handleReads(netConn) // запускаем чтение ошибок из соединения
 	client.conn = conn
+	client.keepAlive()
+	return nil
+}
+
+// ResetConnection закрывает текущее соединение с сервером, не закрывая клиента: новое соединение
+// устанавливается при следующей отправке уведомлений (или проверкой KeepAlive, если она включена).
+// Это позволяет переподключиться к серверу, например, после смены сертификата, не создавая клиента
+// заново. Сертификат, заданный в Config, при этом не перечитывается: для его замены во время работы
+// клиента используйте Config.TLSConfig с функцией GetClientCertificate, не задавая Certificate. Учтите,
+// что при использовании Config.SessionCache новое соединение может возобновить прежнюю TLS-сессию,
+// установленную со старым сертификатом.
+//
+// Метод можно вызывать одновременно с отправкой: уведомления из пакета, запись которого прервана
+// закрытием соединения, возвращаются в очередь и отправляются повторно уже через новое соединение.
+// Но ошибки, которые сервер успел вернуть для уже отправленных уведомлений в закрываемое соединение,
+// будут потеряны. Для закрытого клиента возвращается ErrClientIsClosed.
+func (client *Client) ResetConnection() error {
+	if client.closed.Is() {
+		return ErrClientIsClosed
+	}
+	if client.conn.Reset() {
+		client.currentConfig().logger().Println("Connection reset")
+	}
+	return nil
+}
+
+// SetConfig заменяет конфигурацию клиента, например, при замене сертификата с истекающим сроком
+// действия, и закрывает текущее соединение с сервером (см. ResetConnection): следующая отправка
+// устанавливает новое соединение уже с новым сертификатом. Уведомления в очереди и в кеше
+// отправленных при этом сохраняются.
+//
+// Новая конфигурация должна соответствовать тому же серверу APNS (Host и Sandbox), иначе
+// возвращается ошибка ErrConfigServer. Сертификат проверяется так же, как в NewClient. Параметры,
+// которые используются только при создании клиента (CacheSize, CacheLifeTime и PersistPath),
+// из новой конфигурации не применяются. Переданную конфигурацию нельзя изменять после вызова.
+func (client *Client) SetConfig(config *Config) error {
+	if client.closed.Is() {
+		return ErrClientIsClosed
+	}
+	if config.serverAddr() != client.host {
+		return ErrConfigServer
+	}
+	if err := config.checkEnvironment(); err != nil {
+		return err
+	}
+	client.configMu.Lock()
+	client.config = config
+	client.configMu.Unlock()
+	config.logger().Println("Config replaced")
+	client.conn.Reset()
 	return nil
 }
 
+// currentConfig возвращает текущую конфигурацию клиента.
+func (client *Client) currentConfig() *Config {
+	client.configMu.RLock()
+	var config = client.config
+	client.configMu.RUnlock()
+	return config
+}
+
+// dial устанавливает новое соединение с сервером и возвращает его. Время ожидания ответа для
+// соединения устанавливается равным времени простоя, после которого соединение закрывается.
+func (client *Client) dial() (net.Conn, error) {
+	var config = client.currentConfig() // соединение устанавливается с одной конфигурацией
+	config.logger().Println("Connecting to server", client.host)
+	var netConn net.Conn
+	if client.dialFunc != nil {
+		conn, err := client.dialFunc(client.host)
+		if err != nil {
+			return nil, err
+		}
+		netConn = conn
+	} else {
+		tlsConn, err := config.Dial(client.host)
+		if err != nil {
+			return nil, err
+		}
+		config.logger().Print(newTLSState(tlsConn, config))
+		if tcpConn, ok := tlsConn.NetConn().(*net.TCPConn); ok && client.KeepAlive > 0 {
+			tcpConn.SetKeepAlive(true)
+			tcpConn.SetKeepAlivePeriod(client.KeepAlive)
+		}
+		netConn = tlsConn
+	}
+	netConn.SetReadDeadline(time.Now().Add(client.idleTimeout()))
+	return netConn, nil
+}
+
+// keepAlive запускает, если она еще не запущена и включена, периодическую проверку соединения с
+// сервером: если соединение закрыто, то оно устанавливается заново. Проверка прекращается при
+// закрытии клиента.
+func (client *Client) keepAlive() {
+	if client.KeepAlive <= 0 || client.keeping.Swap(true) {
+		return
+	}
+	go func() {
+		var ticker = time.NewTicker(client.KeepAlive)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-client.done:
+				return
+			}
+			if !client.conn.isConnected() && !client.closed.Is() {
+				client.currentConfig().logger().Println("Keepalive: restoring connection")
+				client.conn.Connect()
+			}
+			if err := client.conn.fill(); err != nil && err != ErrClientIsClosed {
+				client.currentConfig().logger().Println("Keepalive: warmup error:", err)
+			}
+		}
+	}()
+}
+
+// inFlightLimit возвращает допустимое количество отправленных, но еще не считающихся доставленными
+// уведомлений с учетом ThrottleUnconfirmed и MaxInFlight или 0, если оно не ограничено.
+func (client *Client) inFlightLimit() int {
+	var limit int
+	if client.ThrottleUnconfirmed {
+		limit = client.queue.size
+	}
+	if client.MaxInFlight > 0 && (limit == 0 || client.MaxInFlight < limit) {
+		limit = client.MaxInFlight
+	}
+	if limit > client.queue.size { // в кеше не хранится больше уведомлений
+		limit = client.queue.size
+	}
+	return limit
+}
+
+// idleTimeout возвращает время простоя, после которого соединение с сервером закрывается.
+func (client *Client) idleTimeout() time.Duration {
+	if client.IdleTimeout > 0 {
+		return client.IdleTimeout
+	}
+	return TiemoutRead
+}
+
+// minPollInterval задает минимальный интервал периодических проверок при ожидании отправки: без
+// него при нулевом SendDelay ожидание превращается в непрерывный опрос, занимающий процессор.
+const minPollInterval = time.Millisecond
+
+// pollInterval возвращает интервал, с которым проверяется состояние очереди и отправки при их
+// ожидании: SendDelay, но не меньше minPollInterval.
+func (client *Client) pollInterval() time.Duration {
+	if client.SendDelay < minPollInterval {
+		return minPollInterval
+	}
+	return client.SendDelay
+}
+
+// ReconnectBackoff возвращает максимальную задержку перед следующей попыткой соединения с сервером
+// в случае ошибки. После каждой неудачной попытки она удваивается, пока не достигнет ReconnectMax,
+// а после установки соединения снова становится равной ReconnectBase. Фактическая задержка
+// выбирается случайно от нуля до этой величины (см. ReconnectDelay).
+func (client *Client) ReconnectBackoff() time.Duration {
+	if backoff, _ := client.conn.backoffs(); backoff > 0 {
+		return backoff
+	}
+	return client.ReconnectBase
+}
+
+// ReconnectDelay возвращает фактическую задержку, выбранную для последней повторной попытки
+// соединения с сервером, или 0, если соединение еще ни разу не прерывалось.
+func (client *Client) ReconnectDelay() time.Duration {
+	var _, delay = client.conn.backoffs()
+	return delay
+}
+
+// ErrorCounts возвращает копию статистики ошибок, полученных от сервера APNS, в виде
+// количества ошибок для каждого кода статуса.
+func (client *Client) ErrorCounts() map[uint8]uint64 {
+	return client.errors.Snapshot()
+}
+
 // Send помещает уведомление для указанных токенов устройств в очередь на отправку и запускает
 // сервис отправки, если он не был запущен.
+//
+// Уведомления для всех токенов одного вызова помещаются в очередь подряд, в порядке следования
+// токенов, и получают возрастающие идентификаторы. Поэтому уведомления, отправляемые одним потоком
+// последовательными вызовами, всегда отправляются на сервер в порядке этих вызовов. Порядок
+// уведомлений из разных потоков, одновременно вызывающих Send, определяется тем, какой из вызовов
+// первым получит доступ к очереди, но уведомления каждого из потоков между собой не перемешиваются.
+// Повторная отправка уведомлений после ошибки этот порядок сохраняет.
 func (client *Client) Send(ntf *Notification, tokens ...string) error {
+	client.warnIgnored(ntf.CollapseID)
+	template, err := ntf.convert() // конвертируем сообщение во внутреннее представление
+	if err != nil {
+		return err
+	}
+	return client.enqueue(context.Background(), template, tokens)
+}
+
+// SendIDs работает аналогично Send, но возвращает идентификаторы, присвоенные уведомлениям, в порядке
+// следования токенов. Для токенов, которые были пропущены (неверный формат или размер, Blocklist,
+// несоответствие окружения), вместо идентификатора возвращается 0. По этим идентификаторам можно
+// сопоставить ошибки, переданные в OnError, с конкретными вызовами.
+//
+// Идентификаторы уникальны только в пределах одного клиента: каждый новый клиент начинает нумерацию
+// заново (если очередь не восстанавливается из Config.PersistPath), а после 4294967295 уведомлений
+// нумерация начинается сначала. Вместо автоматически назначаемого можно использовать собственный
+// идентификатор, указав его в Notification.ID: такое уведомление отправляется только на один токен
+// устройства (иначе возвращается ErrIDMultipleTokens), а если уведомление с тем же идентификатором
+// еще находится в очереди или в кеше отправленных, то возвращается ErrDuplicateID.
+func (client *Client) SendIDs(ntf *Notification, tokens ...string) ([]uint32, error) {
+	client.warnIgnored(ntf.CollapseID)
+	template, err := ntf.convert() // конвертируем сообщение во внутреннее представление
+	if err != nil {
+		return nil, err
+	}
+	return client.enqueueIDs(context.Background(), template, tokens)
+}
+
+// SendStrict работает аналогично Send, но не игнорирует молча токены устройств с неверным форматом,
+// а возвращает их список с указанием причины: ErrTokenHex или ErrTokenSize. Уведомления для
+// остальных токенов при этом помещаются в очередь, как обычно.
+func (client *Client) SendStrict(ntf *Notification, tokens ...string) ([]TokenError, error) {
+	client.warnIgnored(ntf.CollapseID)
+	template, err := ntf.convert() // конвертируем сообщение во внутреннее представление
+	if err != nil {
+		return nil, err
+	}
+	valid, rejected := rejectTokens(client.normalizeTokens(tokens))
+	return rejected, client.enqueue(context.Background(), template, valid)
+}
+
+// SendContext работает аналогично Send, но если этот вызов запускает отправку уведомлений из
+// очереди, то она прекращается при отмене переданного контекста: после отправки очередного пакета
+// уведомлений отправка останавливается, а все еще не отправленные уведомления остаются в очереди
+// и будут отправлены при следующем вызове Send. Если отправка уже была запущена другим вызовом, то
+// она продолжается независимо от этого контекста. Если контекст уже отменен, то уведомление не
+// добавляется в очередь и возвращается ошибка контекста.
+func (client *Client) SendContext(ctx context.Context, ntf *Notification, tokens ...string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	client.warnIgnored(ntf.CollapseID)
+	template, err := ntf.convert() // конвертируем сообщение во внутреннее представление
+	if err != nil {
+		return err
+	}
+	return client.enqueue(ctx, template, tokens)
+}
+
+// SendCompiled помещает заранее подготовленное с помощью PrecompileNotification уведомление для
+// указанных токенов устройств в очередь на отправку. В отличие от Send, содержимое уведомления
+// при этом повторно не проверяется и не сериализуется.
+func (client *Client) SendCompiled(ntf *CompiledNotification, tokens ...string) error {
+	client.warnIgnored(ntf.collapseID)
+	if ntf.template.IsExpired() {
+		return ErrNotificationExpired
+	}
+	return client.enqueue(context.Background(), ntf.template, tokens)
+}
+
+// warnIgnored выводит в лог предупреждение, если у уведомления задан идентификатор группировки:
+// бинарный протокол его не поддерживает, поэтому уведомления не будут объединяться на устройстве.
+// Предупреждение выводится только один раз для клиента, чтобы не засорять лог при каждой отправке.
+func (client *Client) warnIgnored(collapseID string) {
+	if collapseID == "" || client.warned.Swap(true) {
+		return
+	}
+	client.currentConfig().logger().Printf("Collapse id %q is ignored by the binary protocol", collapseID)
+}
+
+// enqueue помещает уведомление для указанных токенов устройств в очередь на отправку и запускает
+// сервис отправки с указанным контекстом, если он не был запущен.
+func (client *Client) enqueue(ctx context.Context, template *notification, tokens []string) error {
+	_, err := client.enqueueIDs(ctx, template, tokens)
+	return err
+}
+
+// enqueueIDs работает аналогично enqueue, но возвращает идентификаторы добавленных в очередь
+// уведомлений в порядке следования токенов (0 для пропущенных токенов).
+func (client *Client) enqueueIDs(ctx context.Context, template *notification, tokens []string) ([]uint32, error) {
 	if client.closed.Is() {
-		return ErrClientIsClosed
+		return nil, ErrClientIsClosed
+	}
+	if len(tokens) == 0 && client.RequireTokens {
+		return nil, ErrNoTokens
+	}
+	template, err := client.prepare(template)
+	if err != nil {
+		return nil, err
+	}
+	if err := client.waitQueue(ctx, len(tokens)); err != nil {
+		return nil, err
+	}
+	tokens = client.normalizeTokens(tokens)
+	if !fitsFrame(template, maxTokenLen(tokens)) {
+		return nil, ErrNotificationTooLarge
 	}
 	// добавляем сообщение в очередь на отправку
-	if err := client.queue.AddNotification(ntf, tokens...); err != nil {
-		return err
+	ids, err := client.queue.add(template, tokens, client.tokenFilter())
+	if err != nil {
+		return nil, err
+	}
+	client.start(ctx) // разбираемся с отправкой
+	return ids, nil
+}
+
+// waitQueue проверяет, что в очереди есть место для n новых уведомлений (см. MaxQueueSize). Если
+// очередь заполнена, то в зависимости от BlockWhenFull возвращается ошибка ErrQueueFull или
+// ожидается освобождение места.
+func (client *Client) waitQueue(ctx context.Context, n int) error {
+	return client.waitQueueLimit(ctx, n, client.MaxQueueSize, client.BlockWhenFull)
+}
+
+// waitQueueLimit проверяет, что в очереди есть место для n новых уведомлений с учетом ограничения
+// limit, и, если block не задан, возвращает ErrQueueFull, а иначе ждет освобождения места. Если
+// очередь пуста, то место считается свободным, даже если n больше limit: иначе такие уведомления
+// никогда не попали бы в очередь.
+func (client *Client) waitQueueLimit(ctx context.Context, n, limit int, block bool) error {
+	if limit <= 0 {
+		return nil
+	}
+	for {
+		var pending = client.queue.PendingCount()
+		if pending == 0 || pending+n <= limit {
+			return nil
+		}
+		if !block {
+			return ErrQueueFull
+		}
+		client.start(ctx) // очередь освобождается только при отправке
+		select {
+		case <-time.After(client.pollInterval()):
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-client.done:
+			return ErrClientIsClosed
+		}
+		if client.closed.Is() {
+			return ErrClientIsClosed
+		}
+	}
+}
+
+// prepare возвращает шаблон уведомления, подготовленный к помещению в очередь: если у уведомления
+// не задано время жизни, то оно устанавливается в соответствии с DefaultExpiration, а если не задан
+// и он — максимально возможным, чтобы сервер хранил уведомление и повторял попытки доставки как
+// можно дольше. Исходное уведомление при этом не изменяется. Если содержимое уведомления не
+// проходит проверку PayloadValidator, то возвращается ее ошибка.
+func (client *Client) prepare(template *notification) (*notification, error) {
+	if err := client.checkPayload(template.Payload); err != nil {
+		return nil, err
+	}
+	if !template.hasExpiration() {
+		var copy = *template
+		copy.Expiration = client.defaultExpiration()
+		template = &copy
+	}
+	return template, nil
+}
+
+// checkPayload проверяет сериализованное содержимое уведомления с помощью PayloadValidator и
+// выводит предупреждение, если оно длиннее PayloadWarningSize.
+func (client *Client) checkPayload(payload []byte) error {
+	if client.PayloadValidator != nil {
+		if err := client.PayloadValidator(payload); err != nil {
+			return err
+		}
 	}
-	// разбираемся с отправкой
-	if !client.sending.Is() {
-		client.sending.Set(true)
-		go client.sendQueue() // запускаем отправку сообщений из очереди
+	if client.PayloadWarningSize > 0 && len(payload) > client.PayloadWarningSize {
+		client.currentConfig().logger().Printf("Large payload: %d bytes (warning size %d)",
+			len(payload), client.PayloadWarningSize)
 	}
 	return nil
 }
 
+// defaultExpiration возвращает время жизни для уведомления, у которого оно не задано (см. prepare).
+func (client *Client) defaultExpiration() uint32 {
+	if client.DefaultExpiration > 0 {
+		return uint32(time.Now().Add(client.DefaultExpiration).Unix())
+	}
+	return expirationForever
+}
+
+// start запускает сервис отправки уведомлений из очереди, если он не был запущен и не включен
+// режим ManualSend. Отправка прекращается при отмене переданного контекста.
+func (client *Client) start(ctx context.Context) {
+	if !client.ManualSend && !client.sending.Swap(true) {
+		go client.sendQueue(ctx) // запускаем отправку сообщений из очереди
+	}
+}
+
 // Close закрывает соединение с APNS-сервером. Если в качестве параметра передано true, то перед
 // закрытием метод будет ждать, пока не будут отправлены все уведомления из очереди. В противном
 // случае очередь будет проигнорирована и уведомления из нее могут быть не доставлены.
+//
+// При закрытии так же останавливаются все фоновые процессы клиента, включая периодическую очистку
+// кеша отправленных уведомлений, поэтому закрытый клиент не удерживает ресурсов.
 func (client *Client) Close(wait bool) {
 	client.closed.Set(true)
 	if wait {
 	repeat:
 		if client.sending.Is() { // ждем окончания рассылки
-			time.Sleep(DurationSend)
+			time.Sleep(client.pollInterval())
 			goto repeat
 		}
 	}
+	client.stop()
+}
+
+// CloseContext закрывает клиента, предварительно пытаясь отправить все уведомления из очереди,
+// но не дольше, чем позволяет контекст. По истечении контекста соединение с сервером закрывается
+// принудительно, даже если отправка не завершена. Возвращает количество так и не отправленных
+// уведомлений, а если контекст истек раньше окончания отправки, то и ошибку контекста.
+func (client *Client) CloseContext(ctx context.Context) (int, error) {
+	client.closed.Set(true)
+	var err error
+wait:
+	for client.sending.Is() { // ждем окончания рассылки
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+			break wait
+		case <-time.After(client.pollInterval()):
+		}
+	}
+	client.stop()
+	// после закрытия соединения отправка прерывается, а недоставленные уведомления остаются в очереди
+	for client.sending.Is() {
+		time.Sleep(time.Millisecond)
+	}
+	return client.queue.PendingCount(), err
+}
+
+// Shutdown корректно завершает работу клиента: сразу перестает принимать новые уведомления (Send
+// возвращает ErrClientIsClosed), запускает отправку уже находящихся в очереди, даже в режиме
+// ManualSend, и ждет ее окончания, но не дольше, чем позволяет контекст. После этого соединение с
+// сервером закрывается и останавливаются все фоновые процессы клиента.
+//
+// Если все уведомления отправлены, то возвращается nil. Иначе возвращается ShutdownError с
+// количеством неотправленных уведомлений и, если контекст истек раньше, ошибкой контекста. Для
+// уже закрытого клиента возвращается ErrClientIsClosed.
+func (client *Client) Shutdown(ctx context.Context) error {
+	if client.closed.Swap(true) {
+		return ErrClientIsClosed
+	}
+	if client.queue.IsHasToSend() && !client.sending.Swap(true) {
+		// истечение контекста прерывает отправку закрытием соединения, поэтому он не передается
+		go client.sendQueue(context.Background())
+	}
+	pending, err := client.CloseContext(ctx)
+	if pending > 0 || err != nil {
+		return ShutdownError{Pending: pending, Err: err}
+	}
+	return nil
+}
+
+// ShutdownError описывает ошибку завершения работы клиента, при котором не все уведомления из
+// очереди были отправлены.
+type ShutdownError struct {
+	Pending int   // количество неотправленных уведомлений
+	Err     error // ошибка контекста, если он истек до окончания отправки
+}
+
+// Error возвращает строковое представление ошибки.
+func (e ShutdownError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("shutdown: %d notifications not sent", e.Pending)
+	}
+	return fmt.Sprintf("shutdown: %d notifications not sent: %v", e.Pending, e.Err)
+}
+
+// Unwrap возвращает ошибку контекста.
+func (e ShutdownError) Unwrap() error { return e.Err }
+
+// stop прерывает отправку уведомлений и закрывает соединение с сервером.
+func (client *Client) stop() {
+	client.once.Do(func() {
+		close(client.done)
+		client.queue.Close() // останавливаем очистку кеша
+	})
 	if client.conn != nil {
 		client.conn.Close()
 	}
 }
 
+// Flush запускает отправку уведомлений из очереди и ждет, пока все они не будут отправлены на
+// сервер, или пока не истечет переданный контекст. Это позволяет программам, которые завершаются
+// сразу после отправки уведомлений, не потерять их.
+//
+// Если все уведомления отправлены, то возвращается nil, даже если во время отправки соединение
+// с сервером пришлось восстанавливать. Если же контекст истек раньше, то возвращается последняя
+// ошибка соединения, случившаяся во время ожидания, а если ее не было — ошибка контекста.
+// Уведомления, не отправленные к этому моменту, остаются в очереди. При включенном ManualSend
+// отправка выполняется так же, как в DrainOnce, но прекращается при истечении контекста.
+func (client *Client) Flush(ctx context.Context) error {
+	if client.closed.Is() {
+		return ErrClientIsClosed
+	}
+	var failures = atomic.LoadUint64(&client.sendErrors)
+	if client.ManualSend {
+		if !client.sending.Swap(true) {
+			go client.sendQueue(ctx)
+		}
+	} else {
+		// истечение контекста не должно останавливать отправку, поэтому он не передается
+		client.start(context.Background())
+	}
+	// уведомления, взятые из очереди, считаются отправленными только после окончания отправки
+	for client.queue.IsHasToSend() || client.sending.Is() {
+		if client.closed.Is() {
+			return ErrClientIsClosed
+		}
+		select {
+		case <-ctx.Done():
+			if atomic.LoadUint64(&client.sendErrors) != failures {
+				client.errMu.Lock()
+				defer client.errMu.Unlock()
+				return client.lastErr
+			}
+			return ctx.Err()
+		case <-time.After(client.pollInterval()):
+		}
+	}
+	return nil
+}
+
+// DrainOnce синхронно отправляет на сервер все уведомления из очереди, при необходимости
+// устанавливая соединение, и возвращает управление, когда очередь опустеет. Уведомления, добавленные
+// во время отправки, тоже будут отправлены. Используется при включенном ManualSend: одновременно с
+// автоматической отправкой вызывать DrainOnce нельзя.
+func (client *Client) DrainOnce() error {
+	if client.closed.Is() {
+		return ErrClientIsClosed
+	}
+	client.sendQueue(context.Background())
+	if client.closed.Is() {
+		return ErrClientIsClosed // клиент закрыт во время отправки
+	}
+	return nil
+}
+
 // sendQueue непосредственно осуществляет отправку уведомлений на сервер, пока в очереди есть
 // хотя бы одно уведомление. Если в процессе отсылки происходит ошибка соединения, то соединение
 // автоматически восстанавливается.
@@ -102,7 +795,10 @@ func (client *Client) Close(wait bool) {
 //
 // Функция отслеживает попытку запуска нескольких копий и не позволяет это делать ввиду полной
 // не эффективности данного мероприятия.
-func (client *Client) sendQueue() {
+//
+// При отмене контекста отправка прекращается после отправки очередного пакета, а не отправленные
+// уведомления остаются в очереди.
+func (client *Client) sendQueue(ctx context.Context) {
 	// defer un(trace("[send]"))        // DEBUG
 	if !client.queue.IsHasToSend() { // выходим, если нечего отправлять
 		// log.Println("Nothing to send...")
@@ -110,49 +806,144 @@ func (client *Client) sendQueue() {
 	}
 	// отправляем сообщения на сервер
 	var (
-		ntf    *notification // последнее полученное на отправку уведомление
-		sended uint          // количество отправленных
-		buf    = getBuffer() // получаем из пулла байтовый буфер
+		ntf   *notification   // последнее полученное на отправку уведомление
+		frame []*notification // уведомления, находящиеся в буфере
+		buf   = getBuffer()   // получаем из пулла байтовый буфер
 	)
 reconnect:
 	for { // делаем это пока не отправим все...
 		// проверяем соединение: если не установлено, то соединяемся
-		if client.conn == nil || !client.conn.connected.Is() {
+		if client.conn == nil || !client.conn.isConnected() {
 			if err := client.conn.Connect(); err != nil {
 				break // выходим, если не удалось соединиться с сервером.
 			}
 		}
 		for { // пока не отправим все
+			// если превышено допустимое количество неподтвержденных уведомлений, то отправляем
+			// уже накопленное и ждем, пока часть из них не будет считаться доставленной
+			if limit := client.inFlightLimit(); ntf == nil && limit > 0 &&
+				client.queue.Unconfirmed() >= limit {
+				if buf.Len() > 0 {
+					err := client.flush(buf, frame)
+					if err != nil {
+						client.requeue(buf, frame)
+						client.conn.disconnect() // следующий проход устанавливает новое соединение
+					}
+					frame = frame[:0]
+					if err != nil {
+						break // ошибка соединения - соединяемся заново
+					}
+				}
+				if ctx.Err() != nil {
+					break reconnect // отправка прервана
+				}
+				time.Sleep(client.pollInterval())
+				continue
+			}
 			// если уведомление уже было раньше получено, то новое не получаем
 			if ntf == nil {
 				ntf = client.queue.Get() // получаем уведомление из очереди
-				if ntf == nil && DurationSend > 0 {
-					time.Sleep(DurationSend) // если очередь пуста, то подождем немного
-					ntf = client.queue.Get() // попробуем еще раз...
+				if ntf == nil && client.SendDelay > 0 && !client.ManualSend {
+					time.Sleep(client.SendDelay) // если очередь пуста, то подождем немного
+					ntf = client.queue.Get()     // попробуем еще раз...
+				}
+				// отбрасываются только уведомления, время жизни которых истекло в очереди: если оно
+				// прошло еще при создании, то уведомление отправляется с нулевым (Immediate)
+				if ntf != nil && ntf.IsExpired() {
+					client.queue.MarkSent(ntf) // не сохраняем, раз оно уже не будет отправлено
+					client.report(newSendResult(ntf, ErrNotificationExpired))
+					ntf = nil // устаревшее уведомление не отправляем
+					continue
 				}
 			}
+			// уведомление, которое не помещается даже в пустой фрейм, отправить невозможно
+			if ntf != nil && ntf.Len() > MaxFrameBuffer {
+				client.currentConfig().logger().Printf("Message [%d] is too large: %d bytes", ntf.ID, ntf.Len())
+				client.queue.MarkSent(ntf)
+				client.report(newSendResult(ntf, ErrNotificationTooLarge))
+				ntf = nil
+				continue
+			}
 			// если больше нет уведомлений, а буфер не пустой, или после добавления
 			// этого уведомления буфер переполнится, то отправляем буфер на сервер
-			if (ntf == nil && buf.Len() > 0) || (buf.Len()+ntf.Len() > MaxFrameBuffer) {
-				n, err := buf.WriteTo(client.conn) // отправляем буфер на сервер
+			if (ntf == nil && buf.Len() > 0) ||
+				(ntf != nil && buf.Len()+ntf.Len() > MaxFrameBuffer) {
+				err := client.flush(buf, frame)
+				if err != nil {
+					client.requeue(buf, frame)
+					ntf = nil                // уведомление тоже возвращено в очередь
+					client.conn.disconnect() // следующий проход устанавливает новое соединение
+				}
+				frame = frame[:0] // очищаем список отправленного
 				if err != nil {
-					client.config.log.Println("Send error:", err)
 					break // ошибка соединения - соединяемся заново
 				}
-				// увеличиваем время ожидания ответа после успешной отправки данных
-				client.conn.SetReadDeadline(time.Now().Add(TiemoutRead))
-				client.config.log.Printf("Sended %d messages (%d bytes)", sended, n)
-				sended = 0 // сбрасываем счетчик отправленного
+				if ctx.Err() != nil { // отправка прервана: оставшееся остается в очереди
+					if ntf != nil {
+						client.queue.Requeue(ntf.ID)
+					}
+					break reconnect
+				}
 			}
 			if ntf == nil { // очередь закончилась
 				// log.Println("Queue is empty...")
 				break reconnect // прерываем весь цикл
 			}
-			ntf.WriteTo(buf) // сохраняем бинарное представление уведомления в буфере
-			ntf = nil        // забываем про уже отправленное
-			sended++         // увеличиваем счетчик отправленного
+			ntf.WriteTo(buf)           // сохраняем бинарное представление уведомления в буфере
+			frame = append(frame, ntf) // запоминаем уведомление в списке отправленного
+			ntf = nil                  // забываем про уже отправленное
 		}
 	}
 	putBuffer(buf)            // освобождаем буфер после работы
 	client.sending.Set(false) // сбрасываем флаг активной посылки
+	// уведомления, добавленные в очередь во время завершения отправки, не должны в ней остаться
+	if client.queue.IsHasToSend() && !client.closed.Is() && ctx.Err() == nil {
+		client.start(ctx)
+	}
+}
+
+// requeue очищает буфер, который не удалось отправить, и возвращает в очередь на отправку все
+// уведомления, начиная с первого уведомления из этого буфера.
+func (client *Client) requeue(buf *bytes.Buffer, frame []*notification) {
+	buf.Reset()
+	var count = client.queue.Requeue(frame[0].ID)
+	atomic.AddUint64(&client.requeued, uint64(count))
+}
+
+// flush отправляет содержимое буфера на сервер. В качестве параметра так же передается список
+// уведомлений в буфере: задержка отправки отсчитывается от времени получения из очереди первого
+// из них, а после успешной отправки для каждого из них сообщается результат.
+func (client *Client) flush(buf *bytes.Buffer, frame []*notification) error {
+	var data []byte
+	if client.Audit != nil {
+		data = append(data, buf.Bytes()...) // копия фрейма для журнала аудита
+	}
+	if err := client.waitRate(len(frame)); err != nil {
+		return err // клиент закрыт: фрейм возвращается в очередь
+	}
+	n, err := buf.WriteTo(client.conn) // отправляем буфер на сервер
+	if err != nil {
+		client.currentConfig().logger().Println("Send error:", err)
+		client.errMu.Lock()
+		client.lastErr = err
+		client.errMu.Unlock()
+		atomic.AddUint64(&client.sendErrors, 1)
+		return err
+	}
+	if data != nil {
+		client.writeAudit(data)
+	}
+	if client.Latency != nil {
+		client.Latency.Record(time.Since(frame[0].Sended))
+	}
+	atomic.AddUint64(&client.sent, uint64(len(frame)))
+	client.queue.MarkSent(frame...)
+	for _, ntf := range frame {
+		client.report(newSendResult(ntf, nil))
+	}
+	client.scheduleDelivered()
+	// увеличиваем время ожидания ответа после успешной отправки данных
+	client.conn.SetReadDeadline(time.Now().Add(client.idleTimeout()))
+	client.currentConfig().logger().Printf("Sended %d messages (%d bytes)", len(frame), n)
+	return nil
 }
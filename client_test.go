@@ -1,9 +1,21 @@
 package apns
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
 	"math/rand"
+	"net"
+	"runtime"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -19,18 +31,10 @@ func TestClient(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	var tokens = make([][]byte, len(tokenStrings))
-	for i, str := range tokenStrings {
-		token, err := hex.DecodeString(str)
-		if err != nil {
-			t.Fatal(err)
-		}
-		tokens[i] = token
+	client, err := NewClient(config)
+	if err != nil {
+		t.Fatal(err)
 	}
-	client := NewClient(config)
-	// if err != nil {
-	// 	t.Fatal(err)
-	// }
 	// client.Delay = time.Duration(0)
 
 	var wg sync.WaitGroup
@@ -51,7 +55,7 @@ func TestClient(t *testing.T) {
 					// "inf64":  rand.Int63(),
 					// "float":  rand.Float64(),
 				}}
-				if err := client.Send(ntf, tokens...); err != nil {
+				if err := client.Send(ntf, tokenStrings...); err != nil {
 					t.Error(err)
 				}
 				wg.Done()
@@ -70,3 +74,901 @@ func TestClient(t *testing.T) {
 	fmt.Println("Complete! Time:", time.Since(start).String())
 	// time.Sleep(time.Second * 10)
 }
+
+func TestClientDefaultExpiration(t *testing.T) {
+	client := newOfflineClient(t, new(Config))
+	client.DefaultExpiration = time.Hour
+
+	var (
+		payload  = map[string]interface{}{"aps": map[string]interface{}{"alert": "test"}}
+		explicit = time.Now().Add(10 * time.Minute)
+	)
+	if err := client.Send(&Notification{Payload: payload}, tokenStrings[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Send(&Notification{Payload: payload, Expiration: explicit},
+		tokenStrings[1]); err != nil {
+		t.Fatal(err)
+	}
+	if len(client.queue.list) != 2 {
+		t.Fatalf("queue length %d, expected 2", len(client.queue.list))
+	}
+	var expiration = client.queue.list[0].ExpirationTime()
+	if d := time.Until(expiration); d <= 59*time.Minute || d > time.Hour {
+		t.Errorf("default expiration not applied: %v", expiration)
+	}
+	if client.queue.list[1].Expiration != uint32(explicit.Unix()) {
+		t.Errorf("explicit expiration overridden: %v", client.queue.list[1].ExpirationTime())
+	}
+}
+
+func TestClientExpirationFrame(t *testing.T) {
+	var (
+		payload  = NewPayload().Alert("test")
+		explicit = time.Now().Add(time.Hour).Truncate(time.Second)
+	)
+	for _, test := range []struct {
+		expiration time.Time
+		expected   uint32
+	}{
+		{time.Time{}, math.MaxUint32}, // не указано — храним максимально долго
+		{explicit, uint32(explicit.Unix())},
+		{time.Now().Add(-time.Hour), 0}, // уже прошло — сервер не хранит уведомление
+	} {
+		client := newOfflineClient(t, new(Config))
+		if err := client.Send(&Notification{Payload: payload, Expiration: test.expiration},
+			tokenStrings[0]); err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if _, err := client.queue.WriteTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+		frame, err := readFrame(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var expiration []byte
+		for items := frame[5:]; len(items) >= 3; { // перебираем элементы фрейма
+			var size = 3 + int(binary.BigEndian.Uint16(items[1:3]))
+			if items[0] == 4 {
+				expiration = items[3:size]
+			}
+			items = items[size:]
+		}
+		if len(expiration) != 4 {
+			t.Fatalf("no expiration item in frame:\n% x", frame)
+		}
+		if value := binary.BigEndian.Uint32(expiration); value != test.expected {
+			t.Errorf("expiration %d, expected %d", value, test.expected)
+		}
+	}
+}
+
+func TestClientAudit(t *testing.T) {
+	client, server := newTestClient(t)
+	var audit = new(syncBuffer)
+	client.Audit = audit
+	var payload = map[string]interface{}{"aps": map[string]interface{}{"alert": "test"}}
+	if err := client.Send(&Notification{Payload: payload}, tokenStrings...); err != nil {
+		t.Fatal(err)
+	}
+	var (
+		conn     = server.Accept(t)
+		received = new(syncBuffer)
+		copied   = make(chan struct{})
+	)
+	go func() {
+		io.Copy(received, conn)
+		close(copied)
+	}()
+	client.Close(true)
+	<-copied
+	if received.buf.Len() == 0 {
+		t.Fatal("nothing sent")
+	}
+	for start := time.Now(); len(audit.Bytes()) < received.buf.Len(); {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("audit timeout")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !bytes.Equal(audit.Bytes(), received.Bytes()) {
+		t.Error("audit frames differ from sent")
+	}
+	if client.AuditDropped() != 0 {
+		t.Errorf("dropped %d audit frames", client.AuditDropped())
+	}
+}
+
+func TestClientCacheOptions(t *testing.T) {
+	client := newOfflineClient(t, &Config{CacheSize: 500, CacheLifeTime: 20 * time.Millisecond})
+	defer client.Close(false)
+	if size := cap(client.queue.list); size != 500 {
+		t.Errorf("cache capacity %d, expected 500", size)
+	}
+	if err := client.Send(&Notification{Payload: NewPayload().Alert("test")},
+		testTokens(3)...); err != nil {
+		t.Fatal(err)
+	}
+	for ntf := client.queue.Get(); ntf != nil; ntf = client.queue.Get() {
+		client.queue.MarkSent(ntf) // помечаем уведомления как отправленные
+	}
+	time.Sleep(100 * time.Millisecond) // кеш очищается с интервалом CacheLifeTime
+	client.queue.mu.RLock()
+	var cached = client.queue.idUnsended
+	client.queue.mu.RUnlock()
+	if cached != 0 {
+		t.Errorf("%d sent notifications left in cache", cached)
+	}
+	// без указания параметров используются значения по умолчанию
+	if size := newOfflineClient(t, new(Config)).queue.size; size != NotificationCacheSize {
+		t.Errorf("default cache size %d, expected %d", size, NotificationCacheSize)
+	}
+}
+
+func TestClientThrottleUnconfirmed(t *testing.T) {
+	defer func(size int, timeout time.Duration) {
+		NotificationCacheSize, TimeoutDelivered = size, timeout
+	}(NotificationCacheSize, TimeoutDelivered)
+	NotificationCacheSize = 2
+	TimeoutDelivered = 500 * time.Millisecond
+
+	client, server := newTestClient(t)
+	client.ThrottleUnconfirmed = true
+	var payload = map[string]interface{}{"aps": map[string]interface{}{"alert": "test"}}
+	if err := client.Send(&Notification{Payload: payload}, testTokens(5)...); err != nil {
+		t.Fatal(err)
+	}
+	var (
+		conn  = server.Accept(t)
+		start = time.Now()
+		times []time.Duration
+	)
+	for i := 0; i < 5; i++ {
+		if _, err := readFrame(conn); err != nil {
+			t.Fatal(err)
+		}
+		times = append(times, time.Since(start))
+	}
+	client.Close(false)
+	if times[1] >= TimeoutDelivered {
+		t.Errorf("first notifications delayed: %v", times)
+	}
+	if times[2] < TimeoutDelivered*4/5 || times[4] < TimeoutDelivered*9/5 {
+		t.Errorf("throttle not engaged: %v", times)
+	}
+}
+
+func TestClientMaxInFlight(t *testing.T) {
+	defer func(timeout time.Duration) { TimeoutDelivered = timeout }(TimeoutDelivered)
+	TimeoutDelivered = 300 * time.Millisecond
+
+	client, server := newTestClient(t)
+	client.MaxInFlight = 2
+	if limit := client.inFlightLimit(); limit != 2 {
+		t.Errorf("in-flight limit %d, expected 2", limit)
+	}
+	if err := client.Send(&Notification{Payload: NewPayload().Alert("test")}, testTokens(4)...); err != nil {
+		t.Fatal(err)
+	}
+	var (
+		conn  = server.Accept(t)
+		start = time.Now()
+		times []time.Duration
+	)
+	for i := 0; i < 4; i++ {
+		if _, err := readFrame(conn); err != nil {
+			t.Fatal(err)
+		}
+		times = append(times, time.Since(start))
+	}
+	client.Close(false)
+	for client.sending.Is() { // ждем окончания отправки перед изменением параметров
+		time.Sleep(10 * time.Millisecond)
+	}
+	if times[1] >= TimeoutDelivered {
+		t.Errorf("first window delayed: %v", times)
+	}
+	if times[2] < TimeoutDelivered*4/5 {
+		t.Errorf("window is not enforced: %v", times)
+	}
+	// ограничение не превышает размера кеша
+	client.MaxInFlight = client.queue.size + 1
+	if limit := client.inFlightLimit(); limit != client.queue.size {
+		t.Errorf("in-flight limit %d, expected %d", limit, client.queue.size)
+	}
+}
+
+func TestClientRequireTokens(t *testing.T) {
+	client := newOfflineClient(t, new(Config))
+	var ntf = &Notification{Payload: map[string]interface{}{"aps": map[string]interface{}{}}}
+	if err := client.Send(ntf); err != nil {
+		t.Errorf("lenient send: %v", err)
+	}
+	client.RequireTokens = true
+	if err := client.Send(ntf, []string{}...); err != ErrNoTokens {
+		t.Errorf("strict send: %v", err)
+	}
+	if err := client.Send(ntf, tokenStrings...); err != nil {
+		t.Errorf("strict send with tokens: %v", err)
+	}
+}
+
+func TestClientWarmup(t *testing.T) {
+	client, server := newTestClient(t)
+	defer client.Close(false)
+	if err := client.Warmup(3); err != nil {
+		t.Fatal(err)
+	}
+	var conns = []net.Conn{server.Accept(t), server.Accept(t), server.Accept(t)}
+	if count := client.Connections(); count != 3 {
+		t.Fatalf("%d connections after warmup, expected 3", count)
+	}
+	if err := client.Warmup(3); err != nil { // уже установленные соединения учитываются
+		t.Fatal(err)
+	}
+	if len(server.conns) != 0 {
+		t.Error("warmup reconnected live connections")
+	}
+	var payload = map[string]interface{}{"aps": map[string]interface{}{"alert": "test"}}
+	if err := client.Send(&Notification{Payload: payload}, tokenStrings[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readFrame(conns[0]); err != nil { // отправка через первое соединение
+		t.Fatal(err)
+	}
+	// после закрытия текущего соединения используется запасное без установки нового
+	conns[0].Close()
+	var waitConnections = func(count int) {
+		for i := 0; client.Connections() != count; i++ {
+			if i == 500 {
+				t.Fatalf("%d connections, expected %d", client.Connections(), count)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitConnections(2)
+	if len(server.conns) != 0 {
+		t.Error("client dialed instead of using spare connection")
+	}
+	if !client.conn.isConnected() {
+		t.Error("not connected after switching to spare connection")
+	}
+	conns[2].Close() // закрытое сервером запасное соединение удаляется
+	waitConnections(1)
+	if err := client.Warmup(2); err != nil {
+		t.Fatal(err)
+	}
+	server.Accept(t)
+	if count := client.Connections(); count != 2 {
+		t.Errorf("%d connections after second warmup, expected 2", count)
+	}
+}
+
+func TestClientLatency(t *testing.T) {
+	client, server := newTestClient(t)
+	client.Latency = new(LatencyHistogram)
+	var payload = map[string]interface{}{"aps": map[string]interface{}{"alert": "test"}}
+	for i := 0; i < 2; i++ {
+		if err := client.Send(&Notification{Payload: payload}, tokenStrings...); err != nil {
+			t.Fatal(err)
+		}
+		conn := server.Accept(t)
+		for range tokenStrings {
+			if _, err := readFrame(conn); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for client.sending.Is() { // ждем окончания отправки
+			time.Sleep(10 * time.Millisecond)
+		}
+		client.conn.disconnect() // следующая отправка через новое соединение
+	}
+	client.Close(false)
+	if count := client.Latency.Count(); count != 2 {
+		t.Errorf("recorded %d flushes, expected 2", count)
+	}
+	if client.Latency.Percentile(1) < client.SendDelay {
+		t.Errorf("latency %v less than send delay", client.Latency.Percentile(1))
+	}
+}
+
+func TestClientCloseContext(t *testing.T) {
+	var payload = map[string]interface{}{"aps": map[string]interface{}{"alert": "test"}}
+	t.Run("dead", func(t *testing.T) {
+		client, _ := newTestClient(t)
+		client.dialFunc = func(string) (net.Conn, error) { return nil, errors.New("unreachable") }
+		if err := client.Send(&Notification{Payload: payload}, testTokens(3)...); err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		var start = time.Now()
+		count, err := client.CloseContext(ctx)
+		if err != context.DeadlineExceeded || count != 3 {
+			t.Errorf("undelivered %d (%v), expected 3", count, err)
+		}
+		if d := time.Since(start); d > time.Second {
+			t.Errorf("close takes %v", d)
+		}
+		if err := client.Send(&Notification{Payload: payload}, tokenStrings...); err != ErrClientIsClosed {
+			t.Errorf("send after close: %v", err)
+		}
+	})
+	t.Run("wedged", func(t *testing.T) {
+		client, server := newTestClient(t)
+		if err := client.Send(&Notification{Payload: payload}, testTokens(3)...); err != nil {
+			t.Fatal(err)
+		}
+		server.Accept(t) // соединение установлено, но сервер ничего не читает
+		ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+		defer cancel()
+		count, err := client.CloseContext(ctx)
+		if err != context.DeadlineExceeded || count != 3 {
+			t.Errorf("undelivered %d (%v), expected 3", count, err)
+		}
+	})
+	t.Run("drained", func(t *testing.T) {
+		client, server := newTestClient(t)
+		if err := client.Send(&Notification{Payload: payload}, testTokens(3)...); err != nil {
+			t.Fatal(err)
+		}
+		go io.Copy(ioutil.Discard, server.Accept(t))
+		count, err := client.CloseContext(context.Background())
+		if err != nil || count != 0 {
+			t.Errorf("undelivered %d (%v), expected 0", count, err)
+		}
+	})
+}
+
+func TestClientShutdown(t *testing.T) {
+	var ntf = &Notification{Payload: NewPayload().Alert("test")}
+	t.Run("drained", func(t *testing.T) {
+		client, server := newTestClient(t)
+		client.ManualSend = true // отправка запускается при завершении работы
+		if err := client.Send(ntf, testTokens(3)...); err != nil {
+			t.Fatal(err)
+		}
+		var frames = make(chan int, 1)
+		go func() {
+			var conn, count = server.Accept(t), 0
+			for ; ; count++ {
+				if _, err := readFrame(conn); err != nil {
+					break
+				}
+			}
+			frames <- count
+		}()
+		if err := client.Shutdown(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if count := <-frames; count != 3 {
+			t.Errorf("%d notifications sent, expected 3", count)
+		}
+		if err := client.Send(ntf, testTokens(1)...); err != ErrClientIsClosed {
+			t.Errorf("send after shutdown: %v", err)
+		}
+		if err := client.Shutdown(context.Background()); err != ErrClientIsClosed {
+			t.Errorf("repeated shutdown: %v", err)
+		}
+	})
+	t.Run("deadline", func(t *testing.T) {
+		client, _ := newTestClient(t)
+		client.dialFunc = func(string) (net.Conn, error) { return nil, errors.New("unreachable") }
+		if err := client.Send(ntf, testTokens(3)...); err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		var err = client.Shutdown(ctx)
+		var shutdownErr ShutdownError
+		if !errors.As(err, &shutdownErr) || shutdownErr.Pending != 3 ||
+			!errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("shutdown error %v, expected 3 pending", err)
+		}
+	})
+}
+
+func TestClientSendOrder(t *testing.T) {
+	client := newOfflineClient(t, new(Config))
+	const submitters, count = 8, 200
+	var wg sync.WaitGroup
+	wg.Add(submitters)
+	for i := 0; i < submitters; i++ {
+		go func(i int) {
+			defer wg.Done()
+			for seq := 0; seq < count; seq++ {
+				var payload = NewPayload()
+				payload["submitter"], payload["seq"] = i, seq
+				if err := client.Send(&Notification{Payload: payload}, tokenStrings...); err != nil {
+					t.Error(err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	var (
+		last   = make(map[float64]float64)
+		lastID uint32
+	)
+	if len(client.queue.list) != submitters*count*len(tokenStrings) {
+		t.Fatalf("queue length %d", len(client.queue.list))
+	}
+	for i, ntf := range client.queue.list {
+		if ntf.ID <= lastID {
+			t.Fatalf("notification ids are not ascending: %d after %d", ntf.ID, lastID)
+		}
+		lastID = ntf.ID
+		var (
+			payload   = ntf.PayloadMap()
+			submitter = payload["submitter"].(float64)
+			seq       = payload["seq"].(float64)
+		)
+		if i%len(tokenStrings) != 0 { // токены одного вызова идут подряд
+			if seq != last[submitter] ||
+				ntf.TokenString() != strings.ToLower(tokenStrings[i%len(tokenStrings)]) {
+				t.Fatalf("tokens of submitter %v call %v interleaved", submitter, seq)
+			}
+			continue
+		}
+		if prev, ok := last[submitter]; ok && seq != prev+1 {
+			t.Fatalf("submitter %v: seq %v after %v", submitter, seq, prev)
+		}
+		last[submitter] = seq
+	}
+}
+
+func TestNewClientFrameBuffer(t *testing.T) {
+	defer func(size int) { MaxFrameBuffer = size }(MaxFrameBuffer)
+	MaxFrameBuffer = 100
+	if _, err := NewClient(new(Config)); err != ErrFrameBufferTooSmall {
+		t.Errorf("small frame buffer accepted: %v", err)
+	}
+	MaxFrameBuffer = maxNotificationLen()
+	if _, err := NewClient(new(Config)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestClientNotificationTooLarge(t *testing.T) {
+	defer func(size int) { MaxFrameBuffer = size }(MaxFrameBuffer)
+	client, conns := newFakeClient(t)
+	defer client.Close(false)
+	var results = make(chan SendResult, 10)
+	client.Results = results
+	var (
+		tokens = testTokens(2)
+		big    = NewPayload().Alert(strings.Repeat("x", 200))
+		small  = NewPayload().Alert("test")
+	)
+	MaxFrameBuffer = 200 // уменьшен после создания клиента
+	if err := client.Send(&Notification{Payload: big}, tokens[0]); err != ErrNotificationTooLarge {
+		t.Errorf("large notification error %v", err)
+	}
+	// уведомление, уже находящееся в очереди, не останавливает отправку остальных
+	large, err := (&Notification{Payload: big}).convert()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.queue.Put(large.WithToken(make([]byte, 32)))
+	if err := client.Send(&Notification{Payload: small}, tokens[1]); err != nil {
+		t.Fatal(err)
+	}
+	var done = make(chan error, 1)
+	go func() { done <- client.DrainOnce() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("sending is stalled")
+	}
+	if result := <-results; result.ID != 1 || result.Err != ErrNotificationTooLarge {
+		t.Errorf("large notification result %+v", result)
+	}
+	if ids := fmt.Sprint(nextFakeConn(t, client, conns).IDs(t)); ids != "[2]" {
+		t.Errorf("sent %s, expected [2]", ids)
+	}
+}
+
+func TestClientDrainOnce(t *testing.T) {
+	client, server := newTestClient(t)
+	client.ManualSend = true
+	var payload = map[string]interface{}{"aps": map[string]interface{}{"alert": "test"}}
+	if err := client.Send(&Notification{Payload: payload}, testTokens(3)...); err != nil {
+		t.Fatal(err)
+	}
+	if client.sending.Is() || client.Pending() != 3 {
+		t.Fatalf("notifications sent without DrainOnce")
+	}
+	var done = make(chan error)
+	go func() { done <- client.DrainOnce() }()
+	conn := server.Accept(t)
+	for i := 0; i < 3; i++ {
+		frame, err := readFrame(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token := hex.EncodeToString(frame[8:40]); token != testTokens(3)[i] {
+			t.Errorf("frame %d: token %s", i, token)
+		}
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if count := client.Pending(); count != 0 {
+		t.Errorf("%d notifications left in queue", count)
+	}
+	client.Close(false)
+	if err := client.DrainOnce(); err != ErrClientIsClosed {
+		t.Errorf("DrainOnce after close: %v", err)
+	}
+}
+
+func TestClientFlush(t *testing.T) {
+	client, server := newTestClient(t)
+	var (
+		payload = NewPayload().Alert("test")
+		tokens  = testTokens(3)
+		done    = make(chan error, 1)
+	)
+	if err := client.Send(&Notification{Payload: payload}, tokens...); err != nil {
+		t.Fatal(err)
+	}
+	go func() { done <- client.Flush(context.Background()) }()
+	conn := server.Accept(t)
+	for i := range tokens {
+		if _, err := readFrame(conn); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case err := <-done:
+			t.Fatalf("Flush returned before frame %d was read: %v", i, err)
+		default:
+		}
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Flush does not return after the queue is drained")
+	}
+	// сервер не читает данные — отправка не может закончиться до истечения контекста
+	if err := client.Send(&Notification{Payload: payload}, tokens[0]); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := client.Flush(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Flush error %v, expected %v", err, context.DeadlineExceeded)
+	}
+	client.Close(false)
+	for client.sending.Is() { // ждем завершения прерванной отправки
+		time.Sleep(time.Millisecond)
+	}
+	if err := client.Flush(context.Background()); err != ErrClientIsClosed {
+		t.Errorf("Flush after close: %v", err)
+	}
+}
+
+func TestClientPollInterval(t *testing.T) {
+	client := newOfflineClient(t, new(Config))
+	for _, test := range []struct{ delay, interval time.Duration }{
+		{0, minPollInterval},
+		{-time.Second, minPollInterval},
+		{time.Microsecond, minPollInterval},
+		{DurationSend, DurationSend},
+	} {
+		client.SendDelay = test.delay
+		if interval := client.pollInterval(); interval != test.interval {
+			t.Errorf("poll interval %v for send delay %v, expected %v", interval, test.delay, test.interval)
+		}
+	}
+}
+
+func TestClientPayloadWarning(t *testing.T) {
+	client, _ := newTestClient(t)
+	var logs = new(syncBuffer)
+	client.config.SetLogger(log.New(logs, "", 0))
+	client.ManualSend = true
+	client.PayloadWarningSize = 512
+	for _, alert := range []string{"short", strings.Repeat("x", 600)} {
+		var payload = map[string]interface{}{"aps": map[string]interface{}{"alert": alert}}
+		if err := client.Send(&Notification{Payload: payload}, testTokens(1)...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if count := client.queue.PendingCount(); count != 2 {
+		t.Errorf("%d notifications queued, expected 2", count)
+	}
+	if count := strings.Count(string(logs.Bytes()), "Large payload"); count != 1 {
+		t.Errorf("%d warnings logged, expected 1:\n%s", count, logs.Bytes())
+	}
+	client.Close(false)
+}
+
+func TestClientSendContext(t *testing.T) {
+	defer func(size int) { MaxFrameBuffer = size }(MaxFrameBuffer)
+	MaxFrameBuffer = maxNotificationLen()
+
+	client, server := newTestClient(t)
+	var (
+		tokens  = testTokens(5)
+		payload = NewPayload().Sound(DefaultSound)
+		// каждое уведомление занимает больше половины фрейма и отправляется отдельно
+		ntf         = &Notification{Payload: payload}
+		ctx, cancel = context.WithCancel(context.Background())
+	)
+	payload["data"] = strings.Repeat("x", maxNotificationLen()/2)
+	defer cancel()
+	if err := client.SendContext(ctx, ntf, tokens...); err != nil {
+		t.Fatal(err)
+	}
+	var (
+		conn     = server.Accept(t)
+		received []string
+	)
+	// read читает фреймы, пока они поступают
+	var read = func() {
+		for {
+			conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+			frame, err := readFrame(conn)
+			if err != nil {
+				return
+			}
+			received = append(received, hex.EncodeToString(frame[8:40]))
+			if len(received) == 1 {
+				cancel() // прерываем отправку после первого фрейма
+			}
+		}
+	}
+	read()
+	for client.sending.Is() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	var pending = client.queue.PendingCount()
+	if len(received) > 2 || pending != len(tokens)-len(received) {
+		t.Fatalf("received %d, pending %d after cancel", len(received), pending)
+	}
+	if err := client.SendContext(ctx, ntf, tokens...); err != context.Canceled {
+		t.Errorf("send with cancelled context: %v", err)
+	}
+	// следующий вызов Send продолжает отправку оставшихся уведомлений
+	if err := client.Send(ntf); err != nil {
+		t.Fatal(err)
+	}
+	read()
+	client.Close(false)
+	if strings.Join(received, ",") != strings.Join(tokens, ",") {
+		t.Errorf("received %v, expected %v", received, tokens)
+	}
+}
+
+func TestClientCloseGoroutines(t *testing.T) {
+	var before = runtime.NumGoroutine()
+	client, err := NewClient(new(Config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runtime.NumGoroutine() <= before {
+		t.Fatal("cache cleanup is not started")
+	}
+	client.Close(false)
+	for i := 0; runtime.NumGoroutine() > before; i++ {
+		if i == 100 {
+			t.Fatalf("%d goroutines left after close, %d before client", runtime.NumGoroutine(), before)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestClientMaxQueueSize(t *testing.T) {
+	var client = newOfflineClient(t, new(Config))
+	defer client.Close(false)
+	client.MaxQueueSize = 2
+	client.SendDelay = time.Millisecond
+	var ntf = &Notification{Payload: NewPayload().Alert("test")}
+	if err := client.Send(ntf, testTokens(2)...); err != nil {
+		t.Fatal(err)
+	}
+	// по умолчанию уведомления в заполненную очередь не добавляются
+	if err := client.Send(ntf, testTokens(1)...); err != ErrQueueFull {
+		t.Fatalf("full queue error %v", err)
+	}
+
+	client.BlockWhenFull = true
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := client.SendContext(ctx, ntf, testTokens(1)...); err != context.DeadlineExceeded {
+		t.Fatalf("blocked send error %v", err)
+	}
+	var done = make(chan error, 1)
+	go func() { done <- client.Send(ntf, testTokens(1)...) }()
+	select {
+	case err := <-done:
+		t.Fatalf("send is not blocked: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	client.queue.Get() // эмулируем отправку одного уведомления
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("send is not unblocked")
+	}
+	if n := client.Pending(); n != 2 {
+		t.Errorf("%d pending, expected 2", n)
+	}
+
+	// ограничение проверяется для всех добавляемых уведомлений и во всех способах отправки
+	client.BlockWhenFull = false
+	client.queue.Get()
+	if err := client.Send(ntf, testTokens(2)...); err != ErrQueueFull {
+		t.Errorf("send over limit error %v", err)
+	}
+	if _, err := client.SendTokens(ntf, testTokens(2)); err != ErrQueueFull {
+		t.Errorf("send tokens over limit error %v", err)
+	}
+	var items = []BatchItem{{ntf, tokenStrings[0]}, {ntf, tokenStrings[1]}}
+	for _, result := range client.SendBatch(items) {
+		if result.Err != ErrQueueFull {
+			t.Errorf("batch item error %v", result.Err)
+		}
+	}
+	if n := client.Pending(); n != 1 {
+		t.Errorf("%d pending, expected 1", n)
+	}
+}
+
+func TestClientSetConfig(t *testing.T) {
+	serverCert, _ := testCertificate(t)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAnyClientCert,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	var certs = make(chan []byte, 2) // сертификаты клиента, с которыми получены уведомления
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn *tls.Conn) {
+				defer conn.Close()
+				if err := conn.Handshake(); err != nil {
+					return
+				}
+				for {
+					if _, err := readFrame(conn); err != nil {
+						return // соединение закрыто клиентом
+					}
+					certs <- conn.ConnectionState().PeerCertificates[0].Raw
+				}
+			}(conn.(*tls.Conn))
+		}
+	}()
+
+	var newConfig = func() *Config {
+		cert, _ := testCertificate(t)
+		var config = &Config{
+			Host:               listener.Addr().String(),
+			InsecureSkipVerify: true,
+			Certificate:        cert,
+		}
+		config.SetLogger(log.New(ioutil.Discard, "", 0))
+		return config
+	}
+	var config = newConfig()
+	client, err := NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close(false)
+	var ntf = &Notification{Payload: NewPayload().Alert("test")}
+	for i, config := range []*Config{config, newConfig()} {
+		if i > 0 {
+			if err := client.SetConfig(config); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := client.Send(ntf, testTokens(1)...); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case cert := <-certs:
+			if !bytes.Equal(cert, config.Certificate.Certificate[0]) {
+				t.Errorf("send %d: sent with another certificate", i)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("send %d: timeout", i)
+		}
+	}
+	if err := client.SetConfig(&Config{Sandbox: true}); err != ErrConfigServer {
+		t.Errorf("another server error %v", err)
+	}
+}
+
+func TestClientSendReuse(t *testing.T) {
+	var (
+		ntf = &Notification{
+			Payload:    NewPayload().Sound(DefaultSound).Communication("thread"),
+			Expiration: time.Now().Add(time.Hour),
+			Priority:   10,
+		}
+		reuse  SendBuffer
+		frames [2]bytes.Buffer
+	)
+	ntf.Payload.aps()["alert"] = "<b>Hello</b>"
+	for i, send := range []func(*Client) error{
+		func(client *Client) error { return client.Send(ntf, tokenStrings[:2]...) },
+		func(client *Client) error {
+			for _, token := range tokenStrings[:2] {
+				if err := client.SendReuse(&reuse, ntf, token); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	} {
+		client := newOfflineClient(t, new(Config))
+		if err := send(client); err != nil {
+			t.Fatal(err)
+		}
+		// буфер не должен использоваться после возврата
+		reuse.buf.WriteString("garbage")
+		copy(reuse.token, "garbage")
+		if _, err := client.queue.WriteTo(&frames[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if frames[0].Len() == 0 || !bytes.Equal(frames[0].Bytes(), frames[1].Bytes()) {
+		t.Error("frames differ")
+	}
+
+	client := newOfflineClient(t, new(Config))
+	if err := client.SendReuse(&reuse, ntf, "invalid"); err != nil {
+		t.Error(err)
+	}
+	if client.queue.PendingCount() != 0 {
+		t.Error("invalid token queued")
+	}
+}
+
+func benchmarkSend(b *testing.B, send func(*Client, *Notification) error) {
+	client := newOfflineClient(b, new(Config))
+	var ntf = &Notification{Payload: NewPayload().Sound(DefaultSound)}
+	ntf.Payload["data"] = strings.Repeat("x", 512)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := send(client, ntf); err != nil {
+			b.Fatal(err)
+		}
+		client.queue.mu.Lock()
+		client.queue.cut(len(client.queue.list))
+		client.queue.mu.Unlock()
+	}
+}
+
+func BenchmarkClientSend(b *testing.B) {
+	benchmarkSend(b, func(client *Client, ntf *Notification) error {
+		return client.Send(ntf, tokenStrings[0])
+	})
+}
+
+func BenchmarkClientSendReuse(b *testing.B) {
+	var buf SendBuffer
+	benchmarkSend(b, func(client *Client, ntf *Notification) error {
+		return client.SendReuse(&buf, ntf, tokenStrings[0])
+	})
+}
@@ -0,0 +1,120 @@
+package apns
+
+import "sync"
+
+// ClientPool описывает набор клиентов для нескольких приложений и окружений APNS, например, для
+// отладочной и рабочей сборок одного приложения, которые используют разные сертификаты и серверы.
+// Конфигурации клиентов добавляются в пул с помощью Add, а сами клиенты создаются только при
+// первом обращении к ним и затем используются повторно.
+//
+// Клиенты пула ничего не разделяют между собой: у каждого из них своя конфигурация, соединение и
+// очередь уведомлений. Все методы пула можно вызывать одновременно из нескольких потоков.
+type ClientPool struct {
+	// Setup задает функцию, которая вызывается для каждого нового клиента пула до его первого
+	// использования. В ней можно задать параметры клиента, например, OnError или Results.
+	Setup func(client *Client)
+
+	configs map[poolKey]*Config // конфигурации клиентов
+	clients map[poolKey]*Client // уже созданные клиенты
+	closed  bool                // флаг закрытого пула
+	mu      sync.Mutex
+}
+
+// poolKey описывает ключ клиента в пуле: идентификатор приложения и окружение APNS.
+type poolKey struct {
+	topic string
+	env   Environment
+}
+
+// NewClientPool возвращает новый пустой пул клиентов.
+func NewClientPool() *ClientPool {
+	return &ClientPool{
+		configs: make(map[poolKey]*Config),
+		clients: make(map[poolKey]*Client),
+	}
+}
+
+// Add добавляет в пул конфигурацию клиента. Идентификатором приложения для нее служит BundleID, а
+// если он не задан — идентификатор из сертификата (см. Config.Topic), а окружение определяется
+// флагом Sandbox. Если для этого приложения и окружения конфигурация уже добавлена, то
+// возвращается ошибка ErrPoolDuplicate.
+func (p *ClientPool) Add(config *Config) error {
+	var topic = config.BundleID
+	if topic == "" {
+		var err error
+		if topic, err = config.Topic(); err != nil {
+			return err
+		}
+	}
+	var key = poolKey{topic: topic, env: EnvironmentProduction}
+	if config.Sandbox {
+		key.env = EnvironmentSandbox
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return ErrClientIsClosed
+	}
+	if _, ok := p.configs[key]; ok {
+		return ErrPoolDuplicate
+	}
+	p.configs[key] = config
+	return nil
+}
+
+// Client возвращает клиента для указанного приложения и окружения, создавая его при первом
+// обращении. Если конфигурация для них не добавлена, то возвращается ошибка ErrPoolNoClient, а
+// после закрытия пула — ErrClientIsClosed.
+func (p *ClientPool) Client(topic string, env Environment) (*Client, error) {
+	var key = poolKey{topic: topic, env: env}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil, ErrClientIsClosed
+	}
+	if client, ok := p.clients[key]; ok {
+		return client, nil
+	}
+	config, ok := p.configs[key]
+	if !ok {
+		return nil, ErrPoolNoClient
+	}
+	client, err := NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+	if p.Setup != nil {
+		p.Setup(client)
+	}
+	p.clients[key] = client
+	return client, nil
+}
+
+// Send помещает уведомление для указанных токенов устройств в очередь на отправку клиента для
+// указанного приложения и окружения (см. Client.Send).
+func (p *ClientPool) Send(topic string, env Environment, ntf *Notification, tokens ...string) error {
+	client, err := p.Client(topic, env)
+	if err != nil {
+		return err
+	}
+	return client.Send(ntf, tokens...)
+}
+
+// Close закрывает все созданные клиенты пула (см. Client.Close). После закрытия пул нельзя
+// использовать повторно.
+func (p *ClientPool) Close(wait bool) {
+	p.mu.Lock()
+	var clients = p.clients
+	p.clients = make(map[poolKey]*Client)
+	p.closed = true
+	p.mu.Unlock()
+	var wg sync.WaitGroup
+	for _, client := range clients {
+		wg.Add(1)
+		go func(client *Client) { // клиенты закрываются одновременно
+			defer wg.Done()
+			client.Close(wait)
+		}(client)
+	}
+	wg.Wait()
+}
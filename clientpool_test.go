@@ -0,0 +1,56 @@
+package apns
+
+import "testing"
+
+func TestClientPool(t *testing.T) {
+	var pool = NewClientPool()
+	var created int
+	pool.Setup = func(client *Client) {
+		client.ManualSend = true // не соединяемся с сервером
+		created++
+	}
+	for _, sandbox := range []bool{false, true} {
+		if err := pool.Add(&Config{BundleID: "com.example.app", Sandbox: sandbox}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := pool.Add(&Config{BundleID: "com.example.app", Sandbox: true}); err != ErrPoolDuplicate {
+		t.Errorf("duplicate error %v", err)
+	}
+	if err := pool.Add(new(Config)); err != ErrNoTopic {
+		t.Errorf("no topic error %v", err)
+	}
+
+	var ntf = &Notification{Payload: NewPayload().Alert("test")}
+	if err := pool.Send("com.example.app", EnvironmentSandbox, ntf, testTokens(2)...); err != nil {
+		t.Fatal(err)
+	}
+	sandbox, err := pool.Client("com.example.app", EnvironmentSandbox)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sandbox.Environment() != EnvironmentSandbox || sandbox.Pending() != 2 {
+		t.Errorf("bad sandbox client: %s, %d pending", sandbox.Environment(), sandbox.Pending())
+	}
+	production, err := pool.Client("com.example.app", EnvironmentProduction)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if production == sandbox || production.Environment() != EnvironmentProduction || production.Pending() != 0 {
+		t.Error("production client shares state with sandbox client")
+	}
+	if created != 2 {
+		t.Errorf("%d clients created, expected 2", created)
+	}
+	if err := pool.Send("com.example.other", EnvironmentSandbox, ntf, testTokens(1)...); err != ErrPoolNoClient {
+		t.Errorf("unknown topic error %v", err)
+	}
+
+	pool.Close(false)
+	if !sandbox.closed.Is() || !production.closed.Is() {
+		t.Error("clients are not closed")
+	}
+	if err := pool.Send("com.example.app", EnvironmentSandbox, ntf, testTokens(1)...); err != ErrClientIsClosed {
+		t.Errorf("send to closed pool: %v", err)
+	}
+}
@@ -3,6 +3,8 @@ package apns
 import (
 	"bytes"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -17,7 +19,58 @@ type Config struct {
 	BundleID    string          // идентификатор приложения
 	Sandbox     bool            // флаг отладочного режима
 	Certificate tls.Certificate // сертификаты
-	log         *log.Logger     // лог для вывода информации
+	log         Logger          // лог для вывода информации
+
+	// SessionCache задает кеш TLS-сессий, позволяющий при переподключении к серверу возобновлять
+	// предыдущую сессию без полного согласования соединения. Это заметно ускоряет частые
+	// переподключения. Проверка сертификата сервера при возобновлении сессии сохраняется. Для
+	// включения кеша можно использовать tls.NewLRUClientSessionCache. По умолчанию кеш не используется.
+	SessionCache tls.ClientSessionCache
+	// MaxFeedback ограничивает количество ответов, читаемых с feedback сервера за одно соединение.
+	// При достижении ограничения чтение прекращается, а вместе с уже прочитанными ответами
+	// возвращается ошибка ErrFeedbackTruncated. По умолчанию количество ответов не ограничено.
+	MaxFeedback int
+	// Host задает адрес сервера APNS в формате "host:port", используемый клиентом (Client или
+	// HTTP2Client) вместо стандартного. Это позволяет отправлять уведомления на тестовый сервер
+	// или через TLS-прокси. Если адрес задан не в этом формате, то NewClient возвращает ошибку
+	// ErrHostInvalid. По умолчанию используется сервер окружения, заданного Sandbox.
+	Host string
+	// ServerName задает имя сервера, которое используется при установке защищенного соединения
+	// и проверке сертификата сервера. По умолчанию используется имя из адреса сервера.
+	ServerName string
+	// InsecureSkipVerify отключает проверку сертификата сервера. Используется только для тестов
+	// с сервером, имеющим самоподписанный сертификат: соединение без проверки сертификата уязвимо
+	// для подмены сервера, поэтому в рабочем окружении этот флаг устанавливать нельзя.
+	InsecureSkipVerify bool
+	// CacheSize задает размер кеша отправленных уведомлений клиента, которые могут быть отправлены
+	// повторно после ошибки. При включенном Client.ThrottleUnconfirmed он же ограничивает количество
+	// неподтвержденных уведомлений. В кеше хранятся не больше CacheSize последних отправленных
+	// уведомлений, даже если время их хранения (CacheLifeTime) еще не истекло, поэтому при ошибке
+	// в более раннем уведомлении отправленные после него уже не будут отправлены повторно. По
+	// умолчанию используется NotificationCacheSize.
+	CacheSize int
+	// CacheLifeTime задает время хранения отправленных уведомлений в кеше клиента. Чем оно больше,
+	// тем больше уведомлений может быть отправлено повторно после ошибки, но тем больше памяти
+	// занимает кеш. По умолчанию используется CacheLifeTime пакета.
+	CacheLifeTime time.Duration
+	// PersistPath задает путь к файлу, в котором клиент сохраняет еще не отправленные уведомления.
+	// Если программа завершится аварийно, то при создании следующего клиента с тем же файлом эти
+	// уведомления снова будут помещены в очередь и отправлены вместе со следующими уведомлениями
+	// или при вызове Flush. Уведомление считается отправленным после записи в соединение с
+	// сервером, поэтому после перезапуска часть уведомлений может быть доставлена повторно. Один
+	// файл нельзя одновременно использовать в нескольких клиентах. По умолчанию очередь хранится
+	// только в памяти.
+	PersistPath string
+	// StrictEnvironment указывает, что NewClient должен возвращать ошибку ErrEnvironmentMismatch,
+	// если окружение, для которого выдан сертификат (см. CertificateEnvironment), не совпадает с
+	// Sandbox. По умолчанию в этом случае в лог только выводится предупреждение.
+	StrictEnvironment bool
+	// TLSConfig задает базовую конфигурацию TLS для соединений с сервером, например, с минимальной
+	// версией TLS, собственными корневыми сертификатами или набором шифров, которых требует
+	// политика безопасности. Конфигурация копируется и дополняется сертификатом клиента (если он
+	// задан в Certificate) и именем сервера, а также SessionCache и InsecureSkipVerify, если они
+	// заданы. Исходная конфигурация при этом не изменяется.
+	TLSConfig *tls.Config
 }
 
 // LoadConfig загружает и возвращает конфигурацию для APNS из JSON-файла. Формат такого файла
@@ -34,8 +87,139 @@ func LoadConfig(filename string) (*Config, error) {
 	return config, nil
 }
 
-// SetLogger позволяет установить свою систему вывода логов.
-func (config *Config) SetLogger(llog *log.Logger) {
+// oidUserID описывает идентификатор атрибута UID, в котором сертификат APNS содержит идентификатор
+// приложения.
+var oidUserID = asn1.ObjectIdentifier{0, 9, 2342, 19200300, 100, 1, 1}
+
+// ConfigFromPEM возвращает конфигурацию для APNS с сертификатом и приватным ключом в формате PEM.
+// Это позволяет использовать сертификаты, переданные через переменные окружения или секреты, без
+// записи их во временный файл. Идентификатор приложения берется из атрибута UID сертификата, если
+// он там указан.
+//
+// Если сертификат или ключ не удалось разобрать или ключ не соответствует сертификату, то
+// возвращается ошибка, для которой errors.Is(err, ErrCertificateKey) возвращает true.
+func ConfigFromPEM(certPEM, keyPEM []byte, sandbox bool) (*Config, error) {
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCertificateKey, err)
+	}
+	var config = &Config{
+		Sandbox:     sandbox,
+		Certificate: cert,
+	}
+	if leaf, err := x509.ParseCertificate(cert.Certificate[0]); err == nil {
+		config.Certificate.Leaf = leaf
+		config.BundleID, _ = config.Topic()
+	}
+	return config, nil
+}
+
+// leaf возвращает разобранный сертификат конфигурации или nil, если сертификат не задан или его
+// не удалось разобрать.
+func (config *Config) leaf() *x509.Certificate {
+	if config.Certificate.Leaf != nil {
+		return config.Certificate.Leaf
+	}
+	if len(config.Certificate.Certificate) == 0 {
+		return nil
+	}
+	leaf, err := x509.ParseCertificate(config.Certificate.Certificate[0])
+	if err != nil {
+		return nil
+	}
+	return leaf
+}
+
+// Topic возвращает идентификатор приложения из атрибута UID сертификата конфигурации. Он
+// используется в качестве apns-topic для уведомлений, отправляемых через HTTP2Client, если ни в
+// уведомлении, ни в BundleID идентификатор не указан. Если сертификат не задан или не содержит
+// идентификатора приложения, то возвращается ошибка ErrNoTopic.
+func (config *Config) Topic() (string, error) {
+	var leaf = config.leaf()
+	if leaf == nil {
+		return "", ErrNoTopic
+	}
+	for _, name := range leaf.Subject.Names {
+		if value, ok := name.Value.(string); ok && value != "" && name.Type.Equal(oidUserID) {
+			return value, nil
+		}
+	}
+	return "", ErrNoTopic
+}
+
+// Идентификаторы расширений сертификата APNS, которые указывают, для какого окружения он выдан.
+// Универсальный сертификат содержит оба расширения.
+var (
+	oidAPNSDevelopment = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 6, 3, 1}
+	oidAPNSProduction  = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 6, 3, 2}
+)
+
+// CertificateEnvironment возвращает окружение APNS, для которого выдан сертификат конфигурации.
+// Для универсального сертификата, подходящего для обоих окружений, и для сертификата, который не
+// удалось разобрать или который не содержит расширений APNS, возвращается EnvironmentUnknown.
+func (config *Config) CertificateEnvironment() Environment {
+	var leaf = config.leaf()
+	if leaf == nil {
+		return EnvironmentUnknown
+	}
+	var development, production bool
+	for _, ext := range leaf.Extensions {
+		switch {
+		case ext.Id.Equal(oidAPNSDevelopment):
+			development = true
+		case ext.Id.Equal(oidAPNSProduction):
+			production = true
+		}
+	}
+	switch {
+	case development && !production:
+		return EnvironmentSandbox
+	case production && !development:
+		return EnvironmentProduction
+	default:
+		return EnvironmentUnknown
+	}
+}
+
+// checkEnvironment проверяет, что сертификат выдан для окружения, заданного в Sandbox. При
+// несовпадении выводится предупреждение в лог или, если установлен StrictEnvironment,
+// возвращается ошибка ErrEnvironmentMismatch.
+func (config *Config) checkEnvironment() error {
+	var env, expected = config.CertificateEnvironment(), EnvironmentProduction
+	if config.Sandbox {
+		expected = EnvironmentSandbox
+	}
+	if env == EnvironmentUnknown || env == expected {
+		return nil
+	}
+	if config.StrictEnvironment {
+		return ErrEnvironmentMismatch
+	}
+	config.logger().Printf("Warning: %s certificate is used with %s server", env, expected)
+	return nil
+}
+
+// Logger описывает систему вывода логов, через которую клиент и функции работы с feedback сервером
+// выводят информацию о своей работе. Этому интерфейсу удовлетворяет *log.Logger, а для других
+// систем логирования достаточно написать простую обертку: например, добавляющую к сообщениям
+// идентификатор приложения.
+type Logger interface {
+	Print(v ...interface{})
+	Printf(format string, v ...interface{})
+	Println(v ...interface{})
+}
+
+// nopLogger описывает систему вывода логов, которая ничего не выводит.
+type nopLogger struct{}
+
+func (nopLogger) Print(v ...interface{})                 {}
+func (nopLogger) Printf(format string, v ...interface{}) {}
+func (nopLogger) Println(v ...interface{})               {}
+
+// SetLogger позволяет установить свою систему вывода логов. Если передан nil, то логи выводятся
+// в стандартный поток ошибок с префиксом, содержащим идентификатор приложения. По умолчанию,
+// пока система вывода логов не установлена, логи не выводятся.
+func (config *Config) SetLogger(llog Logger) {
 	if llog == nil {
 		prefix := fmt.Sprintf("[apns:%s] ", config.BundleID)
 		config.log = log.New(os.Stderr, prefix, log.LstdFlags)
@@ -44,6 +228,58 @@ func (config *Config) SetLogger(llog *log.Logger) {
 	}
 }
 
+// logger возвращает установленную систему вывода логов или, если она не установлена, систему,
+// которая ничего не выводит.
+func (config *Config) logger() Logger {
+	if config.log == nil {
+		return nopLogger{}
+	}
+	return config.log
+}
+
+// checkHost проверяет, что адрес сервера, если он задан в Host, указан в формате "host:port".
+func (config *Config) checkHost() error {
+	if config.Host == "" {
+		return nil
+	}
+	_, port, err := net.SplitHostPort(config.Host)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrHostInvalid, err)
+	}
+	if port == "" {
+		return fmt.Errorf("%w: missing port in address %s", ErrHostInvalid, config.Host)
+	}
+	return nil
+}
+
+// serverAddr возвращает адрес сервера APNS, с которым соединяется клиент.
+func (config *Config) serverAddr() string {
+	switch {
+	case config.Host != "":
+		return config.Host
+	case config.Sandbox:
+		return ServerApnsSandbox
+	default:
+		return ServerApns
+	}
+}
+
+// cacheSize возвращает размер кеша отправленных уведомлений с учетом значения по умолчанию.
+func (config *Config) cacheSize() int {
+	if config.CacheSize > 0 {
+		return config.CacheSize
+	}
+	return NotificationCacheSize
+}
+
+// cacheLifeTime возвращает время хранения отправленных уведомлений с учетом значения по умолчанию.
+func (config *Config) cacheLifeTime() time.Duration {
+	if config.CacheLifeTime > 0 {
+		return config.CacheLifeTime
+	}
+	return CacheLifeTime
+}
+
 // Feedback соединяется с APNS Feedback сервером и возвращает информацию, полученную от него.
 func (config *Config) Feedback() ([]*FeedbackResponse, error) {
 	return Feedback(config)
@@ -52,8 +288,11 @@ func (config *Config) Feedback() ([]*FeedbackResponse, error) {
 // Connect возвращает инициализированный Client с уже установленным соединением для отправки
 // уведомлений. Если соединение установить не удалось, то возвращается ошибка.
 func (config *Config) Connect() (*Client, error) {
-	var client = NewClient(config)
-	var err = client.Connect()
+	client, err := NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+	err = client.Connect()
 	return client, err
 }
 
@@ -65,19 +304,14 @@ func (config *Config) Dial(addr string) (*tls.Conn, error) {
 	if err != nil {
 		return nil, err
 	}
-	var (
-		tslConfig = &tls.Config{
-			ServerName: serverName,
-			Certificates: []tls.Certificate{
-				config.Certificate,
-			},
-		}
-		dialer = &net.Dialer{
-			Timeout: TimeoutConnect,
-		}
-	)
+	if config.ServerName != "" {
+		serverName = config.ServerName
+	}
+	var dialer = &net.Dialer{
+		Timeout: TimeoutConnect,
+	}
 	// устанавливаем защищенное соединение с сервером
-	conn, err := tls.DialWithDialer(dialer, "tcp", addr, tslConfig)
+	conn, err := tls.DialWithDialer(dialer, "tcp", addr, config.tlsConfig(serverName))
 	if err != nil {
 		return nil, err
 	}
@@ -86,6 +320,32 @@ func (config *Config) Dial(addr string) (*tls.Conn, error) {
 	return conn, nil
 }
 
+// tlsConfig возвращает конфигурацию TLS для соединения с сервером с указанным именем.
+func (config *Config) tlsConfig(serverName string) *tls.Config {
+	if config.TLSConfig == nil {
+		return &tls.Config{
+			ServerName: serverName,
+			Certificates: []tls.Certificate{
+				config.Certificate,
+			},
+			ClientSessionCache: config.SessionCache,
+			InsecureSkipVerify: config.InsecureSkipVerify,
+		}
+	}
+	var result = config.TLSConfig.Clone()
+	result.ServerName = serverName
+	if len(config.Certificate.Certificate) > 0 {
+		result.Certificates = []tls.Certificate{config.Certificate}
+	}
+	if config.SessionCache != nil {
+		result.ClientSessionCache = config.SessionCache
+	}
+	if config.InsecureSkipVerify {
+		result.InsecureSkipVerify = true
+	}
+	return result
+}
+
 // UnmarshalJSON позволяет читать данную конфигурацию из JSON. Это исключительно вспомогательная
 // вещь для поддержки интерфейса JSON.Unmarshaler.
 func (config *Config) UnmarshalJSON(data []byte) error {
@@ -106,8 +366,6 @@ func (config *Config) UnmarshalJSON(data []byte) error {
 		Sandbox:     dataJSON.Sandbox,
 		Certificate: cert,
 	}
-	prefix := fmt.Sprintf("[apns:%s] ", config.BundleID)
-	config.log = log.New(os.Stderr, prefix, log.LstdFlags)
 	return nil
 }
 
@@ -124,17 +382,3 @@ type ConfigJSON struct {
 	// приватный ключ
 	PrivateKey []byte `json:"privateKey"`
 }
-
-// tlsConnectionStateString выводит в лог информацию о TLS-соединении.
-func tlsConnectionStateString(conn *tls.Conn) string {
-	var state = conn.ConnectionState()
-	return fmt.Sprint("Connection state:",
-		"\n------------------------------------------------------------",
-		"\n  Local Address:       ", conn.LocalAddr(),
-		"\n  Remote Address:      ", conn.RemoteAddr(),
-		"\n  TLS version:         ", state.Version,
-		"\n  Handshake Complete:  ", state.HandshakeComplete,
-		"\n  Did Resume:          ", state.DidResume,
-		"\n  Cipher Suite:        ", state.CipherSuite,
-		"\n------------------------------------------------------------")
-}
@@ -0,0 +1,466 @@
+package apns
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConfigSessionCache(t *testing.T) {
+	cert, roots := testCertificate(t)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	var resumed = make(chan bool, 2)
+	go func() {
+		for i := 0; i < 2; i++ {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			var tlsConn = conn.(*tls.Conn)
+			if err := tlsConn.Handshake(); err != nil {
+				conn.Close()
+				return
+			}
+			resumed <- tlsConn.ConnectionState().DidResume
+			tlsConn.Close() // разрываем соединение: клиент переподключится
+		}
+	}()
+
+	var config = &Config{SessionCache: tls.NewLRUClientSessionCache(4)}
+	config.SetLogger(log.New(ioutil.Discard, "", 0))
+	client, err := NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.host = listener.Addr().String()
+	client.dialFunc = func(addr string) (net.Conn, error) {
+		var tlsConfig = config.tlsConfig("127.0.0.1")
+		tlsConfig.RootCAs = roots // доверяем самоподписанному сертификату сервера
+		return tls.Dial("tcp", addr, tlsConfig)
+	}
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close(false)
+
+	for i, resume := range []bool{false, true} {
+		select {
+		case result := <-resumed:
+			if result != resume {
+				t.Errorf("connection %d: session resumed %v, expected %v", i, result, resume)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("connection %d: timeout", i)
+		}
+	}
+}
+
+func TestConfigMockServer(t *testing.T) {
+	cert, _ := testCertificate(t)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	var (
+		serverNames = make(chan string, 1)
+		frames      = make(chan error, 1)
+	)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			var tlsConn = conn.(*tls.Conn)
+			if err := tlsConn.Handshake(); err != nil {
+				conn.Close()
+				continue // клиент не доверяет сертификату
+			}
+			serverNames <- tlsConn.ConnectionState().ServerName
+			_, err = readFrame(tlsConn)
+			frames <- err
+			conn.Close()
+			return
+		}
+	}()
+
+	var config = &Config{
+		Host:       listener.Addr().String(),
+		ServerName: "gateway.push.apple.com",
+	}
+	config.SetLogger(log.New(ioutil.Discard, "", 0))
+	if _, err := config.Connect(); err == nil {
+		t.Fatal("connected to server with untrusted certificate")
+	}
+	config.InsecureSkipVerify = true
+	client, err := config.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close(false)
+	if err := client.Send(&Notification{Payload: NewPayload().Sound(DefaultSound)},
+		testTokens(1)...); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case name := <-serverNames:
+		if name != config.ServerName {
+			t.Errorf("server name %q, expected %q", name, config.ServerName)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("handshake timeout")
+	}
+	select {
+	case err := <-frames:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("notification is not received")
+	}
+}
+
+// testLogger описывает систему вывода логов, запоминающую выведенные сообщения.
+type testLogger struct {
+	lines []string
+	mu    sync.Mutex
+}
+
+func (l *testLogger) Print(v ...interface{})                 { l.add(fmt.Sprint(v...)) }
+func (l *testLogger) Printf(format string, v ...interface{}) { l.add(fmt.Sprintf(format, v...)) }
+func (l *testLogger) Println(v ...interface{})               { l.add(fmt.Sprintln(v...)) }
+
+func (l *testLogger) add(line string) {
+	l.mu.Lock()
+	l.lines = append(l.lines, line)
+	l.mu.Unlock()
+}
+
+func TestConfigLogger(t *testing.T) {
+	// без установленной системы вывода логов клиент работает, ничего не выводя
+	var config = new(Config)
+	if _, ok := config.logger().(nopLogger); !ok {
+		t.Errorf("default logger %T, expected no-op logger", config.logger())
+	}
+	var logger = new(testLogger)
+	config.SetLogger(logger)
+	client, err := NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.dialFunc = func(addr string) (net.Conn, error) {
+		return nil, errors.New("network is unreachable")
+	}
+	if _, err := client.dial(); err == nil {
+		t.Fatal("dial error expected")
+	}
+	client.Close(false)
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	if len(logger.lines) == 0 || !strings.HasPrefix(logger.lines[0], "Connecting to server") {
+		t.Errorf("unexpected log: %q", logger.lines)
+	}
+}
+
+// testCertificatePEM возвращает самоподписанный сертификат APNS для приложения с указанным
+// идентификатором и его приватный ключ в формате PEM.
+func testCertificatePEM(t *testing.T, bundleID string) (certPEM, keyPEM []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var template = &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject: pkix.Name{
+			CommonName: "Apple Push Services: " + bundleID,
+			ExtraNames: []pkix.AttributeTypeAndValue{{Type: oidUserID, Value: bundleID}},
+		},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter:  time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+}
+
+func TestConfigFromPEM(t *testing.T) {
+	certPEM, keyPEM := testCertificatePEM(t, "com.example.app")
+	config, err := ConfigFromPEM(certPEM, keyPEM, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.BundleID != "com.example.app" || !config.Sandbox || config.Certificate.Leaf == nil {
+		t.Errorf("bad config: %+v", config)
+	}
+	// ключ от другого сертификата
+	_, otherKey := testCertificatePEM(t, "com.example.other")
+	if _, err := ConfigFromPEM(certPEM, otherKey, false); !errors.Is(err, ErrCertificateKey) {
+		t.Errorf("mismatched key error %v", err)
+	}
+	if _, err := ConfigFromPEM([]byte("bad"), keyPEM, false); !errors.Is(err, ErrCertificateKey) {
+		t.Errorf("bad certificate error %v", err)
+	}
+}
+
+// testAPNSCertificate возвращает сертификат с указанными расширениями APNS.
+func testAPNSCertificate(t *testing.T, oids ...asn1.ObjectIdentifier) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var template = &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "Apple Push Services: com.example.app"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	for _, oid := range oids {
+		template.ExtraExtensions = append(template.ExtraExtensions,
+			pkix.Extension{Id: oid, Value: []byte{5, 0}}) // ASN.1 NULL
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestConfigCertificateEnvironment(t *testing.T) {
+	for _, test := range []struct {
+		oids     []asn1.ObjectIdentifier
+		expected Environment
+	}{
+		{[]asn1.ObjectIdentifier{oidAPNSDevelopment}, EnvironmentSandbox},
+		{[]asn1.ObjectIdentifier{oidAPNSProduction}, EnvironmentProduction},
+		{[]asn1.ObjectIdentifier{oidAPNSDevelopment, oidAPNSProduction}, EnvironmentUnknown},
+		{nil, EnvironmentUnknown},
+	} {
+		var config = &Config{Certificate: testAPNSCertificate(t, test.oids...)}
+		if env := config.CertificateEnvironment(); env != test.expected {
+			t.Errorf("%v: environment %s, expected %s", test.oids, env, test.expected)
+		}
+	}
+	if env := new(Config).CertificateEnvironment(); env != EnvironmentUnknown {
+		t.Errorf("environment without certificate %s", env)
+	}
+
+	// сертификат для отладочного окружения используется с рабочим сервером
+	var (
+		logger = new(testLogger)
+		config = &Config{Certificate: testAPNSCertificate(t, oidAPNSDevelopment)}
+	)
+	config.SetLogger(logger)
+	client, err := NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close(false)
+	logger.mu.Lock()
+	if len(logger.lines) != 1 || !strings.Contains(logger.lines[0], "sandbox certificate") {
+		t.Errorf("unexpected log: %q", logger.lines)
+	}
+	logger.mu.Unlock()
+	config.StrictEnvironment = true
+	if _, err := NewClient(config); err != ErrEnvironmentMismatch {
+		t.Errorf("strict environment error %v", err)
+	}
+	config.Sandbox = true
+	client, err = NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close(false)
+}
+
+func TestConfigTopic(t *testing.T) {
+	certPEM, keyPEM := testCertificatePEM(t, "com.example.app")
+	config, err := ConfigFromPEM(certPEM, keyPEM, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Certificate.Leaf = nil // идентификатор читается и из неразобранного сертификата
+	if topic, err := config.Topic(); err != nil || topic != "com.example.app" {
+		t.Errorf("topic %q (%v)", topic, err)
+	}
+	var other = &Config{Certificate: testAPNSCertificate(t)}
+	if _, err := other.Topic(); err != ErrNoTopic {
+		t.Errorf("topic error %v", err)
+	}
+	if _, err := new(Config).Topic(); err != ErrNoTopic {
+		t.Errorf("topic error without certificate %v", err)
+	}
+
+	// HTTP2Client использует идентификатор из сертификата по умолчанию
+	config.BundleID = ""
+	if client := NewHTTP2Client(config); client.topic != "com.example.app" {
+		t.Errorf("HTTP/2 default topic %q", client.topic)
+	}
+}
+
+func TestConfigHost(t *testing.T) {
+	for host, valid := range map[string]bool{
+		"":                   true,
+		"127.0.0.1:2195":     true,
+		"[::1]:2195":         true,
+		"proxy.example:443":  true,
+		"gateway.example":    false,
+		"gateway.example:":   false,
+		"::1:2195":           false,
+		"http://example:443": false,
+	} {
+		var config = &Config{Host: host}
+		config.SetLogger(log.New(ioutil.Discard, "", 0))
+		client, err := NewClient(config)
+		if valid != (err == nil) || (err != nil && !errors.Is(err, ErrHostInvalid)) {
+			t.Errorf("host %q: %v", host, err)
+		}
+		if err != nil {
+			continue
+		}
+		if expected := config.Host; expected != "" && client.host != expected {
+			t.Errorf("client host %q, expected %q", client.host, expected)
+		} else if expected == "" && client.host != ServerApns {
+			t.Errorf("default host %q", client.host)
+		}
+		client.Close(false)
+	}
+}
+
+func TestClientTLSState(t *testing.T) {
+	serverCert, _ := testCertificate(t)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		MaxVersion:   tls.VersionTLS12,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.(*tls.Conn).Handshake()
+		io.Copy(ioutil.Discard, conn) // держим соединение открытым до закрытия клиентом
+	}()
+
+	var clientCert, _ = testCertificate(t)
+	clientCert.Leaf.NotAfter = serverCert.Leaf.NotAfter.Add(-time.Minute)
+	var config = &Config{
+		Host:               listener.Addr().String(),
+		InsecureSkipVerify: true,
+		Certificate:        clientCert,
+	}
+	config.SetLogger(log.New(ioutil.Discard, "", 0))
+	client, err := NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close(false)
+	if _, ok := client.TLSState(); ok {
+		t.Error("TLS state without connection")
+	}
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	state, ok := client.TLSState()
+	if !ok {
+		t.Fatal("no TLS state")
+	}
+	if state.Version != tls.VersionTLS12 || state.CipherSuite == 0 || state.RemoteAddr != config.Host {
+		t.Errorf("bad TLS state: %+v", state)
+	}
+	if !state.ServerNotAfter.Equal(serverCert.Leaf.NotAfter) ||
+		!state.ClientNotAfter.Equal(clientCert.Leaf.NotAfter) {
+		t.Errorf("bad expiration: server %v, client %v", state.ServerNotAfter, state.ClientNotAfter)
+	}
+	if !state.NotAfter().Equal(state.ClientNotAfter) {
+		t.Errorf("earliest expiration %v, expected client %v", state.NotAfter(), state.ClientNotAfter)
+	}
+	if s := state.String(); !strings.Contains(s, "TLS 1.2") || !strings.Contains(s, "Client Cert Expires") {
+		t.Errorf("bad state string:\n%s", s)
+	}
+}
+
+func TestConfigTLSConfig(t *testing.T) {
+	cert, roots := testCertificate(t)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	var versions = make(chan uint16, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var tlsConn = conn.(*tls.Conn)
+		if err := tlsConn.Handshake(); err != nil {
+			versions <- 0
+			return
+		}
+		versions <- tlsConn.ConnectionState().Version
+	}()
+
+	var base = &tls.Config{
+		RootCAs:    roots, // сертификат сервера проверяется по имени из адреса сервера
+		MinVersion: tls.VersionTLS12,
+		MaxVersion: tls.VersionTLS12,
+	}
+	var config = &Config{TLSConfig: base}
+	config.SetLogger(log.New(ioutil.Discard, "", 0))
+	conn, err := config.Dial(listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if version := <-versions; version != tls.VersionTLS12 {
+		t.Errorf("TLS version %x, expected TLS 1.2", version)
+	}
+	if base.ServerName != "" || base.Certificates != nil {
+		t.Error("base TLS config is modified")
+	}
+	var tlsConfig = (&Config{TLSConfig: base, Certificate: cert}).tlsConfig("gateway")
+	if len(tlsConfig.Certificates) != 1 || tlsConfig.ServerName != "gateway" || tlsConfig.RootCAs != roots {
+		t.Errorf("bad TLS config: %+v", tlsConfig)
+	}
+}
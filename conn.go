@@ -1,39 +1,126 @@
 package apns
 
 import (
-	"crypto/tls"
+	"context"
 	"io"
+	"math/rand"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// connection описывает соединение с сервером, через которое клиент отправляет уведомления. Клиент
+// работает с соединением только через этот интерфейс (см. apnsConn).
+type connection interface {
+	io.Writer
+	// Connect устанавливает новое соединение с сервером, закрывая предыдущее.
+	Connect() error
+	// SetReadDeadline устанавливает время ожидания ответа для текущего соединения.
+	SetReadDeadline(t time.Time) error
+	// Close окончательно закрывает соединение и запасные соединения.
+	Close()
+	// Reset закрывает соединение, не устанавливая нового, и возвращает false, если оно не было
+	// установлено.
+	Reset() bool
+	// isConnected возвращает true, если соединение установлено.
+	isConnected() bool
+	// disconnect помечает текущее соединение неустановленным: следующая отправка устанавливает
+	// новое.
+	disconnect()
+	// current возвращает текущее сетевое соединение или nil.
+	current() net.Conn
+	// warmup задает количество поддерживаемых запасных соединений.
+	warmup(spares int)
+	// fill устанавливает недостающие текущее и запасные соединения.
+	fill() error
+	// count возвращает количество установленных соединений, включая запасные.
+	count() int
+	// backoffs возвращает текущую максимальную задержку перед повторной попыткой соединения и
+	// задержку, выбранную для последней попытки.
+	backoffs() (backoff, delay time.Duration)
+}
+
 // apnsConn описывает соединение с APNS-сервером. Соединение отслеживает все ошибки, которые могут
 // возвращаться сервером, а так же умеет автоматически переподключаться к серверу в случае разрыва
 // соединения.
 type apnsConn struct {
-	*tls.Conn         // соединение с сервером
-	connected aBool   // флаг установленного соединения
-	closed    aBool   // флаг закрытия соединения
-	client    *Client // клиент соединения
+	net.Conn             // соединение с сервером
+	spares    []net.Conn // заранее установленные запасные соединения (см. Client.Warmup)
+	warm      int        // количество запасных соединений, которое поддерживается
+	connected aBool      // флаг установленного соединения
+	closed    aBool      // флаг закрытия соединения
+	client    *Client    // клиент соединения
+	backoff   int64      // текущая максимальная задержка перед повторной попыткой соединения
+	delay     int64      // задержка, выбранная для последней повторной попытки соединения
 	mu        sync.Mutex
 }
 
+// current возвращает текущее соединение с сервером.
+func (conn *apnsConn) current() net.Conn {
+	conn.mu.Lock()
+	var result = conn.Conn
+	conn.mu.Unlock()
+	return result
+}
+
+// isConnected возвращает true, если соединение с сервером установлено.
+func (conn *apnsConn) isConnected() bool { return conn.connected.Is() }
+
+// disconnect помечает текущее соединение неустановленным, не закрывая его: оно будет закрыто при
+// установке нового соединения.
+func (conn *apnsConn) disconnect() { conn.connected.Set(false) }
+
+// backoffs возвращает текущую максимальную задержку перед повторной попыткой соединения и
+// задержку, выбранную для последней попытки.
+func (conn *apnsConn) backoffs() (backoff, delay time.Duration) {
+	return time.Duration(atomic.LoadInt64(&conn.backoff)), time.Duration(atomic.LoadInt64(&conn.delay))
+}
+
+// Write записывает данные в текущее соединение с сервером.
+func (conn *apnsConn) Write(data []byte) (int, error) {
+	var netConn = conn.current()
+	if netConn == nil {
+		return 0, io.ErrClosedPipe
+	}
+	return netConn.Write(data)
+}
+
+// SetReadDeadline устанавливает время ожидания ответа для текущего соединения с сервером.
+func (conn *apnsConn) SetReadDeadline(t time.Time) error {
+	var netConn = conn.current()
+	if netConn == nil {
+		return io.ErrClosedPipe
+	}
+	return netConn.SetReadDeadline(t)
+}
+
 // handleReads читает из открытого соединения и ждет получения информации об ошибке. После этого
 // автоматически закрывает текущее соединение и запускает процесс установки нового соединения,
 // кроме случаев, когда соединение закрыто из-за долгой неактивности.
 //
 // Если в ответе от сервера содержится информация об идентификаторе ошибочного сообщения, то все
 // сообщения, отосланные после него будут заново автоматически отосланы.
-func (conn *apnsConn) handleReads() {
+//
+// В качестве параметра передается соединение, из которого ведется чтение: если к моменту получения
+// ошибки оно уже было заменено новым соединением, то ошибка не обрабатывается.
+func (conn *apnsConn) handleReads(netConn net.Conn) {
 	// defer un(trace("[handleReads]")) // DEBUG
 	var header = make([]byte, 6) // читаем заголовок сообщения
-	_, err := conn.Read(header)
+	_, err := netConn.Read(header)
 	if err == nil {
 		err = parseAPNSError(header) // разбираем сообщение и конвертируем в описание ошибки
 	}
-	if conn.closed.Is() {
-		return // выходим без обработки ошибок при закрытии соединения
+	// проверка и удаление запасного соединения выполняются под той же блокировкой, под которой
+	// Connect делает запасное соединение текущим
+	conn.mu.Lock()
+	var current = conn.Conn == netConn
+	if !current {
+		conn.dropSpare(netConn) // запасное соединение закрыто сервером или после простоя
+	}
+	conn.mu.Unlock()
+	if conn.closed.Is() || !current {
+		return // выходим без обработки ошибок при закрытии или замене соединения
 	}
 	// обрабатываем ошибки в зависимости от их типа
 	switch err.(type) {
@@ -41,36 +128,62 @@ func (conn *apnsConn) handleReads() {
 		var err = err.(net.Error)
 		if err.Timeout() {
 			conn.connected.Set(false)
-			conn.client.config.log.Println("Timeout, not doing auto reconnect")
+			netConn.Close() // закрываем соединение после простоя
+			conn.client.currentConfig().logger().Println("Timeout, not doing auto reconnect")
 			return // не осуществляем подключения
 		}
-		conn.client.config.log.Println("Network Error:", err)
-	case apnsError: // ошибка, вернувшаяся от сервер APNS
-		var err = err.(apnsError)
-		if err.ID != 0 {
-			conn.client.config.log.Printf("Error in message [%d]: %s",
-				err.ID, apnsErrorMessages[err.Status])
+		conn.client.currentConfig().logger().Println("Network Error:", err)
+	case APNsError: // ошибка, вернувшаяся от сервер APNS
+		var err = err.(APNsError)
+		if err.Status == StatusShutdown {
+			// сервер закрывает соединение для обслуживания: уведомление с указанным
+			// идентификатором последнее принятое им, поэтому это не ошибка, а только причина
+			// переподключиться и отправить заново уведомления, отправленные после него
+			conn.client.currentConfig().logger().Printf("Server shutdown after message [%d]",
+				err.NotificationID)
+			if err.NotificationID != 0 {
+				conn.mu.Lock()
+				var count = conn.client.queue.ResendFromID(err.NotificationID, true)
+				conn.mu.Unlock()
+				atomic.AddUint64(&conn.client.requeued, uint64(count))
+			}
+			break
+		}
+		conn.client.errors.Add(err.Status) // учитываем ошибку в статистике
+		if err.Status > 0 {
+			atomic.AddUint64(&conn.client.failed, 1)
+		}
+		if err.NotificationID != 0 {
+			conn.client.currentConfig().logger().Printf("Error in message [%d]: %s",
+				err.NotificationID, apnsErrorMessages[err.Status])
+			if ntf := conn.client.queue.Find(err.NotificationID); ntf != nil && err.Status > 0 {
+				if conn.client.OnError != nil {
+					conn.client.OnError(ntf.ID, ntf.Token, err.Status)
+				}
+				conn.client.report(newSendResult(ntf, err))
+			}
 			// послать все сообщения после ошибочного заново
 			conn.mu.Lock()
-			conn.client.queue.ResendFromID(err.ID, err.Status > 0)
+			var count = conn.client.queue.ResendFromID(err.NotificationID, err.Status > 0)
 			conn.mu.Unlock()
+			atomic.AddUint64(&conn.client.requeued, uint64(count))
 		} else {
-			conn.client.config.log.Printf("APNS error: %s", apnsErrorMessages[err.Status])
+			conn.client.currentConfig().logger().Printf("APNS error: %s", apnsErrorMessages[err.Status])
 		}
 	default:
 		switch err {
 		case io.EOF:
-			conn.client.config.log.Println("Connection closed by server")
-		case errBadResponseSize:
-			conn.client.config.log.Println("Bad server response")
+			conn.client.currentConfig().logger().Println("Connection closed by server")
+		case errBadResponseSize, errBadResponseCommand:
+			conn.client.currentConfig().logger().Println("Bad server response")
 		default:
-			conn.client.config.log.Println("Error:", err)
-			// conn.client.config.log.Printf("Type [%T]: %+v", err, err) // DEBUG
+			conn.client.currentConfig().logger().Println("Error:", err)
+			// conn.client.currentConfig().logger().Printf("Type [%T]: %+v", err, err) // DEBUG
 		}
 	}
-	// снова подключаемся к серверу
-	if err = conn.Connect(); err != nil {
-		panic("unknown network error")
+	// снова подключаемся к серверу и отправляем уведомления, которые были возвращены в очередь
+	if conn.Connect() == nil && conn.client.queue.IsHasToSend() {
+		conn.client.start(context.Background())
 	}
 }
 
@@ -80,51 +193,120 @@ func (conn *apnsConn) Close() {
 	if conn.Conn != nil {
 		conn.Conn.Close()
 	}
+	conn.closeSpares()
 	conn.mu.Unlock()
 	conn.connected.Set(false)
 	conn.closed.Set(true)
 }
 
+// Reset закрывает текущее соединение с сервером и запасные соединения, не устанавливая новых:
+// они будут установлены при следующей отправке и проверке KeepAlive. Ошибки, которые сервер мог
+// вернуть в закрываемое соединение, не обрабатываются. Возвращает false, если соединение не было
+// установлено.
+func (conn *apnsConn) Reset() bool {
+	conn.mu.Lock()
+	var netConn = conn.Conn
+	conn.Conn = nil // handleReads закрываемого соединения завершится без переподключения
+	conn.connected.Set(false)
+	conn.closeSpares()
+	conn.mu.Unlock()
+	if netConn == nil {
+		return false
+	}
+	netConn.Close()
+	return true
+}
+
 // Connect устанавливает новое соединение с сервером. Если предыдущее соединение при этом было
-// открыто, то оно автоматически закрывается. В случае ошибки установки соединения, этот процесс
-// повторяется до бесконечности с постоянно увеличивающимся интервалом между попытками.
+// открыто, то оно автоматически закрывается. Если есть запасное соединение, установленное Warmup,
+// то вместо установки нового используется оно. В случае ошибки установки соединения, этот процесс
+// повторяется до бесконечности с постоянно увеличивающимся интервалом между попытками, пока клиент
+// не будет закрыт: в этом случае возвращается ошибка ErrClientIsClosed.
 func (conn *apnsConn) Connect() error {
+	select {
+	case <-conn.client.done:
+		return ErrClientIsClosed // клиент закрыт - не подключаемся
+	default:
+	}
 	conn.mu.Lock()
-	if conn.Conn != nil {
+	var reconnect = conn.Conn != nil // соединение уже устанавливалось раньше
+	if reconnect {
 		conn.Conn.Close()
 	}
+	var spare = conn.takeSpare()
+	if spare != nil {
+		conn.Conn = spare // чтение из него уже запущено при установке
+	}
 	conn.mu.Unlock()
-	conn.connected.Set(false)
 	conn.closed.Set(false)
-	var startDuration = DurationReconnect
+	if spare != nil {
+		if reconnect {
+			atomic.AddUint64(&conn.client.reconnects, 1)
+		}
+		spare.SetReadDeadline(time.Now().Add(conn.client.idleTimeout()))
+		conn.connected.Set(true)
+		conn.client.keepAlive()
+		return nil
+	}
+	conn.connected.Set(false)
+	var (
+		base    = conn.client.ReconnectBase // начальная задержка между попытками
+		limit   = conn.client.ReconnectMax  // максимальная задержка между попытками
+		backoff = base                      // текущая максимальная задержка
+	)
+	atomic.StoreInt64(&conn.backoff, int64(backoff))
 	for {
-		conn.client.config.log.Println("Connecting to server", conn.client.host)
-		tlsConn, err := conn.client.config.Dial(conn.client.host)
+		netConn, err := conn.client.dial()
 		switch err.(type) {
 		case nil: // соединение установлено
-			conn.client.config.log.Print(tlsConnectionStateString(tlsConn))
+			if reconnect {
+				atomic.AddUint64(&conn.client.reconnects, 1)
+			}
 			conn.mu.Lock()
-			conn.Conn = tlsConn
+			conn.Conn = netConn
 			conn.mu.Unlock()
 			conn.connected.Set(true)
-			go conn.handleReads() // запускаем чтение ошибок из соединения
+			// после установки соединения задержка снова становится минимальной
+			atomic.StoreInt64(&conn.backoff, int64(base))
+			go conn.handleReads(netConn) // запускаем чтение ошибок из соединения
+			conn.client.keepAlive()
 			return nil
 		case net.Error: // сетевая ошибка
 			err := err.(net.Error)
-			conn.client.config.log.Println("Error connecting to APNS:", err)
+			conn.client.currentConfig().logger().Println("Error connecting to APNS:", err)
 		default: // другая ошибка
 			if err == io.EOF {
-				conn.client.config.log.Println("Connection closed by server")
+				conn.client.currentConfig().logger().Println("Connection closed by server")
 			} else {
-				conn.client.config.log.Println("Connection error:", err)
-				conn.client.config.log.Printf("Type [%T]: %#v", err, err) // DEBUG
+				conn.client.currentConfig().logger().Println("Connection error:", err)
+				conn.client.currentConfig().logger().Printf("Type [%T]: %#v", err, err) // DEBUG
 				// return err // необрабатываемая ошибка
 			}
 		}
-		conn.client.config.log.Printf("Waiting %s ...", startDuration.String())
-		time.Sleep(startDuration) // добавляем задержку между попытками
-		if startDuration < time.Minute*30 {
-			startDuration += DurationReconnect // увеличиваем задержку
+		// выбираем случайную задержку, чтобы клиенты, потерявшие соединение одновременно, не
+		// соединялись с сервером тоже одновременно
+		var delay = jitter(backoff)
+		atomic.StoreInt64(&conn.delay, int64(delay))
+		conn.client.currentConfig().logger().Printf("Waiting %s ...", delay.String())
+		select { // добавляем задержку между попытками
+		case <-time.After(delay):
+		case <-conn.client.done:
+			return ErrClientIsClosed
 		}
+		if backoff < limit {
+			backoff *= 2 // увеличиваем задержку
+			if backoff > limit || backoff <= 0 {
+				backoff = limit
+			}
+			atomic.StoreInt64(&conn.backoff, int64(backoff))
+		}
+	}
+}
+
+// jitter возвращает случайную задержку в интервале от 0 до max включительно.
+func jitter(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
 	}
+	return time.Duration(rand.Int63n(int64(max) + 1))
 }
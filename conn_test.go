@@ -0,0 +1,797 @@
+package apns
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testServer эмулирует сервер APNS: каждое новое соединение клиента создается в памяти, а его
+// серверная сторона становится доступной через Accept.
+type testServer struct {
+	conns chan net.Conn // серверные стороны установленных соединений
+}
+
+// newOfflineClient возвращает клиента, который не отправляет уведомления, а только помещает их
+// в очередь.
+func newOfflineClient(t testing.TB, config *Config) *Client {
+	config.SetLogger(log.New(ioutil.Discard, "", 0))
+	client, err := NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.sending.Set(true) // не запускаем отправку
+	return client
+}
+
+// newTestClient возвращает клиента, соединения которого устанавливаются с тестовым сервером.
+func newTestClient(t testing.TB) (*Client, *testServer) {
+	var config = new(Config)
+	config.SetLogger(log.New(ioutil.Discard, "", 0))
+	client, err := NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var server = &testServer{conns: make(chan net.Conn, 10)}
+	client.dialFunc = func(addr string) (net.Conn, error) {
+		clientConn, serverConn := net.Pipe()
+		server.conns <- serverConn
+		return clientConn, nil
+	}
+	return client, server
+}
+
+// Accept возвращает серверную сторону следующего соединения, установленного клиентом.
+func (s *testServer) Accept(t *testing.T) net.Conn {
+	select {
+	case conn := <-s.conns:
+		return conn
+	case <-time.After(5 * time.Second):
+		t.Fatal("client does not connect")
+		return nil
+	}
+}
+
+// testCertificate возвращает самоподписанный сертификат для адреса 127.0.0.1 и список
+// корневых сертификатов, которым он доверяет.
+func testCertificate(t testing.TB) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var template = &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "APNS test server"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pool = x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}, pool
+}
+
+// readFrame читает из потока и возвращает один фрейм уведомления.
+func readFrame(r io.Reader) ([]byte, error) {
+	var header = make([]byte, 5)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	var frame = make([]byte, 5+binary.BigEndian.Uint32(header[1:]))
+	copy(frame, header)
+	if _, err := io.ReadFull(r, frame[5:]); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+// testTokens возвращает список из указанного количества различных токенов устройств.
+func testTokens(count int) []string {
+	var tokens = make([]string, count)
+	for i := range tokens {
+		tokens[i] = fmt.Sprintf("%064x", i+1)
+	}
+	return tokens
+}
+
+// syncBuffer описывает байтовый буфер, безопасный для одновременного использования.
+type syncBuffer struct {
+	buf bytes.Buffer
+	mu  sync.Mutex
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]byte(nil), b.buf.Bytes()...)
+}
+
+func TestClientErrorCounts(t *testing.T) {
+	client, server := newTestClient(t)
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	for i, status := range []uint8{8, 8, 7, 1} {
+		conn := server.Accept(t)
+		if _, err := conn.Write([]byte{8, status, 0, 0, 0, byte(i + 1)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	server.Accept(t) // ошибка обработана, когда клиент переподключился
+	client.Close(false)
+
+	var counts = client.ErrorCounts()
+	if len(counts) != 3 || counts[8] != 2 || counts[7] != 1 || counts[1] != 1 {
+		t.Errorf("bad error counts: %v", counts)
+	}
+}
+
+func TestClientIdleTimeout(t *testing.T) {
+	client, server := newTestClient(t)
+	client.SendDelay = 0 // отправляем без задержки, чтобы она не влияла на время простоя
+	client.IdleTimeout = 200 * time.Millisecond
+	var (
+		ntf   = &Notification{Payload: NewPayload().Sound(DefaultSound)}
+		token = testTokens(1)
+		conn  net.Conn
+	)
+	for i := 0; i < 2; i++ {
+		if err := client.Send(ntf, token...); err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			conn = server.Accept(t)
+		}
+		if _, err := readFrame(conn); err != nil {
+			t.Fatalf("send %d: %v", i, err)
+		}
+		time.Sleep(client.IdleTimeout / 2) // небольшой перерыв не разрывает соединение
+	}
+	select {
+	case conn := <-server.conns:
+		conn.Close()
+		t.Fatal("connection was reestablished during short gap")
+	default:
+	}
+	// после простоя соединение закрывается клиентом
+	conn.SetReadDeadline(time.Now().Add(2 * client.IdleTimeout))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("idle connection read: %v", err)
+	}
+	if err := client.Send(ntf, token...); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readFrame(server.Accept(t)); err != nil {
+		t.Fatal(err)
+	}
+	client.Close(false)
+}
+
+func TestClientResendAfterError(t *testing.T) {
+	client, server := newTestClient(t)
+	var (
+		tokens   = testTokens(4)
+		rejected []string
+	)
+	client.OnError = func(id uint32, token []byte, status uint8) {
+		rejected = append(rejected, fmt.Sprintf("%d:%x:%d", id, token, status))
+	}
+	if err := client.Send(&Notification{Payload: NewPayload().Sound(DefaultSound)},
+		tokens...); err != nil {
+		t.Fatal(err)
+	}
+	conn := server.Accept(t)
+	for range tokens {
+		if _, err := readFrame(conn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for client.sending.Is() { // ждем окончания отправки
+		time.Sleep(10 * time.Millisecond)
+	}
+	// сервер отклоняет второе уведомление: третье и четвертое отправляются заново без вызова Send
+	if _, err := conn.Write([]byte{8, 8, 0, 0, 0, 2}); err != nil {
+		t.Fatal(err)
+	}
+	conn = server.Accept(t)
+	for _, token := range tokens[2:] {
+		frame, err := readFrame(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resent := hex.EncodeToString(frame[8:40]); resent != token {
+			t.Errorf("resent token %s, expected %s", resent, token)
+		}
+	}
+	for client.sending.Is() { // ждем окончания повторной отправки
+		time.Sleep(10 * time.Millisecond)
+	}
+	client.Close(false)
+	if sent, failed, requeued, reconnects := client.SentCount(), client.ErrorCount(),
+		client.RequeuedCount(), client.ReconnectCount(); sent != 6 || failed != 1 ||
+		requeued != 2 || reconnects != 1 {
+		t.Errorf("counters: sent %d, failed %d, requeued %d, reconnects %d",
+			sent, failed, requeued, reconnects)
+	}
+	if counts := client.ErrorCounts(); counts[8] != 1 {
+		t.Errorf("bad error counts: %v", counts)
+	}
+	if stats := client.Stats(); stats.Sent != 6 || stats.Errors != 1 || stats.ErrorsByStatus[8] != 1 ||
+		stats.Requeued != 2 || stats.Reconnects != 1 || stats.Pending != 0 || stats.Connected {
+		t.Errorf("bad stats: %+v", stats)
+	}
+	if len(rejected) != 1 || rejected[0] != "2:"+tokens[1]+":8" {
+		t.Errorf("bad error callbacks: %v", rejected)
+	}
+}
+
+func TestClientReconnectBackoff(t *testing.T) {
+	client, server := newTestClient(t)
+	client.ReconnectBase = 10 * time.Millisecond
+	client.ReconnectMax = 25 * time.Millisecond
+	var (
+		dial     = client.dialFunc
+		attempts []time.Duration // максимальная задержка, действующая при каждой попытке соединения
+		delays   []time.Duration // фактическая задержка перед каждой повторной попыткой
+	)
+	client.dialFunc = func(addr string) (net.Conn, error) {
+		attempts = append(attempts, client.ReconnectBackoff())
+		if len(attempts) > 1 {
+			delays = append(delays, client.ReconnectDelay())
+		}
+		if len(attempts) <= 4 {
+			return nil, errors.New("network is unreachable")
+		}
+		return dial(addr)
+	}
+	if err := client.conn.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	server.Accept(t)
+	var expected = []time.Duration{10, 20, 25, 25, 25} // экспоненциальный рост до ReconnectMax
+	if len(attempts) != len(expected) {
+		t.Fatalf("%d attempts, expected %d", len(attempts), len(expected))
+	}
+	for i, backoff := range attempts {
+		if backoff != expected[i]*time.Millisecond {
+			t.Errorf("attempt %d: backoff %v, expected %v", i, backoff, expected[i]*time.Millisecond)
+		}
+	}
+	for i, delay := range delays {
+		if delay < 0 || delay > attempts[i] {
+			t.Errorf("delay %d: %v is out of [0, %v]", i, delay, attempts[i])
+		}
+	}
+	if backoff := client.ReconnectBackoff(); backoff != client.ReconnectBase {
+		t.Errorf("backoff %v after connect, expected %v", backoff, client.ReconnectBase)
+	}
+	client.Close(false)
+}
+
+func TestJitter(t *testing.T) {
+	const max = 100 * time.Millisecond
+	var min, top = max, time.Duration(0)
+	for i := 0; i < 1000; i++ {
+		var delay = jitter(max)
+		if delay < 0 || delay > max {
+			t.Fatalf("delay %v is out of [0, %v]", delay, max)
+		}
+		if delay < min {
+			min = delay
+		}
+		if delay > top {
+			top = delay
+		}
+	}
+	if min > max/4 || top < max*3/4 { // задержки распределены по всему интервалу
+		t.Errorf("delays are not spread: from %v to %v", min, top)
+	}
+	if delay := jitter(0); delay != 0 {
+		t.Errorf("zero jitter %v", delay)
+	}
+}
+
+// fakeConn описывает соединение с сервером APNS в памяти. В отличие от testServer, запись в него
+// никогда не блокируется, а все записанные фреймы сохраняются, поэтому их можно проверить после
+// отправки. Ответы сервера и ошибки чтения передаются в соединение с помощью Inject.
+type fakeConn struct {
+	written bytes.Buffer  // все записанные в соединение данные
+	reads   chan []byte   // ответы сервера
+	errs    chan error    // ошибки чтения
+	closed  chan struct{} // канал, закрываемый при закрытии соединения
+	fails   int           // количество следующих записей, завершающихся ошибкой
+	once    sync.Once
+	mu      sync.Mutex
+}
+
+// fakeAddr описывает адрес соединения в памяти.
+type fakeAddr struct{}
+
+func (fakeAddr) Network() string { return "memory" }
+func (fakeAddr) String() string  { return "apns" }
+
+// newFakeClient возвращает клиента с отключенной автоматической отправкой, соединения которого
+// создаются в памяти и передаются в возвращаемый канал по мере установки.
+func newFakeClient(t testing.TB) (*Client, <-chan *fakeConn) {
+	var config = new(Config)
+	config.SetLogger(log.New(ioutil.Discard, "", 0))
+	client, err := NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.ManualSend = true
+	client.ReconnectBase = time.Millisecond
+	var conns = make(chan *fakeConn, 10)
+	client.dialFunc = func(addr string) (net.Conn, error) {
+		var conn = &fakeConn{
+			reads:  make(chan []byte, 1),
+			errs:   make(chan error, 1),
+			closed: make(chan struct{}),
+		}
+		conns <- conn
+		return conn, nil
+	}
+	return client, conns
+}
+
+// nextFakeConn возвращает следующее соединение, установленное клиентом, дождавшись, пока клиент
+// не начнет его использовать.
+func nextFakeConn(t *testing.T, client *Client, conns <-chan *fakeConn) *fakeConn {
+	var timeout = time.After(5 * time.Second)
+	select {
+	case conn := <-conns:
+		for client.conn.current() != net.Conn(conn) || !client.conn.isConnected() {
+			select {
+			case <-timeout:
+				t.Fatal("client does not use connection")
+			case <-time.After(time.Millisecond):
+			}
+		}
+		return conn
+	case <-timeout:
+		t.Fatal("client does not connect")
+		return nil
+	}
+}
+
+func (c *fakeConn) Read(p []byte) (int, error) {
+	select {
+	case data := <-c.reads:
+		return copy(p, data), nil
+	case err := <-c.errs:
+		return 0, err
+	case <-c.closed:
+		return 0, io.EOF
+	}
+}
+
+func (c *fakeConn) Write(p []byte) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.fails > 0 {
+		c.fails--
+		return 0, io.ErrClosedPipe
+	}
+	return c.written.Write(p)
+}
+
+// FailWrites задает количество следующих записей в соединение, завершающихся ошибкой.
+func (c *fakeConn) FailWrites(n int) {
+	c.mu.Lock()
+	c.fails = n
+	c.mu.Unlock()
+}
+
+func (c *fakeConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *fakeConn) LocalAddr() net.Addr                { return fakeAddr{} }
+func (c *fakeConn) RemoteAddr() net.Addr               { return fakeAddr{} }
+func (c *fakeConn) SetDeadline(t time.Time) error      { return nil }
+func (c *fakeConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *fakeConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// InjectError передает клиенту ответ сервера с ошибкой для уведомления с указанным идентификатором.
+func (c *fakeConn) InjectError(status uint8, id uint32) {
+	var data = []byte{8, status, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(data[2:], id)
+	c.reads <- data
+}
+
+// InjectReadError передает клиенту ошибку чтения из соединения.
+func (c *fakeConn) InjectReadError(err error) { c.errs <- err }
+
+// IDs возвращает идентификаторы уведомлений из всех записанных в соединение фреймов.
+func (c *fakeConn) IDs(t *testing.T) []uint32 {
+	c.mu.Lock()
+	var r = bytes.NewReader(c.written.Bytes())
+	c.mu.Unlock()
+	var ids []uint32
+	for r.Len() > 0 {
+		frame, err := readFrame(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ntf := decodeFrameItems(frame[5:])
+		if ntf == nil {
+			t.Fatalf("bad frame %x", frame)
+		}
+		ids = append(ids, ntf.ID)
+	}
+	return ids
+}
+
+func TestFakeConnResend(t *testing.T) {
+	client, conns := newFakeClient(t)
+	defer client.Close(false)
+	if err := client.Send(&Notification{Payload: NewPayload().Alert("test")}, testTokens(5)...); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.DrainOnce(); err != nil {
+		t.Fatal(err)
+	}
+	var conn = nextFakeConn(t, client, conns)
+	if ids := fmt.Sprint(conn.IDs(t)); ids != "[1 2 3 4 5]" {
+		t.Fatalf("sent %s", ids)
+	}
+	conn.InjectError(StatusInvalidToken, 3)
+	conn = nextFakeConn(t, client, conns) // уведомления после ошибочного возвращены в очередь до соединения
+	if err := client.DrainOnce(); err != nil {
+		t.Fatal(err)
+	}
+	if ids := fmt.Sprint(conn.IDs(t)); ids != "[4 5]" {
+		t.Errorf("resent %s, expected [4 5]", ids)
+	}
+	if client.ErrorCount() != 1 || client.RequeuedCount() != 2 || client.ReconnectCount() != 1 {
+		t.Errorf("counters: %d errors, %d requeued, %d reconnects",
+			client.ErrorCount(), client.RequeuedCount(), client.ReconnectCount())
+	}
+}
+
+func TestFakeConnShutdown(t *testing.T) {
+	client, conns := newFakeClient(t)
+	defer client.Close(false)
+	var rejected = make(chan uint32, 1)
+	client.OnError = func(id uint32, token []byte, status uint8) { rejected <- id }
+	var results = make(chan SendResult, 10)
+	client.Results = results
+	if err := client.Send(&Notification{Payload: NewPayload().Alert("test")}, testTokens(3)...); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.DrainOnce(); err != nil {
+		t.Fatal(err)
+	}
+	nextFakeConn(t, client, conns).InjectError(StatusShutdown, 1)
+	var conn = nextFakeConn(t, client, conns) // сервер закрыл соединение: клиент переподключился
+	if err := client.DrainOnce(); err != nil {
+		t.Fatal(err)
+	}
+	if ids := fmt.Sprint(conn.IDs(t)); ids != "[2 3]" {
+		t.Errorf("resent %s, expected [2 3]", ids)
+	}
+	select {
+	case id := <-rejected:
+		t.Errorf("OnError is called for shutdown after message %d", id)
+	default:
+	}
+	for len(results) > 0 {
+		if result := <-results; result.Err != nil {
+			t.Errorf("error result for message %d: %v", result.ID, result.Err)
+		}
+	}
+	if client.ErrorCount() != 0 || len(client.ErrorCounts()) != 0 || client.RequeuedCount() != 2 ||
+		client.ReconnectCount() != 1 {
+		t.Errorf("counters: %d errors %v, %d requeued, %d reconnects", client.ErrorCount(),
+			client.ErrorCounts(), client.RequeuedCount(), client.ReconnectCount())
+	}
+}
+
+func TestFakeConnReadError(t *testing.T) {
+	client, conns := newFakeClient(t)
+	defer client.Close(false)
+	if err := client.Send(&Notification{Payload: NewPayload().Alert("test")}, testTokens(2)...); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.DrainOnce(); err != nil {
+		t.Fatal(err)
+	}
+	nextFakeConn(t, client, conns).InjectReadError(errors.New("connection reset"))
+	var conn = nextFakeConn(t, client, conns)
+	if client.Pending() != 0 || client.ReconnectCount() != 1 {
+		t.Errorf("%d pending, %d reconnects after read error", client.Pending(), client.ReconnectCount())
+	}
+	// новое соединение используется для следующих уведомлений
+	if err := client.Send(&Notification{Payload: NewPayload().Alert("test")}, testTokens(1)...); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.DrainOnce(); err != nil {
+		t.Fatal(err)
+	}
+	if ids := fmt.Sprint(conn.IDs(t)); ids != "[3]" {
+		t.Errorf("sent %s after reconnect, expected [3]", ids)
+	}
+}
+
+func TestClientSendIDs(t *testing.T) {
+	client, conns := newFakeClient(t)
+	defer client.Close(false)
+	var rejected = make(chan uint32, 1)
+	client.OnError = func(id uint32, token []byte, status uint8) { rejected <- id }
+	var tokens = append(testTokens(3), "bad token")
+	tokens[0], tokens[3] = tokens[3], tokens[0]
+	ids, err := client.SendIDs(&Notification{Payload: NewPayload().Alert("test")}, tokens...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(ids) != "[0 1 2 3]" {
+		t.Fatalf("ids %v, expected [0 1 2 3]", ids)
+	}
+	if err := client.DrainOnce(); err != nil {
+		t.Fatal(err)
+	}
+	nextFakeConn(t, client, conns).InjectError(StatusInvalidToken, ids[2])
+	select {
+	case id := <-rejected:
+		if id != ids[2] {
+			t.Errorf("rejected id %d, expected %d", id, ids[2])
+		}
+	case <-time.After(time.Second):
+		t.Fatal("OnError is not called")
+	}
+	if ids, err = client.SendIDs(&Notification{Payload: NewPayload().Alert("test")}, tokens[1]); err != nil || fmt.Sprint(ids) != "[4]" {
+		t.Errorf("next ids %v (%v), expected [4]", ids, err)
+	}
+}
+
+func TestClientExplicitID(t *testing.T) {
+	client, conns := newFakeClient(t)
+	defer client.Close(false)
+	var rejected = make(chan uint32, 1)
+	client.OnError = func(id uint32, token []byte, status uint8) { rejected <- id }
+	var (
+		tokens = testTokens(2)
+		ntf    = &Notification{Payload: NewPayload().Alert("test"), ID: 2}
+	)
+	if err := client.Send(ntf, tokens...); err != ErrIDMultipleTokens {
+		t.Errorf("multiple tokens error %v", err)
+	}
+	ids, err := client.SendIDs(ntf, tokens[0])
+	if err != nil || fmt.Sprint(ids) != "[2]" {
+		t.Fatalf("explicit ids %v (%v), expected [2]", ids, err)
+	}
+	if err := client.Send(ntf, tokens[1]); err != ErrDuplicateID {
+		t.Errorf("duplicate error %v", err)
+	}
+	// автоматически назначаемые идентификаторы пропускают занятый
+	ids, err = client.SendIDs(&Notification{Payload: NewPayload().Alert("test")}, tokens...)
+	if err != nil || fmt.Sprint(ids) != "[1 3]" {
+		t.Fatalf("auto ids %v (%v), expected [1 3]", ids, err)
+	}
+	var results = client.SendBatch([]BatchItem{
+		{Notification: &Notification{Payload: NewPayload().Alert("test"), ID: 100}, Token: tokens[0]},
+		{Notification: ntf, Token: tokens[1]},
+	})
+	if results[0].ID != 100 || results[0].Err != nil || results[1].Err != ErrDuplicateID {
+		t.Errorf("bad batch results: %+v", results)
+	}
+	if err := client.DrainOnce(); err != nil {
+		t.Fatal(err)
+	}
+	nextFakeConn(t, client, conns).InjectError(StatusInvalidToken, 100)
+	select {
+	case id := <-rejected:
+		if id != 100 {
+			t.Errorf("rejected id %d, expected 100", id)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("OnError is not called")
+	}
+}
+
+func TestClientResetConnection(t *testing.T) {
+	client, server := newTestClient(t)
+	var tokens = testTokens(2)
+	if err := client.ResetConnection(); err != nil { // соединение еще не установлено
+		t.Fatal(err)
+	}
+	if err := client.Send(&Notification{Payload: NewPayload().Alert("test")}, tokens[0]); err != nil {
+		t.Fatal(err)
+	}
+	var conn = server.Accept(t)
+	if _, err := readFrame(conn); err != nil {
+		t.Fatal(err)
+	}
+	for client.sending.Is() { // ждем окончания отправки
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := client.ResetConnection(); err != nil {
+		t.Fatal(err)
+	}
+	if client.Stats().Connected {
+		t.Error("connection is not reset")
+	}
+	if _, err := readFrame(conn); err != io.EOF {
+		t.Errorf("old connection read error %v, expected EOF", err)
+	}
+	// следующая отправка устанавливает новое соединение
+	if err := client.Send(&Notification{Payload: NewPayload().Alert("test")}, tokens[1]); err != nil {
+		t.Fatal(err)
+	}
+	frame, err := readFrame(server.Accept(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token := hex.EncodeToString(frame[8:40]); token != tokens[1] {
+		t.Errorf("sent token %s, expected %s", token, tokens[1])
+	}
+	client.Close(false)
+	if err := client.ResetConnection(); err != ErrClientIsClosed {
+		t.Errorf("reset closed client: %v", err)
+	}
+}
+
+func TestClientKeepAlive(t *testing.T) {
+	client, server := newTestClient(t)
+	client.IdleTimeout = 20 * time.Millisecond
+	client.KeepAlive = 10 * time.Millisecond
+	client.ReconnectBase = time.Millisecond
+	client.SendDelay = time.Millisecond // отправляем раньше, чем соединение будет закрыто
+	if err := client.Send(&Notification{Payload: NewPayload().Alert("test")}, testTokens(1)...); err != nil {
+		t.Fatal(err)
+	}
+	var conn = server.Accept(t)
+	if _, err := readFrame(conn); err != nil {
+		t.Fatal(err)
+	}
+	// после простоя соединение закрывается клиентом, но сразу восстанавливается
+	server.Accept(t)
+	client.Close(false)
+	for client.sending.Is() {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestFakeConnWriteErrorLargeFrame(t *testing.T) {
+	client, conns := newFakeClient(t)
+	defer client.Close(false)
+	var (
+		dial  = client.dialFunc
+		first = true
+	)
+	client.dialFunc = func(addr string) (net.Conn, error) {
+		conn, err := dial(addr)
+		if first { // первая запись фрейма завершается ошибкой
+			conn.(*fakeConn).FailWrites(1)
+			first = false
+		}
+		return conn, err
+	}
+	// во фрейм помещается больше уведомлений, чем в кеш отправленных
+	var tokens = testTokens(3 * NotificationCacheSize)
+	if err := client.Send(&Notification{Payload: NewPayload().Alert("test")}, tokens...); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.DrainOnce(); err != nil {
+		t.Fatal(err)
+	}
+	var delivered = make(map[uint32]bool)
+	for len(conns) > 0 {
+		for _, id := range (<-conns).IDs(t) {
+			delivered[id] = true
+		}
+	}
+	if len(delivered) != len(tokens) {
+		t.Errorf("%d of %d notifications delivered", len(delivered), len(tokens))
+	}
+	if stats := client.Stats(); stats.Requeued != uint64(len(tokens)) {
+		t.Errorf("%d notifications requeued, expected %d", stats.Requeued, len(tokens))
+	}
+}
+
+func TestFakeConnPastExpiration(t *testing.T) {
+	client, conns := newFakeClient(t)
+	defer client.Close(false)
+	// уведомление с уже прошедшим временем жизни отправляется с нулевым, а не отбрасывается
+	if err := client.Send(&Notification{Payload: NewPayload().Alert("test"),
+		Expiration: time.Now().Add(-time.Hour)}, tokenStrings[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.DrainOnce(); err != nil {
+		t.Fatal(err)
+	}
+	var conn = nextFakeConn(t, client, conns)
+	if ids := conn.IDs(t); len(ids) != 1 {
+		t.Fatalf("%d notifications sent, expected 1", len(ids))
+	}
+	conn.mu.Lock()
+	frame, err := readFrame(bytes.NewReader(conn.written.Bytes()))
+	conn.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ntf := decodeFrameItems(frame[5:]); !ntf.Immediate || ntf.Expiration != 0 {
+		t.Errorf("expiration %d, expected 0", ntf.Expiration)
+	}
+}
+
+func TestFakeConnWriteErrorReconnect(t *testing.T) {
+	client, conns := newFakeClient(t)
+	defer client.Close(false)
+	var (
+		dial  = client.dialFunc
+		first = true
+	)
+	client.dialFunc = func(addr string) (net.Conn, error) {
+		conn, err := dial(addr)
+		if first { // запись в первое соединение всегда завершается ошибкой
+			conn.(*fakeConn).FailWrites(1 << 30)
+			first = false
+		}
+		return conn, err
+	}
+	var tokens = testTokens(3)
+	if err := client.Send(&Notification{Payload: NewPayload().Alert("test")}, tokens...); err != nil {
+		t.Fatal(err)
+	}
+	var done = make(chan error, 1)
+	go func() { done <- client.DrainOnce() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("sending is not completed: no reconnect after write error")
+	}
+	if len(conns) != 2 {
+		t.Fatalf("%d connections established, expected 2", len(conns))
+	}
+	<-conns
+	if ids := (<-conns).IDs(t); len(ids) != len(tokens) {
+		t.Errorf("%d notifications delivered, expected %d", len(ids), len(tokens))
+	}
+	if stats := client.Stats(); stats.Requeued != uint64(len(tokens)) {
+		t.Errorf("%d notifications requeued, expected %d", stats.Requeued, len(tokens))
+	}
+}
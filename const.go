@@ -11,21 +11,31 @@ const (
 	ServerApnsSandbox     = "gateway.sandbox.push.apple.com:2195"
 	ServerFeedback        = "feedback.push.apple.com:2196"
 	ServerFeedbackSandbox = "feedback.sandbox.push.apple.com:2196"
+	ServerHTTP2           = "api.push.apple.com:443"
+	ServerHTTP2Sandbox    = "api.sandbox.push.apple.com:443"
 )
 
 // Используемые сервисом времена задержек и ожиданий.
 var (
 	// TimeoutConnect указывает время ожидания ответа от сервера при соединении.
 	TimeoutConnect = 30 * time.Second
-	// DurationReconnect описывает время задержки между переподсоединениями. После каждой ошибки
-	// соединения время задержки увеличивается на эту величину, пока не достигнет максимального
-	// времени в 30 минут. После это уже расти не будет.
+	// DurationReconnect описывает начальную максимальную задержку между переподсоединениями.
+	// После каждой ошибки соединения она удваивается, пока не достигнет 30 минут, а сама задержка
+	// выбирается случайно от нуля до нее. Используется как значение по умолчанию для
+	// Client.ReconnectBase при создании клиента.
 	DurationReconnect = 10 * time.Second
 	// TiemoutRead описывает время закрытия соединения, если не активно.
 	TiemoutRead = 2 * time.Minute
 	// DurationSend описывает время задержки отправки сообщений по умолчанию. Если за это время не
-	// добавили ни одного нового сообщения, то буфер отсылается на сервер.
+	// добавили ни одного нового сообщения, то буфер отсылается на сервер. Используется как значение
+	// по умолчанию для Client.SendDelay при создании клиента.
 	DurationSend = 100 * time.Millisecond
+	// TimeoutDelivered описывает время, по истечении которого отправленное уведомление, на которое
+	// сервер не вернул ошибку, считается доставленным.
+	TimeoutDelivered = 5 * time.Second
+	// TokenRefreshInterval описывает время, в течение которого токен провайдера (TokenAuth)
+	// используется повторно. Apple отклоняет токены старше одного часа.
+	TokenRefreshInterval = 50 * time.Minute
 )
 
 // Используемые по умолчанию значения, для кеширования уведомлений.
@@ -36,21 +46,113 @@ var (
 	MaxFrameBuffer = 65535
 	// CacheLifeTime описывает как долго хранятся отправленные сообщения
 	CacheLifeTime = 5 * time.Minute
+	// AuditQueueSize описывает количество фреймов, ожидающих записи в журнал аудита. Если журнал
+	// не успевает их записывать, то новые фреймы в него не попадают.
+	AuditQueueSize = 100
+	// MaxQueueDepth описывает максимальное количество неотправленных уведомлений в очереди, до
+	// которого Client.SendFromReader добавляет в нее новые уведомления, если для клиента не задан
+	// Client.MaxQueueSize.
+	MaxQueueDepth = 10000
 )
 
-// MaxPayloadSize описывает максимально допустимую длину для payload уведомления.
+// MaxPayloadSize описывает максимально допустимую длину для payload уведомления. Значение по
+// умолчанию соответствует ограничению бинарного протокола APNS; при работе с сервером, который
+// допускает 4096 байт, его можно увеличить.
 var MaxPayloadSize = 2048
 
+// MaxTokenSize описывает максимально допустимый размер токена устройства в байтах. Обычно токены
+// устройств имеют размер 32 байта, но в некоторых окружениях могут быть длиннее.
+var MaxTokenSize = 100
+
+// MaxCollapseIDSize описывает максимально допустимую длину идентификатора группировки уведомлений
+// (apns-collapse-id) в байтах.
+const MaxCollapseIDSize = 64
+
 // Ошибки, возвращаемые при конвертации уведомлений во внутреннее представление и при добавлении
 // уведомлений в очередь на отправку.
 var (
 	ErrPayloadEmpty        = errors.New("payload is empty")
 	ErrPayloadTooLarge     = errors.New("payload is too large")
 	ErrNotificationExpired = errors.New("notification expired")
+	ErrTokenSize           = errors.New("invalid device token size")
+	ErrTokenHex            = errors.New("device token is not a valid hex string")
+	ErrTokenSkipped        = errors.New("device token is blocked or belongs to another environment")
+	ErrExpirationInvalid   = errors.New("invalid expiration time")
+	ErrPriorityInvalid     = errors.New("priority must be 5 or 10")
+	ErrAlertRequired       = errors.New("alert is required")
+	ErrBackgroundPriority  = errors.New("background notification priority must be 5")
+	ErrBackgroundAlert     = errors.New("background notification cannot have alert, sound or badge")
+	ErrTargetContentID     = errors.New("invalid target-content-id")
+	ErrInterruptionLevel   = errors.New("invalid interruption level")
+	ErrRelevanceScore      = errors.New("relevance score must be between 0 and 1")
+	ErrLocArgs             = errors.New("loc-args must be an array of strings")
+	ErrMutableContent      = errors.New("mutable-content must be 1")
 )
 
 // Ошибка добавления уведомления на отправку для закрытого клиента.
 var ErrClientIsClosed = errors.New("client is closed")
 
+// Ошибка создания клиента, если MaxFrameBuffer меньше размера уведомления максимальной длины.
+var ErrFrameBufferTooSmall = errors.New("MaxFrameBuffer is too small for a notification")
+
+// Ошибка отправки уведомления, которое не помещается во фрейм размером MaxFrameBuffer. Возможна,
+// если размер фрейма или MaxPayloadSize были изменены после создания клиента.
+var ErrNotificationTooLarge = errors.New("notification does not fit into MaxFrameBuffer")
+
+// Ошибка отправки уведомления без указания токенов устройств.
+var ErrNoTokens = errors.New("no device tokens")
+
+// Ошибка чтения с feedback сервера большего количества ответов, чем задано в Config.MaxFeedback.
+var ErrFeedbackTruncated = errors.New("feedback truncated")
+
+// Ошибка добавления уведомления в очередь, заполненную до Client.MaxQueueSize.
+var ErrQueueFull = errors.New("queue is full")
+
+// Ошибка отправки через HTTP/2 уведомления со слишком длинным идентификатором группировки.
+var ErrCollapseIDTooLong = errors.New("collapse id is too long")
+
+// Ошибка разбора ключа для подписи токенов провайдера.
+var ErrTokenAuthKey = errors.New("invalid token auth key: PKCS #8 ECDSA key expected")
+
+// Ошибка разбора фрейма, записанного в соединение Capture.
+var ErrCaptureFrame = errors.New("capture: bad notification frame")
+
+// Ошибка загрузки сертификата: сертификат или ключ не удалось разобрать или они не соответствуют
+// друг другу.
+var ErrCertificateKey = errors.New("invalid certificate or private key")
+
+// Ошибки загрузки сертификата из файла .p12: неверный пароль или поврежденный файл.
+var (
+	ErrP12Password = errors.New("p12: incorrect password")
+	ErrP12Format   = errors.New("p12: malformed bundle")
+)
+
+// Ошибка создания клиента с сертификатом, выданным для другого окружения APNS (см.
+// Config.StrictEnvironment).
+var ErrEnvironmentMismatch = errors.New("certificate is issued for another APNS environment")
+
+// Ошибка получения идентификатора приложения из сертификата, который его не содержит.
+var ErrNoTopic = errors.New("certificate does not contain a topic")
+
+// Ошибки пула клиентов: конфигурация для приложения и окружения уже добавлена или не найдена.
+var (
+	ErrPoolDuplicate = errors.New("pool: client for this topic and environment is already added")
+	ErrPoolNoClient  = errors.New("pool: no client for this topic and environment")
+)
+
+// Ошибки уведомлений с идентификатором, заданным в Notification.ID: такой идентификатор уже
+// используется уведомлением в очереди или в кеше отправленных, или уведомление адресовано
+// нескольким токенам устройств.
+var (
+	ErrDuplicateID      = errors.New("notification id is already in use")
+	ErrIDMultipleTokens = errors.New("notification with id can be sent to a single device token")
+)
+
+// Ошибка адреса сервера, заданного в Config.Host не в формате "host:port".
+var ErrHostInvalid = errors.New("invalid APNS server address")
+
+// Ошибка замены конфигурации клиента на конфигурацию для другого сервера APNS (см. SetConfig).
+var ErrConfigServer = errors.New("config is for another APNS server")
+
 // Ошибка разбора конфигурации в пустой указатель.
 var ErrConfigNil = errors.New("Config: UnmarshalJSON on nil pointer")
@@ -1,7 +1,6 @@
 package apns
 
 import (
-	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -10,29 +9,76 @@ import (
 // errBadResponseSize ошибка
 var errBadResponseSize = errors.New("bad apple error size")
 
-// Ошибка, возвращаемая сервером APNS.
-type apnsError struct {
-	Type   uint8
-	Status uint8
-	ID     uint32
+// errBadResponseCommand ошибка ответа сервера, который не является ответом об ошибке.
+var errBadResponseCommand = errors.New("bad apple error command")
+
+// commandError описывает команду ответа сервера APNS об ошибке.
+const commandError uint8 = 8
+
+// APNsError описывает ошибку, которую вернул сервер APNS в ответ на отправленное уведомление.
+// Для проверки кода статуса ошибки можно использовать errors.Is с одной из переменных ErrStatus*:
+// при сравнении с ними идентификатор уведомления не учитывается.
+type APNsError struct {
+	Status         uint8  // код статуса ошибки
+	NotificationID uint32 // идентификатор уведомления, вызвавшего ошибку
 }
 
+// Коды статуса ошибок, возвращаемых сервером APNS.
+const (
+	StatusNoErrors           uint8 = 0
+	StatusProcessingError    uint8 = 1
+	StatusMissingDeviceToken uint8 = 2
+	StatusMissingTopic       uint8 = 3
+	StatusMissingPayload     uint8 = 4
+	StatusInvalidTokenSize   uint8 = 5
+	StatusInvalidTopicSize   uint8 = 6
+	StatusInvalidPayloadSize uint8 = 7
+	StatusInvalidToken       uint8 = 8
+	StatusShutdown           uint8 = 10
+	StatusUnknown            uint8 = 255
+)
+
+// Ошибки сервера APNS с соответствующими кодами статуса для сравнения с помощью errors.Is.
+var (
+	ErrStatusProcessingError    error = APNsError{Status: StatusProcessingError}
+	ErrStatusMissingDeviceToken error = APNsError{Status: StatusMissingDeviceToken}
+	ErrStatusMissingTopic       error = APNsError{Status: StatusMissingTopic}
+	ErrStatusMissingPayload     error = APNsError{Status: StatusMissingPayload}
+	ErrStatusInvalidTokenSize   error = APNsError{Status: StatusInvalidTokenSize}
+	ErrStatusInvalidTopicSize   error = APNsError{Status: StatusInvalidTopicSize}
+	ErrStatusInvalidPayloadSize error = APNsError{Status: StatusInvalidPayloadSize}
+	ErrStatusInvalidToken       error = APNsError{Status: StatusInvalidToken}
+	ErrStatusShutdown           error = APNsError{Status: StatusShutdown}
+	ErrStatusUnknown            error = APNsError{Status: StatusUnknown}
+)
+
 // Error возвращает строковое представление ошибки.
-func (e apnsError) Error() string {
-	if e.ID != 0 {
-		return fmt.Sprintf("APNS %s [message id %d]", apnsErrorMessages[e.Status], e.ID)
+func (e APNsError) Error() string {
+	if e.NotificationID != 0 {
+		return fmt.Sprintf("APNS %s [message id %d]", apnsErrorMessages[e.Status], e.NotificationID)
 	}
 	return fmt.Sprintf("APNS %s", apnsErrorMessages[e.Status])
 }
 
+// Is возвращает true, если target — ошибка сервера APNS с тем же кодом статуса и без
+// идентификатора уведомления или с тем же идентификатором.
+func (e APNsError) Is(target error) bool {
+	t, ok := target.(APNsError)
+	return ok && t.Status == e.Status && (t.NotificationID == 0 || t.NotificationID == e.NotificationID)
+}
+
 // parseAPNSError позволяет создать описание ошибки из набора байт, полученного от сервера Apple.
 func parseAPNSError(data []byte) error {
 	if len(data) != 6 {
 		return errBadResponseSize
 	}
-	var err apnsError
-	binary.Read(bytes.NewReader(data), binary.BigEndian, &err)
-	return err
+	if data[0] != commandError {
+		return errBadResponseCommand
+	}
+	return APNsError{
+		Status:         data[1],
+		NotificationID: binary.BigEndian.Uint32(data[2:]),
+	}
 }
 
 // apnsErrorMessages описывает известные мне на данный момент времени коды ошибок и их текстовое
@@ -0,0 +1,38 @@
+package apns
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestAPNsError(t *testing.T) {
+	var err = parseAPNSError([]byte{8, 8, 0, 0, 1, 2})
+	if err != (APNsError{Status: StatusInvalidToken, NotificationID: 258}) {
+		t.Fatalf("bad parsed error: %#v", err)
+	}
+	var wrapped = fmt.Errorf("send: %w", err)
+	if !errors.Is(wrapped, ErrStatusInvalidToken) {
+		t.Error("error does not match its status")
+	}
+	if errors.Is(wrapped, ErrStatusProcessingError) {
+		t.Error("error matches another status")
+	}
+	if !errors.Is(err, APNsError{Status: 8, NotificationID: 258}) ||
+		errors.Is(err, APNsError{Status: 8, NotificationID: 1}) {
+		t.Error("bad notification id matching")
+	}
+	var apnsErr APNsError
+	if !errors.As(wrapped, &apnsErr) || apnsErr.NotificationID != 258 {
+		t.Errorf("bad unwrapped error: %#v", apnsErr)
+	}
+	if err.Error() != "APNS Invalid Token [message id 258]" {
+		t.Errorf("bad error message: %s", err)
+	}
+	if parseAPNSError([]byte{8, 8}) != errBadResponseSize {
+		t.Error("short response parsed")
+	}
+	if parseAPNSError([]byte{2, 8, 0, 0, 1, 2}) != errBadResponseCommand {
+		t.Error("response with bad command parsed")
+	}
+}
@@ -1,55 +1,217 @@
 package apns
 
 import (
+	"context"
 	"encoding/binary"
 	"encoding/hex"
 	"io"
+	"net"
 	"time"
 )
 
 // Feedback осуществляет соединение с feedback сервером и возвращает список ответов от него.
-// После этого соединение автоматически закрывается.
+// После этого соединение автоматически закрывается. Если количество ответов превышает
+// config.MaxFeedback, то возвращаются только первые из них вместе с ошибкой ErrFeedbackTruncated.
 func Feedback(config *Config) ([]*FeedbackResponse, error) {
-	var addr string
+	return FeedbackContext(context.Background(), config)
+}
+
+// FeedbackContext работает аналогично Feedback, но ограничивает время чтения ответов переданным
+// контекстом: если feedback сервер не закрывает соединение, то чтение прекращается по истечении
+// или отмене контекста. В этом случае возвращаются все полностью прочитанные к этому моменту
+// ответы вместе с ошибкой контекста.
+func FeedbackContext(ctx context.Context, config *Config) ([]*FeedbackResponse, error) {
+	conn, err := config.Dial(config.feedbackAddr())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	config.logger().Println("Feedback connection")
+	config.logger().Print(newTLSState(conn, config))
+
+	return readFeedbackContext(ctx, conn, config.MaxFeedback)
+}
+
+// feedbackAddr возвращает адрес feedback сервера в зависимости от окружения.
+func (config *Config) feedbackAddr() string {
 	if config.Sandbox {
-		addr = ServerFeedbackSandbox
-	} else {
-		addr = ServerFeedback
+		return ServerFeedbackSandbox
 	}
-	conn, err := config.Dial(addr)
+	return ServerFeedback
+}
+
+// readFeedbackContext читает ответы feedback сервера из соединения аналогично readFeedback, пока
+// не истечет или не будет отменен контекст: время ожидания ответа для соединения устанавливается
+// по сроку действия контекста, а при его отмене соединение закрывается.
+func readFeedbackContext(ctx context.Context, conn net.Conn, limit int) ([]*FeedbackResponse, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetReadDeadline(deadline)
+	}
+	var done = make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close() // прерываем чтение при отмене контекста
+		case <-done:
+		}
+	}()
+	result, err := readFeedback(conn, limit)
 	if err != nil {
+		if err, ok := err.(net.Error); ok && err.Timeout() {
+			return result, context.DeadlineExceeded // время ожидания истекло вместе с контекстом
+		}
+		if ctx.Err() != nil {
+			return result, ctx.Err() // ошибка чтения вызвана закрытием соединения при отмене
+		}
+	}
+	return result, err
+}
+
+// readFeedback читает из потока ответы feedback сервера, пока поток не закончится. Каждый ответ
+// читается полностью, поэтому, если при чтении произошла ошибка, то вместе с ней возвращаются все
+// полностью прочитанные до этого ответы, но никогда не возвращается частично прочитанный ответ.
+// Обрыв потока посреди ответа считается ошибкой io.ErrUnexpectedEOF.
+//
+// Если limit больше нуля, то возвращается не больше limit ответов: если после них в потоке есть
+// еще ответы, то чтение прекращается и возвращается ошибка ErrFeedbackTruncated.
+func readFeedback(r io.Reader, limit int) ([]*FeedbackResponse, error) {
+	var result = make([]*FeedbackResponse, 0)
+	for {
+		response, err := readFeedbackResponse(r)
+		if err != nil {
+			if err == io.EOF {
+				err = nil // поток закончился между ответами
+			}
+			return result, err
+		}
+		if limit > 0 && len(result) == limit {
+			return result, ErrFeedbackTruncated // дальше не читаем
+		}
+		result = append(result, response)
+	}
+}
+
+// readFeedbackResponse читает из потока один ответ feedback сервера. Если поток закончился до
+// начала ответа, то возвращается io.EOF, а если посреди ответа — io.ErrUnexpectedEOF.
+func readFeedbackResponse(r io.Reader) (*FeedbackResponse, error) {
+	var header = make([]byte, 6)
+	if _, err := io.ReadFull(r, header); err != nil {
 		return nil, err
 	}
-	defer conn.Close()
-	config.log.Println("Feedback connection")
-	// config.log.Print(tlsConnectionStateString(conn))
+	var token = make([]byte, binary.BigEndian.Uint16(header[4:6]))
+	if _, err := io.ReadFull(r, token); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF // поток оборвался посреди ответа
+		}
+		return nil, err
+	}
+	var response = &FeedbackResponse{
+		Timestamp: binary.BigEndian.Uint32(header[0:4]),
+		Token:     token,
+	}
+	return response, nil
+}
 
+// FeedbackStream осуществляет соединение с feedback сервером и возвращает канал, в который
+// по мере чтения передаются ответы от него. Канал не буферизован: следующий ответ читается
+// с сервера только после того, как получатель забрал предыдущий, поэтому медленный получатель
+// не приводит к накоплению ответов в памяти.
+//
+// После окончания чтения канал ответов закрывается, а в канал ошибок передается результат
+// чтения: nil, если все ответы прочитаны, ошибка соединения или ошибка контекста, если он был
+// отменен. Ограничение config.MaxFeedback учитывается так же, как и в Feedback.
+func FeedbackStream(ctx context.Context, config *Config) (<-chan *FeedbackResponse, <-chan error) {
 	var (
-		result = make([]*FeedbackResponse, 0)
-		header = make([]byte, 6)
+		responses = make(chan *FeedbackResponse)
+		errs      = make(chan error, 1)
 	)
-	for {
-		if _, err = conn.Read(header); err != nil {
+	go func() {
+		defer close(responses)
+		conn, err := config.Dial(config.feedbackAddr())
+		if err != nil {
+			errs <- err
+			return
+		}
+		defer conn.Close()
+		config.logger().Println("Feedback stream connection")
+		config.logger().Print(newTLSState(conn, config))
+		var done = make(chan struct{})
+		defer close(done)
+		go func() {
+			select {
+			case <-ctx.Done():
+				conn.Close() // прерываем чтение при отмене контекста
+			case <-done:
+			}
+		}()
+		errs <- streamFeedback(ctx, conn, config.MaxFeedback, responses)
+	}()
+	return responses, errs
+}
+
+// streamFeedback читает из потока ответы feedback сервера и передает их в канал, пока поток не
+// закончится или не будет отменен контекст. Следующий ответ читается только после того, как
+// предыдущий был передан в канал. Ограничение limit учитывается так же, как в readFeedback.
+func streamFeedback(ctx context.Context, r io.Reader, limit int, out chan<- *FeedbackResponse) error {
+	for count := 0; ; count++ {
+		response, err := readFeedbackResponse(r)
+		if ctx.Err() != nil {
+			return ctx.Err() // ошибка чтения вызвана закрытием соединения при отмене
+		}
+		if err != nil {
 			if err == io.EOF {
-				err = nil
+				err = nil // поток закончился между ответами
 			}
-			return result, err
+			return err
+		}
+		if limit > 0 && count == limit {
+			return ErrFeedbackTruncated // дальше не читаем
 		}
-		var (
-			tokenSize   = int(binary.BigEndian.Uint16(header[4:6]))
-			tokenBuffer = make([]byte, tokenSize)
-		)
-		if _, err = conn.Read(tokenBuffer); err != nil {
+		select {
+		case out <- response:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// FeedbackHandler осуществляет соединение с feedback сервером и по мере чтения вызывает fn для
+// каждого ответа, передавая ей токен устройства в шестнадцатеричном виде и время, начиная с
+// которого уведомления для него не доставляются (FeedbackResponse.Time). Это позволяет удалять
+// недействительные токены из хранилища сразу во время чтения ответов. Если fn возвращает ошибку,
+// то чтение прекращается и возвращается эта ошибка. Ограничение config.MaxFeedback учитывается
+// так же, как и в Feedback.
+func FeedbackHandler(config *Config, fn func(token string, since time.Time) error) error {
+	conn, err := config.Dial(config.feedbackAddr())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	config.logger().Println("Feedback handler connection")
+	config.logger().Print(newTLSState(conn, config))
+
+	return handleFeedback(conn, config.MaxFeedback, fn)
+}
+
+// handleFeedback читает из потока ответы feedback сервера и вызывает для каждого из них fn, пока
+// поток не закончится или fn не вернет ошибку. Ограничение limit учитывается так же, как в
+// readFeedback.
+func handleFeedback(r io.Reader, limit int, fn func(token string, since time.Time) error) error {
+	for count := 0; ; count++ {
+		response, err := readFeedbackResponse(r)
+		if err != nil {
 			if err == io.EOF {
-				err = nil
+				err = nil // поток закончился между ответами
 			}
-			return result, err
+			return err
 		}
-		var response = &FeedbackResponse{
-			Timestamp: binary.BigEndian.Uint32(header[0:4]),
-			Token:     tokenBuffer,
+		if limit > 0 && count == limit {
+			return ErrFeedbackTruncated // дальше не читаем
+		}
+		if err := fn(response.String(), response.Time()); err != nil {
+			return err
 		}
-		result = append(result, response)
 	}
 }
 
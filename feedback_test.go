@@ -0,0 +1,229 @@
+package apns
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// feedbackData возвращает бинарное представление ответов feedback сервера для указанных токенов.
+func feedbackData(tokens ...[]byte) []byte {
+	var buf bytes.Buffer
+	for i, token := range tokens {
+		binary.Write(&buf, binary.BigEndian, uint32(1400000000+i))
+		binary.Write(&buf, binary.BigEndian, uint16(len(token)))
+		buf.Write(token)
+	}
+	return buf.Bytes()
+}
+
+var errInterrupted = errors.New("interrupted")
+
+func TestReadFeedbackInterrupted(t *testing.T) {
+	var data = feedbackData(bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 32),
+		bytes.Repeat([]byte{3}, 32))
+	for _, test := range []struct {
+		r     io.Reader
+		count int
+		err   error
+	}{
+		{bytes.NewReader(data), 3, nil},
+		{bytes.NewReader(data[:76]), 2, nil},
+		{bytes.NewReader(data[:80]), 2, io.ErrUnexpectedEOF},
+		{bytes.NewReader(data[:100]), 2, io.ErrUnexpectedEOF},
+		{io.MultiReader(bytes.NewReader(data[:100]), errReader{errInterrupted}), 2, errInterrupted},
+		// ответы, пришедшие частями, читаются полностью
+		{iotest.OneByteReader(bytes.NewReader(data)), 3, nil},
+		{iotest.OneByteReader(bytes.NewReader(data[:80])), 2, io.ErrUnexpectedEOF},
+	} {
+		result, err := readFeedback(test.r, 0)
+		if err != test.err || len(result) != test.count {
+			t.Errorf("got %d responses (%v), expected %d (%v)", len(result), err, test.count, test.err)
+		}
+		for i, response := range result {
+			if len(response.Token) != 32 || response.Token[31] != byte(i+1) ||
+				response.Timestamp != uint32(1400000000+i) {
+				t.Errorf("bad response %d: %v", i, response)
+			}
+		}
+	}
+}
+
+// errReader описывает поток, чтение из которого всегда возвращает ошибку.
+type errReader struct{ err error }
+
+func (r errReader) Read([]byte) (int, error) { return 0, r.err }
+
+func TestReadFeedbackLimit(t *testing.T) {
+	var data = feedbackData(bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 32),
+		bytes.Repeat([]byte{3}, 32))
+	for _, test := range []struct {
+		limit int
+		count int
+		err   error
+	}{
+		{0, 3, nil},
+		{2, 2, ErrFeedbackTruncated},
+		{3, 3, nil},
+		{4, 3, nil},
+	} {
+		result, err := readFeedback(bytes.NewReader(data), test.limit)
+		if err != test.err || len(result) != test.count {
+			t.Errorf("limit %d: got %d responses (%v), expected %d (%v)",
+				test.limit, len(result), err, test.count, test.err)
+		}
+	}
+}
+
+// countingReader описывает поток, подсчитывающий количество прочитанных из него байт.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	atomic.AddInt64(&r.n, int64(n))
+	return n, err
+}
+
+func TestStreamFeedbackBackpressure(t *testing.T) {
+	var tokens = make([][]byte, 10)
+	for i := range tokens {
+		tokens[i] = bytes.Repeat([]byte{byte(i + 1)}, 32)
+	}
+	var (
+		r           = &countingReader{r: bytes.NewReader(feedbackData(tokens...))}
+		responses   = make(chan *FeedbackResponse)
+		errs        = make(chan error, 1)
+		ctx, cancel = context.WithCancel(context.Background())
+	)
+	defer cancel()
+	go func() {
+		errs <- streamFeedback(ctx, r, 0, responses)
+		close(responses)
+	}()
+	if response := <-responses; response.Token[0] != 1 {
+		t.Errorf("bad first response: %v", response)
+	}
+	time.Sleep(50 * time.Millisecond) // медленный получатель
+	// прочитан только отданный ответ и следующий, ожидающий передачи
+	if n := atomic.LoadInt64(&r.n); n > 2*(6+32) {
+		t.Errorf("read %d bytes while consumer is waiting", n)
+	}
+	if response := <-responses; response.Token[0] != 2 {
+		t.Errorf("bad second response: %v", response)
+	}
+	cancel()
+	for range responses {
+	}
+	if err := <-errs; err != context.Canceled {
+		t.Errorf("stream error %v, expected %v", err, context.Canceled)
+	}
+}
+
+func TestStreamFeedbackLimit(t *testing.T) {
+	var data = feedbackData(bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 32),
+		bytes.Repeat([]byte{3}, 32))
+	for _, test := range []struct {
+		limit int
+		count int
+		err   error
+	}{
+		{0, 3, nil},
+		{2, 2, ErrFeedbackTruncated},
+		{3, 3, nil},
+	} {
+		var (
+			responses = make(chan *FeedbackResponse)
+			errs      = make(chan error, 1)
+			count     int
+		)
+		go func() {
+			errs <- streamFeedback(context.Background(), bytes.NewReader(data), test.limit, responses)
+			close(responses)
+		}()
+		for range responses {
+			count++
+		}
+		if err := <-errs; err != test.err || count != test.count {
+			t.Errorf("limit %d: got %d responses (%v), expected %d (%v)",
+				test.limit, count, err, test.count, test.err)
+		}
+	}
+}
+
+func TestReadFeedbackContext(t *testing.T) {
+	var data = feedbackData(bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 32))
+	for _, test := range []struct {
+		timeout bool // ограничение по времени или отмена контекста
+		err     error
+	}{
+		{true, context.DeadlineExceeded},
+		{false, context.Canceled},
+	} {
+		client, server := net.Pipe()
+		// сервер отдает первый ответ и часть второго, после чего зависает
+		go server.Write(data[:50])
+		var (
+			ctx    context.Context
+			cancel context.CancelFunc
+		)
+		if test.timeout {
+			ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+		} else {
+			ctx, cancel = context.WithCancel(context.Background())
+			time.AfterFunc(50*time.Millisecond, cancel)
+		}
+		result, err := readFeedbackContext(ctx, client, 0)
+		cancel()
+		if err != test.err || len(result) != 1 || result[0].Token[0] != 1 {
+			t.Errorf("got %d responses (%v), expected 1 (%v)", len(result), err, test.err)
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestHandleFeedback(t *testing.T) {
+	var tokens = [][]byte{bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 32),
+		bytes.Repeat([]byte{3}, 32)}
+	var (
+		handled []string
+		errStop = errors.New("stop")
+	)
+	var handler = func(token string, since time.Time) error {
+		if since.Unix() != int64(1400000000+len(handled)) {
+			t.Errorf("bad time %v for token %s", since, token)
+		}
+		handled = append(handled, token)
+		if token == hex.EncodeToString(tokens[1]) {
+			return errStop
+		}
+		return nil
+	}
+	// обработка прекращается на первой ошибке обработчика
+	if err := handleFeedback(bytes.NewReader(feedbackData(tokens...)), 0, handler); err != errStop {
+		t.Errorf("handler error %v, expected %v", err, errStop)
+	}
+	if len(handled) != 2 || handled[0] != hex.EncodeToString(tokens[0]) {
+		t.Errorf("handled %v", handled)
+	}
+	handled = nil
+	if err := handleFeedback(bytes.NewReader(feedbackData(tokens[0])), 0, handler); err != nil {
+		t.Errorf("handle error %v", err)
+	}
+	handled = nil
+	if err := handleFeedback(bytes.NewReader(feedbackData(tokens[0], tokens[0])), 1,
+		handler); err != ErrFeedbackTruncated || len(handled) != 1 {
+		t.Errorf("limit error %v, %d handled", err, len(handled))
+	}
+}
@@ -0,0 +1,195 @@
+package apns
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// HTTP2Client описывает клиента для отправки уведомлений через HTTP/2 API APNS, которое пришло на
+// смену бинарному протоколу. Для авторизации используется сертификат из Config. Все уведомления
+// отправляются через одно соединение с сервером, которое устанавливается при первой отправке и
+// повторно используется для следующих: HTTP/2 позволяет отправлять через него одновременно много
+// запросов, поэтому клиент можно использовать из разных потоков.
+//
+// В отличие от Client, уведомления не помещаются в очередь: каждое уведомление отправляется
+// отдельным запросом, а результат его обработки сервером возвращается сразу.
+type HTTP2Client struct {
+	config    *Config
+	host      string          // адрес сервера в формате "host:port"
+	topic     string          // идентификатор приложения из сертификата (см. Config.Topic)
+	transport *http.Transport // транспорт с поддержкой HTTP/2, хранящий соединение с сервером
+	client    *http.Client
+
+	// TokenAuth задает авторизацию с помощью токенов провайдера вместо сертификата. Если она
+	// задана, то токен передается в заголовке authorization каждого запроса. Идентификатор
+	// приложения при этом должен указываться в Notification.Topic или Config.BundleID.
+	TokenAuth *TokenAuth
+}
+
+// NewHTTP2Client возвращает клиента для отправки уведомлений через HTTP/2 API APNS. Адрес сервера
+// выбирается так же, как для Client: Config.Host, если он задан, или адрес рабочего или отладочного
+// сервера в зависимости от Config.Sandbox. Соединение с сервером при этом не устанавливается.
+//
+// Заголовок apns-topic берется из Notification.Topic, а если он не указан, то из Config.BundleID
+// или, если не задан и он, из сертификата (см. Config.Topic).
+func NewHTTP2Client(config *Config) *HTTP2Client {
+	var host string
+	switch {
+	case config.Host != "":
+		host = config.Host
+	case config.Sandbox:
+		host = ServerHTTP2Sandbox
+	default:
+		host = ServerHTTP2
+	}
+	var serverName = config.ServerName
+	if serverName == "" {
+		serverName, _, _ = net.SplitHostPort(host)
+	}
+	var transport = &http.Transport{
+		TLSClientConfig:     config.tlsConfig(serverName),
+		ForceAttemptHTTP2:   true, // при собственной конфигурации TLS HTTP/2 нужно включать явно
+		TLSHandshakeTimeout: TimeoutConnect,
+		IdleConnTimeout:     TiemoutRead,
+	}
+	var topic, _ = config.Topic()
+	return &HTTP2Client{
+		config:    config,
+		host:      host,
+		topic:     topic,
+		transport: transport,
+		client:    &http.Client{Transport: transport},
+	}
+}
+
+// HTTP2Error описывает ошибку, которую вернул сервер в ответ на уведомление, отправленное через
+// HTTP/2 API.
+type HTTP2Error struct {
+	StatusCode int       // HTTP-статус ответа
+	Reason     string    // причина ошибки, например, "BadDeviceToken"
+	Timestamp  time.Time // время, с которого токен устройства недействителен (для статуса 410)
+	ID         string    // идентификатор уведомления, возвращенный сервером (apns-id)
+	Token      []byte    // токен устройства, для которого отправлялось уведомление
+}
+
+// ReasonUnregistered описывает причину ошибки HTTP/2 API, означающую, что токен устройства больше
+// не действителен: приложение удалено с устройства или отключило уведомления.
+const ReasonUnregistered = "Unregistered"
+
+// Error возвращает строковое представление ошибки.
+func (e *HTTP2Error) Error() string {
+	return fmt.Sprintf("APNS HTTP/2 error %d: %s", e.StatusCode, e.Reason)
+}
+
+// Unregistered возвращает true, если ошибка означает, что токен устройства больше не действителен
+// и уведомления для него отправлять не нужно.
+func (e *HTTP2Error) Unregistered() bool {
+	return e.StatusCode == http.StatusGone || e.Reason == ReasonUnregistered
+}
+
+// Feedback возвращает описание недействительного токена устройства в том же виде, в котором его
+// возвращает feedback сервер: HTTP/2 API сообщает о таких токенах прямо в ответ на уведомление,
+// поэтому их можно обрабатывать тем же кодом, что и ответы Feedback. Если ошибка не означает
+// недействительность токена (см. Unregistered), то возвращается nil.
+func (e *HTTP2Error) Feedback() *FeedbackResponse {
+	if !e.Unregistered() {
+		return nil
+	}
+	var timestamp = e.Timestamp
+	if timestamp.IsZero() {
+		timestamp = time.Now() // сервер не сообщил время: токен недействителен по крайней мере сейчас
+	}
+	return &FeedbackResponse{Timestamp: uint32(timestamp.Unix()), Token: e.Token}
+}
+
+// Push отправляет уведомление на устройство с указанным токеном и возвращает идентификатор,
+// присвоенный уведомлению сервером (apns-id). Если сервер отклонил уведомление, то возвращается
+// ошибка HTTP2Error с описанием причины; для недействительного токена (см. HTTP2Error.Unregistered)
+// она содержит и время, с которого токен недействителен.
+func (client *HTTP2Client) Push(ntf *Notification, token string) (string, error) {
+	return client.PushContext(context.Background(), ntf, token)
+}
+
+// PushContext работает аналогично Push, но прерывает отправку при отмене переданного контекста.
+func (client *HTTP2Client) PushContext(ctx context.Context, ntf *Notification, token string) (string, error) {
+	btoken, err := parseToken(token)
+	if err != nil {
+		return "", err
+	}
+	if len(ntf.CollapseID) > MaxCollapseIDSize {
+		return "", ErrCollapseIDTooLong
+	}
+	template, err := ntf.convert() // проверяем и сериализуем уведомление так же, как для Client
+	if err != nil {
+		return "", err
+	}
+	var url = "https://" + client.host + "/3/device/" + hex.EncodeToString(btoken)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url,
+		bytes.NewReader(template.Payload))
+	if err != nil {
+		return "", err
+	}
+	var topic = ntf.Topic
+	if topic == "" {
+		topic = client.config.BundleID
+	}
+	if topic == "" {
+		topic = client.topic
+	}
+	if topic != "" {
+		req.Header.Set("apns-topic", topic)
+	}
+	if template.hasExpiration() {
+		req.Header.Set("apns-expiration", strconv.FormatUint(uint64(template.Expiration), 10))
+	}
+	req.Header.Set("apns-priority", strconv.Itoa(int(template.Priority)))
+	if ntf.PushType != "" {
+		req.Header.Set("apns-push-type", string(ntf.PushType))
+	}
+	if ntf.CollapseID != "" {
+		req.Header.Set("apns-collapse-id", ntf.CollapseID)
+	}
+	if client.TokenAuth != nil {
+		token, err := client.TokenAuth.Token()
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("authorization", "bearer "+token)
+	}
+	resp, err := client.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var id = resp.Header.Get("apns-id")
+	if resp.StatusCode == http.StatusOK {
+		return id, nil
+	}
+	var response struct {
+		Reason    string `json:"reason"`
+		Timestamp int64  `json:"timestamp"` // время в миллисекундах
+	}
+	json.NewDecoder(resp.Body).Decode(&response) // причина ошибки может быть не указана
+	var apiErr = &HTTP2Error{
+		StatusCode: resp.StatusCode,
+		Reason:     response.Reason,
+		ID:         id,
+		Token:      btoken,
+	}
+	if response.Timestamp > 0 {
+		apiErr.Timestamp = time.Unix(0, response.Timestamp*int64(time.Millisecond))
+	}
+	return id, apiErr
+}
+
+// Close закрывает неиспользуемое соединение с сервером. Следующая отправка установит его заново.
+func (client *HTTP2Client) Close() {
+	client.transport.CloseIdleConnections()
+}
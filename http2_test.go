@@ -0,0 +1,260 @@
+package apns
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newHTTP2TestServer возвращает тестовый HTTP/2 сервер и клиента, отправляющего ему уведомления.
+// Количество соединений, установленных с сервером, учитывается в conns.
+func newHTTP2TestServer(handler http.HandlerFunc, conns *int64) (*HTTP2Client, *httptest.Server) {
+	var server = httptest.NewUnstartedServer(handler)
+	server.EnableHTTP2 = true
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt64(conns, 1)
+		}
+	}
+	server.StartTLS()
+	var client = NewHTTP2Client(&Config{
+		BundleID:           "com.example.app",
+		Host:               server.Listener.Addr().String(),
+		InsecureSkipVerify: true, // самоподписанный сертификат тестового сервера
+	})
+	return client, server
+}
+
+func TestHTTP2ClientPush(t *testing.T) {
+	const apnsID = "EC1BF194-B3B2-424A-89A9-5A918A6E6B5D"
+	var (
+		token      = testTokens(1)[0]
+		expiration = time.Now().Add(time.Hour)
+		conns      int64
+	)
+	client, server := newHTTP2TestServer(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			t.Errorf("protocol %s, expected HTTP/2", r.Proto)
+		}
+		if r.Method != http.MethodPost || r.URL.Path != "/3/device/"+token {
+			t.Errorf("bad request %s %s", r.Method, r.URL.Path)
+		}
+		for header, expected := range map[string]string{
+			"apns-topic":      "com.example.app",
+			"apns-expiration": strconv.FormatInt(expiration.Unix(), 10),
+			"apns-priority":   "10",
+			"apns-push-type":  "alert",
+		} {
+			if value := r.Header.Get(header); value != expected {
+				t.Errorf("header %s: %q, expected %q", header, value, expected)
+			}
+		}
+		if body, _ := ioutil.ReadAll(r.Body); string(body) != `{"aps":{"alert":"test"}}` {
+			t.Errorf("bad body %s", body)
+		}
+		w.Header().Set("apns-id", apnsID)
+	}, &conns)
+	defer server.Close()
+	defer client.Close()
+
+	var ntf = &Notification{
+		Payload:    NewPayload().Alert("test"),
+		Expiration: expiration,
+		PushType:   PushTypeAlert,
+	}
+	for i := 0; i < 3; i++ {
+		id, err := client.Push(ntf, token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != apnsID {
+			t.Errorf("bad apns-id %q", id)
+		}
+	}
+	if n := atomic.LoadInt64(&conns); n != 1 {
+		t.Errorf("%d connections used, expected 1", n)
+	}
+	if _, err := client.Push(ntf, "bad"); err != ErrTokenHex {
+		t.Errorf("bad token error %v", err)
+	}
+}
+
+func TestHTTP2ClientError(t *testing.T) {
+	var conns int64
+	client, server := newHTTP2TestServer(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("apns-id", "42")
+		w.WriteHeader(http.StatusGone)
+		w.Write([]byte(`{"reason":"Unregistered","timestamp":1458114061260}`))
+	}, &conns)
+	defer server.Close()
+	defer client.Close()
+
+	id, err := client.Push(&Notification{Payload: NewPayload().Alert("test")}, testTokens(1)[0])
+	var apiErr *HTTP2Error
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("error %v, expected HTTP2Error", err)
+	}
+	if id != "42" || apiErr.StatusCode != http.StatusGone || apiErr.Reason != "Unregistered" ||
+		!apiErr.Timestamp.Equal(time.Unix(1458114061, 260*int64(time.Millisecond))) {
+		t.Errorf("bad response %q: %#v", id, apiErr)
+	}
+	if !apiErr.Unregistered() || apiErr.ID != "42" {
+		t.Errorf("bad unregistered error %#v", apiErr)
+	}
+	if feedback := apiErr.Feedback(); feedback == nil || feedback.String() != testTokens(1)[0] ||
+		feedback.Timestamp != 1458114061 {
+		t.Errorf("bad feedback %v", feedback)
+	}
+	var bad = &HTTP2Error{StatusCode: http.StatusBadRequest, Reason: "BadDeviceToken"}
+	if bad.Unregistered() || bad.Feedback() != nil {
+		t.Error("bad device token is reported as unregistered")
+	}
+}
+
+func TestNotificationCollapseID(t *testing.T) {
+	var conns int64
+	client, server := newHTTP2TestServer(func(w http.ResponseWriter, r *http.Request) {
+		if value := r.Header.Get("apns-collapse-id"); value != "score" {
+			t.Errorf("bad apns-collapse-id %q", value)
+		}
+	}, &conns)
+	defer server.Close()
+	defer client.Close()
+
+	var ntf = &Notification{Payload: NewPayload().Alert("1:0"), CollapseID: "score"}
+	if _, err := client.Push(ntf, testTokens(1)[0]); err != nil {
+		t.Fatal(err)
+	}
+	ntf.CollapseID = strings.Repeat("x", MaxCollapseIDSize+1)
+	if _, err := client.Push(ntf, testTokens(1)[0]); err != ErrCollapseIDTooLong {
+		t.Errorf("long collapse id error %v", err)
+	}
+
+	// бинарный протокол идентификатор игнорирует, но предупреждает об этом
+	var (
+		logger = new(testLogger)
+		config = new(Config)
+	)
+	legacy := newOfflineClient(t, config)
+	config.SetLogger(logger) // newOfflineClient устанавливает свою систему вывода логов
+	defer legacy.Close(false)
+	for i := 0; i < 2; i++ { // предупреждение выводится один раз для клиента
+		if err := legacy.Send(ntf, testTokens(1)...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// и при отправке остальными способами
+	compiled, err := PrecompileNotification(ntf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, send := range []func(client *Client) error{
+		func(client *Client) error { return client.SendCompiled(compiled, testTokens(1)...) },
+		func(client *Client) error {
+			return client.SendBatch([]BatchItem{{ntf, tokenStrings[0]}})[0].Err
+		},
+		func(client *Client) error {
+			_, _, err := client.SendFromReader(ntf, strings.NewReader(tokenStrings[0]))
+			return err
+		},
+	} {
+		client := newOfflineClient(t, config)
+		config.SetLogger(logger)
+		if err := send(client); err != nil {
+			t.Fatal(err)
+		}
+		client.Close(false)
+	}
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	if len(logger.lines) != 4 {
+		t.Fatalf("unexpected log: %q", logger.lines)
+	}
+	for _, line := range logger.lines {
+		if !strings.Contains(line, "Collapse id") {
+			t.Errorf("unexpected log: %q", line)
+		}
+	}
+}
+
+func TestNotificationBothProtocols(t *testing.T) {
+	var (
+		token = testTokens(1)[0]
+		ntf   = &Notification{
+			Payload:    NewPayload().Alert("test").Sound(DefaultSound),
+			Expiration: time.Now().Add(time.Hour).Truncate(time.Second),
+			Priority:   5,
+		}
+		expected = `{"aps":{"alert":"test","sound":"default"}}`
+		requests = make(chan *http.Request, 1)
+		bodies   = make(chan string, 1)
+		conns    int64
+	)
+	// HTTP/2
+	http2Client, server := newHTTP2TestServer(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests <- r
+		bodies <- string(body)
+	}, &conns)
+	defer server.Close()
+	defer http2Client.Close()
+	if _, err := http2Client.Push(ntf, token); err != nil {
+		t.Fatal(err)
+	}
+	var r = <-requests
+	if r.URL.Path != "/3/device/"+token {
+		t.Errorf("bad HTTP/2 token path %s", r.URL.Path)
+	}
+	for header, value := range map[string]string{
+		"apns-expiration": strconv.FormatInt(ntf.Expiration.Unix(), 10),
+		"apns-priority":   "5",
+	} {
+		if r.Header.Get(header) != value {
+			t.Errorf("header %s: %q, expected %q", header, r.Header.Get(header), value)
+		}
+	}
+	if body := <-bodies; body != expected {
+		t.Errorf("bad HTTP/2 body %s", body)
+	}
+
+	// бинарный протокол
+	client, fakeConns := newFakeClient(t)
+	defer client.Close(false)
+	if err := client.Send(ntf, token); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.DrainOnce(); err != nil {
+		t.Fatal(err)
+	}
+	var conn = nextFakeConn(t, client, fakeConns)
+	conn.mu.Lock()
+	frame, err := readFrame(bytes.NewReader(conn.written.Bytes()))
+	conn.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var item = decodeFrameItems(frame[5:])
+	if item == nil {
+		t.Fatalf("bad frame:\n% x", frame)
+	}
+	if item.TokenString() != token {
+		t.Errorf("bad frame token %s", item.TokenString())
+	}
+	if string(item.Payload) != expected {
+		t.Errorf("bad frame payload %s", item.Payload)
+	}
+	if item.Expiration != uint32(ntf.Expiration.Unix()) {
+		t.Errorf("bad frame expiration %d", item.Expiration)
+	}
+	if item.Priority != 5 {
+		t.Errorf("bad frame priority %d", item.Priority)
+	}
+}
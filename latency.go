@@ -0,0 +1,64 @@
+package apns
+
+import (
+	"sync"
+	"time"
+)
+
+// latencyBuckets описывает количество интервалов гистограммы задержек. Верхняя граница каждого
+// следующего интервала в два раза больше предыдущего, начиная с одной миллисекунды, а последний
+// интервал включает в себя все задержки, превышающие верхнюю границу предпоследнего.
+const latencyBuckets = 24
+
+// LatencyHistogram накапливает статистику задержек отправки уведомлений на сервер: от момента
+// получения из очереди первого уведомления фрейма до успешного окончания отправки этого фрейма.
+// Для экономии памяти хранится только количество задержек в каждом интервале, поэтому процентили
+// вычисляются с точностью до границы интервала. Нулевое значение готово к использованию.
+type LatencyHistogram struct {
+	buckets [latencyBuckets]uint64 // количество задержек в интервалах
+	count   uint64                 // общее количество задержек
+	mu      sync.Mutex
+}
+
+// Record добавляет задержку в статистику.
+func (h *LatencyHistogram) Record(d time.Duration) {
+	var i int
+	for bound := time.Millisecond; d > bound && i < latencyBuckets-1; bound *= 2 {
+		i++
+	}
+	h.mu.Lock()
+	h.buckets[i]++
+	h.count++
+	h.mu.Unlock()
+}
+
+// Count возвращает количество учтенных задержек.
+func (h *LatencyHistogram) Count() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.count
+}
+
+// Percentile возвращает верхнюю границу интервала, в который попадает указанная доля (от 0 до 1)
+// всех учтенных задержек. Например, Percentile(0.99) возвращает задержку, которую не превышают
+// 99% отправок. Если задержки еще не учитывались, то возвращается 0.
+func (h *LatencyHistogram) Percentile(p float64) time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.count == 0 {
+		return 0
+	}
+	var (
+		rank  = uint64(p*float64(h.count) + 0.5)
+		total uint64
+		bound = time.Millisecond
+	)
+	for i := 0; i < latencyBuckets-1; i++ {
+		total += h.buckets[i]
+		if total >= rank {
+			break
+		}
+		bound *= 2
+	}
+	return bound
+}
@@ -0,0 +1,34 @@
+package apns
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLatencyHistogram(t *testing.T) {
+	var h LatencyHistogram
+	if h.Percentile(0.5) != 0 {
+		t.Error("empty histogram percentile")
+	}
+	for i := 0; i < 90; i++ {
+		h.Record(500 * time.Microsecond)
+	}
+	for i := 0; i < 9; i++ {
+		h.Record(30 * time.Millisecond)
+	}
+	h.Record(time.Hour)
+	if h.Count() != 100 {
+		t.Errorf("count %d", h.Count())
+	}
+	for p, expected := range map[float64]time.Duration{
+		0.5:  time.Millisecond,
+		0.9:  time.Millisecond,
+		0.95: 32 * time.Millisecond,
+		0.99: 32 * time.Millisecond,
+		1:    time.Millisecond << (latencyBuckets - 2),
+	} {
+		if d := h.Percentile(p); d != expected {
+			t.Errorf("percentile %v: %v, expected %v", p, d, expected)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package apns
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// errorCounter подсчитывает количество ошибок, полученных от сервера, для каждого кода статуса.
+type errorCounter struct {
+	counts map[uint8]uint64 // количество ошибок по статусам
+	mu     sync.Mutex
+}
+
+// Add увеличивает счетчик ошибок с указанным статусом.
+func (c *errorCounter) Add(status uint8) {
+	c.mu.Lock()
+	if c.counts == nil {
+		c.counts = make(map[uint8]uint64)
+	}
+	c.counts[status]++
+	c.mu.Unlock()
+}
+
+// Snapshot возвращает копию текущих значений счетчиков.
+func (c *errorCounter) Snapshot() map[uint8]uint64 {
+	c.mu.Lock()
+	var result = make(map[uint8]uint64, len(c.counts))
+	for status, count := range c.counts {
+		result[status] = count
+	}
+	c.mu.Unlock()
+	return result
+}
+
+// BlockedCount возвращает количество уведомлений, не добавленных в очередь из-за того, что токен
+// устройства находится в Blocklist.
+func (client *Client) BlockedCount() uint64 {
+	return atomic.LoadUint64(&client.blocked)
+}
+
+// MismatchedCount возвращает количество уведомлений, не добавленных в очередь из-за того, что токен
+// устройства предназначен для другого окружения APNS (см. TokenEnvironment).
+func (client *Client) MismatchedCount() uint64 {
+	return atomic.LoadUint64(&client.mismatched)
+}
+
+// SentCount возвращает количество уведомлений, успешно отправленных на сервер, включая повторные
+// отправки.
+func (client *Client) SentCount() uint64 {
+	return atomic.LoadUint64(&client.sent)
+}
+
+// ErrorCount возвращает общее количество уведомлений, отклоненных сервером. Количество ошибок по
+// отдельным кодам статуса возвращает ErrorCounts.
+func (client *Client) ErrorCount() uint64 {
+	return atomic.LoadUint64(&client.failed)
+}
+
+// RequeuedCount возвращает количество уведомлений, возвращенных в очередь для повторной отправки
+// из-за ошибки соединения или ошибки, полученной от сервера для предшествующего уведомления.
+func (client *Client) RequeuedCount() uint64 {
+	return atomic.LoadUint64(&client.requeued)
+}
+
+// ReconnectCount возвращает количество повторных соединений с сервером после закрытия или разрыва
+// предыдущего соединения.
+func (client *Client) ReconnectCount() uint64 {
+	return atomic.LoadUint64(&client.reconnects)
+}
+
+// Pending возвращает количество уведомлений, помещенных в очередь, но еще не отправленных на сервер.
+// Рост этого значения говорит о том, что отправка не успевает за добавлением уведомлений: например,
+// из-за медленного соединения или постоянных переподключений. Вызов не блокирует отправку и может
+// выполняться часто.
+func (client *Client) Pending() int {
+	return client.queue.PendingCount()
+}
+
+// Stats описывает снимок счетчиков и текущего состояния клиента. Он возвращается одним вызовом
+// Stats и удобен для передачи в системы мониторинга: например, коллектор для Prometheus из пакета
+// github.com/mdigger/apns/prom строится на его основе.
+type Stats struct {
+	Sent           uint64           // отправлено уведомлений (SentCount)
+	Errors         uint64           // отклонено сервером (ErrorCount)
+	ErrorsByStatus map[uint8]uint64 // отклонено сервером по кодам статуса (ErrorCounts)
+	Requeued       uint64           // возвращено в очередь для повторной отправки (RequeuedCount)
+	Reconnects     uint64           // повторных соединений с сервером (ReconnectCount)
+	Blocked        uint64           // пропущено из-за Blocklist (BlockedCount)
+	Mismatched     uint64           // пропущено из-за другого окружения (MismatchedCount)
+	ResultsDropped uint64           // результатов, не попавших в канал Results (ResultsDropped)
+	Pending        int              // уведомлений в очереди на отправку (Pending)
+	Scheduled      int              // отложенных уведомлений (Scheduled)
+	Connected      bool             // флаг установленного соединения с сервером
+}
+
+// Stats возвращает текущие значения всех счетчиков клиента. Значения читаются независимо друг от
+// друга, поэтому при одновременной отправке они могут немного не соответствовать друг другу.
+func (client *Client) Stats() Stats {
+	return Stats{
+		Sent:           client.SentCount(),
+		Errors:         client.ErrorCount(),
+		ErrorsByStatus: client.ErrorCounts(),
+		Requeued:       client.RequeuedCount(),
+		Reconnects:     client.ReconnectCount(),
+		Blocked:        client.BlockedCount(),
+		Mismatched:     client.MismatchedCount(),
+		ResultsDropped: client.ResultsDropped(),
+		Pending:        client.Pending(),
+		Scheduled:      client.Scheduled(),
+		Connected:      client.conn.isConnected(),
+	}
+}
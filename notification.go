@@ -1,27 +1,198 @@
 package apns
 
 import (
+	"bytes"
 	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
+	"math"
+	"strings"
 	"time"
 )
 
 // Notification описывает формат уведомления.
+//
+// Одно и то же уведомление может отправляться как через бинарный протокол, так и через HTTP/2.
+// Содержимое, время жизни и приоритет используются обоими способами отправки, а идентификатор
+// приложения, идентификатор группировки и тип уведомления поддерживаются только HTTP/2: при
+// отправке через бинарный протокол они игнорируются.
 type Notification struct {
 	// Содержимое уведомления (не может быть пустым)
-	Payload map[string]interface{} `json:"payload"`
-	// Время, до которого сообщение является актуальным (должно быть будущее)
+	Payload Payload `json:"payload"`
+	// Время, до которого сообщение является актуальным. Если не указано, то сервер хранит
+	// уведомление и повторяет попытки доставки максимально долго, а если уже прошло, то передается
+	// нулевое время жизни: сервер пытается доставить уведомление один раз и не хранит его
 	Expiration time.Time `json:"expiration,omitempty"`
-	// Приоритет (может быть 0, 5 или 8)
+	// Приоритет: 10 — доставить немедленно, 5 — с учетом экономии энергии устройства. Если не
+	// указан, то используется 10
 	Priority uint8 `json:"priority,omitempty"`
+	// Идентификатор приложения, которому адресовано уведомление (только HTTP/2)
+	Topic string `json:"topic,omitempty"`
+	// Идентификатор, по которому несколько уведомлений объединяются в одно: устройство показывает
+	// только последнее из них. Не длиннее MaxCollapseIDSize байт (только HTTP/2, при отправке
+	// через Client игнорируется с предупреждением в логе)
+	CollapseID string `json:"collapseId,omitempty"`
+	// Тип уведомления (только HTTP/2)
+	PushType PushType `json:"pushType,omitempty"`
+	// Время, раньше которого уведомление не отправляется: до этого времени оно хранится в клиенте,
+	// а затем помещается в очередь на отправку (только Client, см. Client.Scheduled)
+	NotBefore time.Time `json:"notBefore,omitempty"`
+	// Идентификатор уведомления, заданный вызывающей стороной: по нему можно сопоставить ошибки,
+	// возвращаемые сервером, с собственными данными. Если не указан (0), то идентификатор
+	// назначается клиентом автоматически. Уведомление с заданным идентификатором можно отправить
+	// только на один токен устройства, а сам идентификатор не должен совпадать с идентификаторами
+	// уведомлений, которые еще находятся в очереди или в кеше отправленных (только Client)
+	ID uint32 `json:"id,omitempty"`
+}
+
+// PushType описывает тип уведомления, передаваемый в заголовке apns-push-type.
+type PushType string
+
+// Типы уведомлений.
+const (
+	PushTypeAlert        PushType = "alert"
+	PushTypeBackground   PushType = "background"
+	PushTypeLocation     PushType = "location"
+	PushTypeVoIP         PushType = "voip"
+	PushTypeComplication PushType = "complication"
+	PushTypeFileProvider PushType = "fileprovider"
+	PushTypeMDM          PushType = "mdm"
+	PushTypeLiveActivity PushType = "liveactivity"
+	PushTypePushToTalk   PushType = "pushtotalk"
+)
+
+// pushTypeTopics описывает суффиксы идентификатора приложения (Topic), которые Apple требует для
+// уведомлений соответствующего типа.
+var pushTypeTopics = map[PushType]string{
+	PushTypeVoIP:         ".voip",
+	PushTypeComplication: ".complication",
+	PushTypeFileProvider: ".pushkit.fileprovider",
+	PushTypeLiveActivity: ".push-type.liveactivity",
+	PushTypePushToTalk:   ".voip-ptt",
+	PushTypeLocation:     ".location-query",
+}
+
+// PushTypeError описывает недопустимое сочетание типа уведомления с другими его параметрами.
+type PushTypeError struct {
+	PushType PushType // тип уведомления
+	Field    string   // параметр уведомления, значение которого недопустимо: "topic" или "priority"
+	Reason   string   // описание требования Apple к значению параметра
+}
+
+// Error возвращает строковое представление ошибки.
+func (e *PushTypeError) Error() string {
+	if e.Field == "" {
+		return fmt.Sprintf("unknown push type %q", e.PushType)
+	}
+	return fmt.Sprintf("%s push type conflicts with %s: %s", e.PushType, e.Field, e.Reason)
+}
+
+// PayloadSizeError описывает ошибку превышения допустимой длины содержимого уведомления. При
+// сравнении с помощью errors.Is она соответствует ErrPayloadTooLarge.
+type PayloadSizeError struct {
+	Size  int // длина содержимого уведомления в байтах
+	Limit int // максимально допустимая длина, действовавшая при проверке
+}
+
+// Error возвращает строковое представление ошибки.
+func (e *PayloadSizeError) Error() string {
+	return fmt.Sprintf("payload is too large: %d bytes, limit is %d", e.Size, e.Limit)
+}
+
+// Is возвращает true при сравнении с ErrPayloadTooLarge.
+func (e *PayloadSizeError) Is(target error) bool { return target == ErrPayloadTooLarge }
+
+// validatePushType проверяет, что тип уведомления допустим в сочетании с идентификатором
+// приложения и приоритетом, и возвращает ошибку PushTypeError, если это не так. Идентификатор
+// приложения проверяется, только если он указан.
+func (ntf *Notification) validatePushType() error {
+	switch ntf.PushType {
+	case "", PushTypeAlert, PushTypeBackground, PushTypeMDM:
+	case PushTypePushToTalk:
+		if ntf.priority() != 10 {
+			return &PushTypeError{ntf.PushType, "priority", "priority must be 10"}
+		}
+	case PushTypeVoIP, PushTypeComplication, PushTypeFileProvider, PushTypeLiveActivity,
+		PushTypeLocation:
+	default:
+		return &PushTypeError{PushType: ntf.PushType}
+	}
+	if suffix, ok := pushTypeTopics[ntf.PushType]; ok && ntf.Topic != "" &&
+		!strings.HasSuffix(ntf.Topic, suffix) {
+		return &PushTypeError{ntf.PushType, "topic", fmt.Sprintf("topic must end with %q", suffix)}
+	}
+	return nil
+}
+
+// NewBackgroundNotification возвращает фоновое уведомление, которое без ведома пользователя
+// запускает обновление данных приложения. Переданные данные добавляются в содержимое уведомления,
+// в словаре aps устанавливается только флаг content-available, а приоритет и тип уведомления
+// устанавливаются в соответствии с требованиями Apple: 5 и PushTypeBackground.
+//
+// Такие уведомления доставляются на усмотрение системы и ограничиваются Apple по частоте, поэтому
+// не стоит отправлять их чаще нескольких раз в час. Фоновое уведомление не может содержать alert,
+// sound или badge: такое уведомление не пройдет проверку Validate.
+func NewBackgroundNotification(data map[string]interface{}) *Notification {
+	var payload = NewPayload()
+	for key, value := range data {
+		payload[key] = value
+	}
+	return &Notification{
+		Payload:  payload.ContentAvailable(),
+		Priority: 5,
+		PushType: PushTypeBackground,
+	}
+}
+
+// priority возвращает приоритет уведомления с учетом значения по умолчанию.
+func (ntf *Notification) priority() uint8 {
+	if ntf.Priority == 0 {
+		return 10
+	}
+	return ntf.Priority
+}
+
+// Validate проверяет, что уведомление удовлетворяет требованиям Apple, и возвращает ошибку, если
+// это не так. Проверка автоматически выполняется при отправке уведомления.
+//
+// Если задан тип уведомления, то проверяется и его сочетание с идентификатором приложения и
+// приоритетом: о недопустимом сочетании сообщает ошибка PushTypeError, а о недопустимом приоритете
+// фонового уведомления — ErrBackgroundPriority. Приоритет, отличный от 5 или 10, считается
+// недопустимым для любого уведомления: в этом случае возвращается ErrPriorityInvalid.
+func (ntf *Notification) Validate() error {
+	if ntf.Payload == nil || len(ntf.Payload) == 0 {
+		return ErrPayloadEmpty
+	}
+	if ntf.Priority != 0 && ntf.Priority != 5 && ntf.Priority != 10 {
+		return ErrPriorityInvalid
+	}
+	if err := ntf.Payload.validate(); err != nil {
+		return err
+	}
+	if err := ntf.validatePushType(); err != nil {
+		return err
+	}
+	if ntf.PushType == PushTypeBackground {
+		if ntf.Priority != 5 {
+			return ErrBackgroundPriority
+		}
+		if aps, ok := ntf.Payload["aps"].(map[string]interface{}); ok {
+			for _, key := range []string{"alert", "sound", "badge"} {
+				if _, ok := aps[key]; ok {
+					return ErrBackgroundAlert
+				}
+			}
+		}
+	}
+	return nil
 }
 
 // toSendMessage конвертирует представление сообщения в формат отправляемого сообщения.
 // В процессе конвертации проверяется, что сообщение не содержит пустого payload и что
-// его длинна не превышает 2K. Время жизни сообщения устанавливается исходя из текущего времени.
+// его длинна не превышает MaxPayloadSize: в противном случае возвращается ошибка PayloadSizeError.
+// Время жизни сообщения устанавливается исходя из текущего времени.
 //
 // Обратите внимание, что получаемое таким образом сообщение не содержит токен устройства
 // и не может быть отправлено как есть. Перед отправкой воспользуйтесь методом WithToken()
@@ -29,35 +200,91 @@ type Notification struct {
 // Таким образом, вы можете легко и без существенного увеличения нагрузки отсылать одно
 // и тоже сообщение сразу на большое количество устройств.
 func (ntf *Notification) convert() (*notification, error) {
-	if ntf.Payload == nil || len(ntf.Payload) == 0 {
-		return nil, ErrPayloadEmpty
+	if err := ntf.Validate(); err != nil {
+		return nil, err
 	}
 	payload, err := json.Marshal(ntf.Payload)
 	if err != nil {
 		return nil, err
 	}
+	return ntf.compile(payload)
+}
+
+// compile возвращает внутреннее представление уже проверенного уведомления с переданным
+// сериализованным содержимым, проверяя его длину и время жизни уведомления.
+func (ntf *Notification) compile(payload []byte) (*notification, error) {
 	if len(payload) > MaxPayloadSize { // проверяем, что сообщение допустимого размера
-		return nil, ErrPayloadTooLarge
+		return nil, &PayloadSizeError{Size: len(payload), Limit: MaxPayloadSize}
 	}
-	var expiration uint32
+	var (
+		expiration uint32
+		immediate  bool
+	)
 	if !ntf.Expiration.IsZero() {
-		if ntf.Expiration.Before(time.Now()) {
-			return nil, ErrNotificationExpired
+		if ntf.Expiration.After(time.Now()) {
+			expiration = uint32(ntf.Expiration.Unix())
+		} else {
+			immediate = true // время жизни уже истекло: сервер не будет хранить уведомление
 		}
-		expiration = uint32(ntf.Expiration.Unix())
-	}
-	var priority uint8
-	if ntf.Priority == 5 || ntf.Priority == 10 {
-		priority = ntf.Priority
 	}
 	var notification = &notification{
 		Payload:    payload,
 		Expiration: expiration,
-		Priority:   priority,
+		Immediate:  immediate,
+		ID:         ntf.ID,
+		Priority:   ntf.priority(),
+		NotBefore:  ntf.NotBefore,
 	}
 	return notification, nil
 }
 
+// PayloadPreview описывает содержимое уведомления в том виде, в котором оно будет отправлено на
+// сервер, и позволяет вывести его в лог перед отправкой.
+type PayloadPreview struct {
+	Payload []byte // содержимое уведомления в формате JSON
+	Size    int    // длина содержимого в байтах
+	Limit   int    // максимально допустимая длина содержимого (MaxPayloadSize)
+}
+
+// String возвращает содержимое уведомления вместе с его длиной и ограничением длины.
+func (p PayloadPreview) String() string {
+	return fmt.Sprintf("%s (%d of %d bytes)", p.Payload, p.Size, p.Limit)
+}
+
+// Preview возвращает содержимое уведомления, сериализованное точно так же, как при отправке,
+// вместе с его длиной. Если уведомление не проходит проверку, то вместе с содержимым возвращается
+// та же ошибка, что и при отправке: так, для слишком большого уведомления можно увидеть, что именно
+// превышает ограничение. Буферы, используемые при отправке, при этом не затрагиваются.
+func (ntf *Notification) Preview() (PayloadPreview, error) {
+	payload, err := json.Marshal(ntf.Payload)
+	if err != nil {
+		return PayloadPreview{}, err
+	}
+	var preview = PayloadPreview{Payload: payload, Size: len(payload), Limit: MaxPayloadSize}
+	_, err = ntf.convert()
+	return preview, err
+}
+
+// CompiledNotification описывает заранее проверенное и сериализованное уведомление, которое можно
+// многократно отправлять с помощью Client.SendCompiled без повторной обработки его содержимого.
+// После создания оно не изменяется и может одновременно использоваться из разных потоков.
+type CompiledNotification struct {
+	template   *notification // шаблон уведомления без токена устройства
+	collapseID string        // идентификатор группировки, о котором предупреждает Client
+}
+
+// PrecompileNotification проверяет и сериализует уведомление, возвращая его подготовленное к
+// отправке представление. Если уведомление содержит некорректные данные, то возвращается ошибка.
+// Идентификатор группировки (CollapseID) бинарным протоколом не поддерживается: предупреждение об
+// этом выводится в лог клиента при отправке с помощью Client.SendCompiled.
+func PrecompileNotification(ntf *Notification) (*CompiledNotification, error) {
+	template, err := ntf.convert()
+	if err != nil {
+		return nil, err
+	}
+	return &CompiledNotification{template: template, collapseID: ntf.CollapseID}, nil
+}
+
 // notification описывает внутреннее, подготовленное к отправке, представление
 // сообщения, используемое внутри приложения.
 type notification struct {
@@ -65,14 +292,21 @@ type notification struct {
 	Token      []byte    // идентификатор устройства, которому это адресовано
 	Payload    []byte    // содержимое уведомления в бинарном виде
 	Expiration uint32    // дата и время, после которого сообщение считается не актуальным
-	Priority   uint8     // приоритет сообщения: 0, 5 или 8
+	Immediate  bool      // время жизни передается нулевым: сервер не хранит уведомление
+	Priority   uint8     // приоритет сообщения: 0 (не указан), 5 или 10
+	NotBefore  time.Time // время, раньше которого сообщение не отправляется
+	Enqueued   time.Time // время, когда сообщение помещено в очередь на отправку
 	Sended     time.Time // время, когда сообщение отправлено на сервер
 }
 
+// expirationForever описывает время жизни уведомления, для которого оно не было указано: самое
+// позднее время, представимое в бинарном протоколе.
+const expirationForever uint32 = math.MaxUint32
+
 // Len возвращает размер сообщения в байтах, с учетом заголовка
 func (ntf *notification) Len() int {
 	// 1+4 - заголовок
-	// 1+2+32  - токен
+	// 1+2+len(token) - токен
 	// 1+2+len(payload) - тело сообщения
 	var length = 5 + 3 + len(ntf.Token) + 3 + len(ntf.Payload)
 	// 1+2+4 - идентификатор сообщения (если есть)
@@ -80,7 +314,7 @@ func (ntf *notification) Len() int {
 		length += 7
 	}
 	// 1+2+4 - срок окончания актуальности (если есть)
-	if ntf.Expiration != 0 {
+	if ntf.hasExpiration() {
 		length += 7
 	}
 	// 1+2+1 - приоритет (если есть)
@@ -90,6 +324,42 @@ func (ntf *notification) Len() int {
 	return length
 }
 
+// maxNotificationLen возвращает размер в байтах уведомления с содержимым максимальной длины и со
+// всеми необязательными элементами.
+func maxNotificationLen() int {
+	var ntf = &notification{
+		ID:         1,
+		Token:      make([]byte, MaxTokenSize),
+		Payload:    make([]byte, MaxPayloadSize),
+		Expiration: 1,
+		Priority:   10,
+	}
+	return ntf.Len()
+}
+
+// fitsFrame возвращает true, если уведомление с токеном устройства указанного размера (с учетом
+// идентификатора и времени жизни, добавляемых при помещении в очередь) помещается во фрейм
+// размером MaxFrameBuffer. Уведомление, которое в него не помещается, отправить невозможно.
+func fitsFrame(template *notification, tokenSize int) bool {
+	var size = template.Len() + tokenSize + 7 // токен и идентификатор
+	if !template.hasExpiration() {
+		size += 7 // время жизни добавляется при помещении в очередь
+	}
+	return size <= MaxFrameBuffer
+}
+
+// maxTokenLen возвращает размер в байтах самого длинного из токенов устройств, заданных в
+// шестнадцатеричном виде.
+func maxTokenLen(tokens []string) int {
+	var longest int
+	for _, token := range tokens {
+		if len(token) > longest {
+			longest = len(token)
+		}
+	}
+	return longest / 2
+}
+
 // WriteTo записывает в поток байтовое представление сообщения.
 func (ntf *notification) WriteTo(w io.Writer) (n int64, err error) {
 	if err = binary.Write(w, binary.BigEndian, uint8(2)); err != nil {
@@ -145,7 +415,7 @@ func (ntf *notification) WriteTo(w io.Writer) (n int64, err error) {
 		n += 4
 	}
 	// Expiration date
-	if ntf.Expiration != 0 {
+	if ntf.hasExpiration() {
 		if err = binary.Write(w, binary.BigEndian, uint8(4)); err != nil {
 			return
 		}
@@ -165,7 +435,7 @@ func (ntf *notification) WriteTo(w io.Writer) (n int64, err error) {
 			return
 		}
 		n++
-		if err = binary.Write(w, binary.BigEndian, uint16(4)); err != nil {
+		if err = binary.Write(w, binary.BigEndian, uint16(1)); err != nil {
 			return
 		}
 		n += 2
@@ -177,15 +447,95 @@ func (ntf *notification) WriteTo(w io.Writer) (n int64, err error) {
 	return
 }
 
+// decodeFrameItems разбирает элементы фрейма уведомления, записанного с помощью WriteTo, без
+// заголовка. Если фрейм поврежден или не содержит токена и содержимого, то возвращается nil.
+func decodeFrameItems(frame []byte) *notification {
+	var ntf = new(notification)
+	for len(frame) >= 3 {
+		var (
+			id   = frame[0]
+			size = int(binary.BigEndian.Uint16(frame[1:3]))
+		)
+		if len(frame) < 3+size {
+			return nil
+		}
+		var data = frame[3 : 3+size]
+		switch {
+		case id == 1:
+			ntf.Token = data
+		case id == 2:
+			ntf.Payload = data
+		case id == 3 && size == 4:
+			ntf.ID = binary.BigEndian.Uint32(data)
+		case id == 4 && size == 4:
+			ntf.Expiration = binary.BigEndian.Uint32(data)
+			ntf.Immediate = ntf.Expiration == 0
+		case id == 5 && size == 1:
+			ntf.Priority = data[0]
+		}
+		frame = frame[3+size:]
+	}
+	if len(ntf.Token) == 0 || len(ntf.Payload) == 0 {
+		return nil
+	}
+	return ntf
+}
+
+// EncodeFrame возвращает бинарное представление уведомления в формате команды 2 протокола APNS,
+// которое можно отправить на сервер через собственное соединение, не используя Client. Нулевые
+// значения идентификатора, времени жизни и приоритета в представление не включаются.
+//
+// Токен устройства не может быть пустым или превышать MaxTokenSize, содержимое уведомления не может
+// быть пустым или превышать MaxPayloadSize, время жизни должно быть представимо в виде 32-битного
+// Unix-времени, а приоритет может принимать только значения 5 или 10.
+func EncodeFrame(token, payload []byte, id uint32, expiration time.Time, priority uint8) ([]byte, error) {
+	if !validTokenSize(len(token)) {
+		return nil, ErrTokenSize
+	}
+	if len(payload) == 0 {
+		return nil, ErrPayloadEmpty
+	}
+	if len(payload) > MaxPayloadSize || len(payload) > math.MaxUint16 {
+		return nil, ErrPayloadTooLarge
+	}
+	var expirationUnix uint32
+	if !expiration.IsZero() {
+		var unix = expiration.Unix()
+		if unix <= 0 || unix > math.MaxUint32 {
+			return nil, ErrExpirationInvalid
+		}
+		expirationUnix = uint32(unix)
+	}
+	if priority != 0 && priority != 5 && priority != 10 {
+		return nil, ErrPriorityInvalid
+	}
+	var ntf = &notification{
+		ID:         id,
+		Token:      token,
+		Payload:    payload,
+		Expiration: expirationUnix,
+		Priority:   priority,
+	}
+	var buf = bytes.NewBuffer(make([]byte, 0, ntf.Len()))
+	if _, err := ntf.WriteTo(buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
 // WithToken возвращает копию уведомления для отправки с установленным токеном.
-// Идентификатор уведомления и дата создания, если они были установлены, при этом сбрасываются.
+// Идентификатор уведомления копируется (у шаблона он задан, только если указан в Notification.ID),
+// а время помещения в очередь и отправки, если они были установлены, при этом сбрасываются.
 // Уведомления, полученные с помощью этой функции, полностью готовы для отправки.
 func (ntf *notification) WithToken(token []byte) *notification {
 	return &notification{
+		ID:         ntf.ID,
 		Token:      token,
 		Payload:    ntf.Payload,
 		Expiration: ntf.Expiration,
+		Immediate:  ntf.Immediate,
 		Priority:   ntf.Priority,
+		NotBefore:  ntf.NotBefore,
 	}
 }
 
@@ -199,6 +549,9 @@ func (ntf *notification) PayloadMap() map[string]interface{} {
 	return payload
 }
 
+// hasExpiration возвращает true, если время жизни уведомления задано и передается на сервер.
+func (ntf *notification) hasExpiration() bool { return ntf.Expiration != 0 || ntf.Immediate }
+
 // IsExpired возвращает true, если сообщение устарело.
 func (ntf *notification) IsExpired() bool {
 	return ntf.Expiration != 0 && ntf.Expiration < uint32(time.Now().Unix())
@@ -208,6 +561,11 @@ func (ntf *notification) IsExpired() bool {
 // не было установлено, то возвращает дату, соответствующую time.Time.IsZero().
 func (ntf *notification) ExpirationTime() time.Time { return time.Unix(int64(ntf.Expiration), 0) }
 
+// Preview возвращает содержимое сообщения в том виде, в котором оно отправляется на сервер.
+func (ntf *notification) Preview() PayloadPreview {
+	return PayloadPreview{Payload: ntf.Payload, Size: len(ntf.Payload), Limit: MaxPayloadSize}
+}
+
 // String возвращает короткое строковое описание сообщения в виде токена и номера
 // сообщения. Если сообщение не содержит токен устройства, возвращается строка
 // с "untokened message" и номером.
@@ -0,0 +1,348 @@
+package apns
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrecompileNotification(t *testing.T) {
+	var ntf = &Notification{
+		Payload:    NewPayload().RelevanceScore(0.3),
+		Expiration: time.Now().Add(time.Hour),
+		Priority:   5,
+	}
+	compiled, err := PrecompileNotification(ntf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var frames [2]bytes.Buffer
+	for i, send := range []func(*Client) error{
+		func(client *Client) error { return client.Send(ntf, tokenStrings...) },
+		func(client *Client) error { return client.SendCompiled(compiled, tokenStrings...) },
+	} {
+		client := newOfflineClient(t, new(Config))
+		if err := send(client); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.queue.WriteTo(&frames[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if frames[0].Len() == 0 || !bytes.Equal(frames[0].Bytes(), frames[1].Bytes()) {
+		t.Error("precompiled frames differ")
+	}
+	if _, err := PrecompileNotification(new(Notification)); err != ErrPayloadEmpty {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestNotificationBinaryIgnoresHTTP2Fields(t *testing.T) {
+	var (
+		ntf = &Notification{
+			Payload:  NewPayload().Sound(DefaultSound),
+			Priority: 10,
+		}
+		http2 = *ntf
+		data  [2]bytes.Buffer
+	)
+	http2.Topic = "com.example.app"
+	http2.CollapseID = "score"
+	http2.PushType = PushTypeAlert
+	for i, ntf := range []*Notification{ntf, &http2} {
+		item, err := ntf.convert()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := item.WithToken(bytes.Repeat([]byte{1}, 32)).WriteTo(&data[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(data[0].Bytes(), data[1].Bytes()) {
+		t.Error("binary frame depends on HTTP/2 fields")
+	}
+}
+
+func TestEncodeFrame(t *testing.T) {
+	var (
+		token   = bytes.Repeat([]byte{0xaa}, 32)
+		payload = []byte(`{"aps":{}}`)
+		known   []byte
+	)
+	known = append(known, 2, 0, 0, 0, 66)                  // команда и длина фрейма
+	known = append(known, 1, 0, 32)                        // токен устройства
+	known = append(known, token...)                        //
+	known = append(known, 2, 0, 10)                        // содержимое
+	known = append(known, payload...)                      //
+	known = append(known, 3, 0, 4, 0x01, 0x02, 0x03, 0x04) // идентификатор
+	known = append(known, 4, 0, 4, 0x65, 0x53, 0xf1, 0x00) // время жизни
+	known = append(known, 5, 0, 1, 10)                     // приоритет
+	frame, err := EncodeFrame(token, payload, 0x01020304, time.Unix(1700000000, 0), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(frame, known) {
+		t.Errorf("bad frame:\n% x\nexpected:\n% x", frame, known)
+	}
+	// без необязательных элементов
+	frame, err = EncodeFrame(token, payload, 0, time.Time{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(frame[5:], known[5:5+35+13]) || frame[4] != 35+13 {
+		t.Errorf("bad short frame:\n% x", frame)
+	}
+	// токены короче 32 байт тоже допустимы
+	if frame, err = EncodeFrame(token[:8], payload, 0, time.Time{}, 0); err != nil ||
+		!bytes.Equal(frame[8:16], token[:8]) {
+		t.Errorf("bad short token frame (%v):\n% x", err, frame)
+	}
+
+	for _, test := range []struct {
+		token, payload []byte
+		expiration     time.Time
+		priority       uint8
+		err            error
+	}{
+		{nil, payload, time.Time{}, 0, ErrTokenSize},
+		{token, nil, time.Time{}, 0, ErrPayloadEmpty},
+		{token, make([]byte, MaxPayloadSize+1), time.Time{}, 0, ErrPayloadTooLarge},
+		{token, payload, time.Unix(1<<32, 0), 0, ErrExpirationInvalid},
+		{token, payload, time.Time{}, 8, ErrPriorityInvalid},
+	} {
+		if _, err := EncodeFrame(test.token, test.payload, 1, test.expiration,
+			test.priority); err != test.err {
+			t.Errorf("error %v, expected %v", err, test.err)
+		}
+	}
+}
+
+func TestBackgroundNotification(t *testing.T) {
+	var ntf = NewBackgroundNotification(map[string]interface{}{"sync": "inbox"})
+	if err := ntf.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	item, err := ntf.convert()
+	if err != nil {
+		t.Fatal(err)
+	}
+	const expected = `{"aps":{"content-available":1},"sync":"inbox"}`
+	if string(item.Payload) != expected || item.Priority != 5 ||
+		ntf.PushType != PushTypeBackground {
+		t.Errorf("bad background notification: %s, priority %d, type %q",
+			item.Payload, item.Priority, ntf.PushType)
+	}
+
+	ntf.Payload.aps()["alert"] = "wake up"
+	if _, err := ntf.convert(); err != ErrBackgroundAlert {
+		t.Errorf("alert in background notification: %v", err)
+	}
+	ntf = NewBackgroundNotification(nil)
+	ntf.Payload.Sound(DefaultSound)
+	if err := ntf.Validate(); err != ErrBackgroundAlert {
+		t.Errorf("sound in background notification: %v", err)
+	}
+	ntf = NewBackgroundNotification(nil)
+	ntf.Priority = 10
+	if err := ntf.Validate(); err != ErrBackgroundPriority {
+		t.Errorf("background notification priority: %v", err)
+	}
+}
+
+func TestPayloadSizeLimit(t *testing.T) {
+	// длина сериализованного содержимого без значения data
+	var overhead = len(`{"aps":{},"data":""}`)
+	for _, size := range []int{MaxPayloadSize, MaxPayloadSize + 1} {
+		var ntf = &Notification{Payload: Payload{
+			"aps":  map[string]interface{}{},
+			"data": strings.Repeat("x", size-overhead),
+		}}
+		_, err := ntf.convert()
+		if size <= MaxPayloadSize {
+			if err != nil {
+				t.Errorf("%d bytes: unexpected error %v", size, err)
+			}
+			continue
+		}
+		if !errors.Is(err, ErrPayloadTooLarge) {
+			t.Fatalf("%d bytes: error %v, expected %v", size, err, ErrPayloadTooLarge)
+		}
+		var sizeErr *PayloadSizeError
+		if !errors.As(err, &sizeErr) || sizeErr.Size != size || sizeErr.Limit != MaxPayloadSize {
+			t.Errorf("%d bytes: bad error %#v", size, err)
+		}
+		if msg := err.Error(); !strings.Contains(msg, strconv.Itoa(size)) ||
+			!strings.Contains(msg, strconv.Itoa(MaxPayloadSize)) {
+			t.Errorf("error message %q does not name the size and the limit", msg)
+		}
+	}
+}
+
+func TestNotificationPriority(t *testing.T) {
+	for _, test := range []struct {
+		priority, expected uint8
+		err                error
+	}{
+		{0, 10, nil},
+		{5, 5, nil},
+		{10, 10, nil},
+		{8, 0, ErrPriorityInvalid},
+	} {
+		item, err := (&Notification{Payload: NewPayload().Alert("test"),
+			Priority: test.priority}).convert()
+		if err != test.err {
+			t.Errorf("priority %d: error %v, expected %v", test.priority, err, test.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		var buf bytes.Buffer
+		if _, err := item.WithToken(bytes.Repeat([]byte{1}, 32)).WriteTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+		// элемент приоритета записывается последним
+		var frame = buf.Bytes()
+		if item := frame[len(frame)-4:]; !bytes.Equal(item, []byte{5, 0, 1, test.expected}) {
+			t.Errorf("priority %d: bad frame item % x", test.priority, item)
+		}
+	}
+}
+
+func TestNotificationPreview(t *testing.T) {
+	var ntf = &Notification{Payload: NewPayload().Alert("Hello").Badge(1)}
+	preview, err := ntf.Preview()
+	if err != nil {
+		t.Fatal(err)
+	}
+	item, err := ntf.convert()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(preview.Payload, item.Payload) || preview.Size != len(item.Payload) ||
+		preview.Limit != MaxPayloadSize {
+		t.Errorf("bad preview %v, expected %s", preview, item.Payload)
+	}
+	if preview.String() != item.Preview().String() {
+		t.Errorf("preview %q, expected %q", preview, item.Preview())
+	}
+	const expected = `{"aps":{"alert":"Hello","badge":1}} (35 of 2048 bytes)`
+	if preview.String() != expected {
+		t.Errorf("preview %q, expected %q", preview, expected)
+	}
+	// слишком большое уведомление можно посмотреть вместе с ошибкой
+	ntf.Payload.Custom("data", strings.Repeat("x", MaxPayloadSize))
+	if preview, err = ntf.Preview(); !errors.Is(err, ErrPayloadTooLarge) ||
+		preview.Size <= MaxPayloadSize {
+		t.Errorf("oversized preview %d bytes (%v)", preview.Size, err)
+	}
+}
+
+func TestClientSendUnencodablePayload(t *testing.T) {
+	client := newOfflineClient(t, new(Config))
+	var ntf = &Notification{Payload: NewPayload().Alert("test").Custom("done", make(chan int))}
+	var typeErr *json.UnsupportedTypeError
+	if err := client.Send(ntf, testTokens(1)...); !errors.As(err, &typeErr) {
+		t.Errorf("send error %v, expected %T", err, typeErr)
+	}
+	if count := client.Pending(); count != 0 {
+		t.Errorf("%d notifications queued", count)
+	}
+}
+
+func TestPayloadValidator(t *testing.T) {
+	var errSchema = errors.New("payload does not match schema")
+	client := newOfflineClient(t, new(Config))
+	client.PayloadValidator = func(payload []byte) error {
+		if !bytes.Contains(payload, []byte(`"sound"`)) {
+			return errSchema
+		}
+		return nil
+	}
+	for _, test := range []struct {
+		payload Payload
+		err     error
+		queued  int
+	}{
+		{NewPayload().ContentAvailable(), errSchema, 0},
+		{NewPayload().Sound(DefaultSound), nil, 1},
+	} {
+		if err := client.Send(&Notification{Payload: test.payload}, testTokens(1)...); err != test.err {
+			t.Errorf("send error %v, expected %v", err, test.err)
+		}
+		if count := client.queue.PendingCount(); count != test.queued {
+			t.Errorf("%d notifications queued, expected %d", count, test.queued)
+		}
+	}
+	// проверка выполняется во всех способах отправки
+	var ntf = &Notification{Payload: NewPayload().ContentAvailable()}
+	compiled, err := PrecompileNotification(ntf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SendCompiled(compiled, testTokens(1)...); err != errSchema {
+		t.Errorf("send compiled error %v", err)
+	}
+	if _, err := client.SendTokens(ntf, testTokens(1)); err != errSchema {
+		t.Errorf("send tokens error %v", err)
+	}
+	if results := client.SendBatch([]BatchItem{{ntf, tokenStrings[0]}}); results[0].Err != errSchema {
+		t.Errorf("batch item error %v", results[0].Err)
+	}
+	if _, _, err := client.SendFromReader(ntf, strings.NewReader(tokenStrings[0])); err != errSchema {
+		t.Errorf("send from reader error %v", err)
+	}
+	if count := client.queue.PendingCount(); count != 1 {
+		t.Errorf("%d notifications queued, expected 1", count)
+	}
+}
+
+func TestNotificationPushType(t *testing.T) {
+	var payload = NewPayload().Sound(DefaultSound)
+	for i, test := range []struct {
+		ntf   *Notification
+		field string // параметр, вызывающий ошибку, или пустая строка, если ошибки нет
+	}{
+		{&Notification{PushType: PushTypeAlert, Topic: "com.example.app", Priority: 10}, ""},
+		{&Notification{PushType: PushTypeVoIP, Topic: "com.example.app.voip"}, ""},
+		{&Notification{PushType: PushTypeVoIP}, ""},
+		{&Notification{PushType: PushTypeVoIP, Topic: "com.example.app"}, "topic"},
+		{&Notification{PushType: PushTypeLiveActivity,
+			Topic: "com.example.app.push-type.liveactivity"}, ""},
+		{&Notification{PushType: PushTypeLiveActivity, Topic: "com.example.app.voip"}, "topic"},
+		{&Notification{PushType: PushTypeComplication, Topic: "com.example.app"}, "topic"},
+		{&Notification{PushType: PushTypeFileProvider,
+			Topic: "com.example.app.pushkit.fileprovider"}, ""},
+		{&Notification{PushType: PushTypeLocation, Topic: "com.example.app"}, "topic"},
+		{&Notification{PushType: PushTypePushToTalk, Topic: "com.example.app.voip-ptt",
+			Priority: 5}, "priority"},
+		{&Notification{PushType: PushTypePushToTalk, Topic: "com.example.app.voip-ptt",
+			Priority: 10}, ""},
+	} {
+		test.ntf.Payload = payload
+		var err = test.ntf.Validate()
+		if test.field == "" {
+			if err != nil {
+				t.Errorf("%d: unexpected error %v", i, err)
+			}
+			continue
+		}
+		if err, ok := err.(*PushTypeError); !ok || err.Field != test.field ||
+			err.PushType != test.ntf.PushType {
+			t.Errorf("%d: error %v, expected %s conflict", i, err, test.field)
+		}
+	}
+	// фоновое уведомление с приоритетом 10 и неизвестный тип
+	if err := (&Notification{Payload: payload, PushType: PushTypeBackground,
+		Priority: 10}).Validate(); err != ErrBackgroundPriority {
+		t.Errorf("background priority error %v", err)
+	}
+	var err = (&Notification{Payload: payload, PushType: "widget"}).Validate()
+	if err == nil || err.Error() != `unknown push type "widget"` {
+		t.Errorf("unknown push type error %v", err)
+	}
+}
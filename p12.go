@@ -0,0 +1,34 @@
+package apns
+
+import (
+	"encoding/pem"
+	"fmt"
+
+	"golang.org/x/crypto/pkcs12"
+)
+
+// ConfigFromP12 возвращает конфигурацию для APNS с сертификатом и приватным ключом из файла .p12
+// (PKCS #12), в котором Apple выдает сертификаты для отправки уведомлений. Это избавляет от
+// необходимости предварительно конвертировать сертификат в PEM. Как и в ConfigFromPEM,
+// идентификатор приложения берется из атрибута UID сертификата.
+//
+// Если пароль не подходит, то возвращается ошибка, для которой errors.Is(err, ErrP12Password)
+// возвращает true, а если файл не удалось разобрать — ErrP12Format.
+func ConfigFromP12(data []byte, password string, sandbox bool) (*Config, error) {
+	blocks, err := pkcs12.ToPEM(data, password)
+	if err == pkcs12.ErrIncorrectPassword {
+		return nil, ErrP12Password
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrP12Format, err)
+	}
+	var certPEM, keyPEM []byte
+	for _, block := range blocks {
+		if block.Type == "CERTIFICATE" {
+			certPEM = append(certPEM, pem.EncodeToMemory(block)...)
+		} else {
+			keyPEM = append(keyPEM, pem.EncodeToMemory(block)...)
+		}
+	}
+	return ConfigFromPEM(certPEM, keyPEM, sandbox)
+}
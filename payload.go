@@ -0,0 +1,274 @@
+package apns
+
+import "encoding/json"
+
+// Payload описывает содержимое уведомления. Кроме непосредственного заполнения словаря, для
+// формирования содержимого можно использовать методы, изменяющие словарь aps. Все они возвращают
+// тот же самый Payload, что позволяет объединять их вызовы в цепочку.
+type Payload map[string]interface{}
+
+// NewPayload возвращает новое пустое содержимое уведомления.
+func NewPayload() Payload { return make(Payload) }
+
+// aps возвращает словарь aps, создавая его, если он еще не определен.
+func (p Payload) aps() map[string]interface{} {
+	if aps, ok := p["aps"].(map[string]interface{}); ok {
+		return aps
+	}
+	var aps = make(map[string]interface{})
+	p["aps"] = aps
+	return aps
+}
+
+// ContentAvailable устанавливает флаг content-available, по которому приложение запускается в фоне
+// для обновления своих данных.
+func (p Payload) ContentAvailable() Payload {
+	p.aps()["content-available"] = 1
+	return p
+}
+
+// MutableContent устанавливает флаг mutable-content, по которому перед показом уведомления
+// запускается расширение приложения (notification service extension), способное изменить его
+// содержимое: например, расшифровать текст или загрузить вложение.
+func (p Payload) MutableContent() Payload {
+	p.aps()["mutable-content"] = 1
+	return p
+}
+
+// ThreadID устанавливает идентификатор, по которому уведомления группируются на устройстве.
+func (p Payload) ThreadID(id string) Payload {
+	p.aps()["thread-id"] = id
+	return p
+}
+
+// Alert устанавливает текст уведомления, отображаемый пользователю.
+func (p Payload) Alert(text string) Payload {
+	p.aps()["alert"] = text
+	return p
+}
+
+// TitledAlert устанавливает уведомление с заголовком, подзаголовком и текстом. Пустые значения не
+// передаются, а если заданы только текст, то уведомление записывается так же, как с помощью Alert:
+// в виде строки.
+func (p Payload) TitledAlert(title, subtitle, body string) Payload {
+	if title == "" && subtitle == "" {
+		return p.Alert(body)
+	}
+	var alert = make(map[string]interface{}, 3)
+	for key, value := range map[string]string{"title": title, "subtitle": subtitle, "body": body} {
+		if value != "" {
+			alert[key] = value
+		}
+	}
+	p.aps()["alert"] = alert
+	return p
+}
+
+// LocalizedAlert описывает текст уведомления, который локализуется на устройстве: вместо самого
+// текста передаются ключи строк из файла Localizable.strings приложения и аргументы для их
+// подстановки.
+type LocalizedAlert struct {
+	TitleLocKey  string   `json:"title-loc-key,omitempty"`  // ключ строки заголовка
+	TitleLocArgs []string `json:"title-loc-args,omitempty"` // аргументы строки заголовка
+	LocKey       string   `json:"loc-key,omitempty"`        // ключ строки текста уведомления
+	LocArgs      []string `json:"loc-args,omitempty"`       // аргументы строки текста уведомления
+	ActionLocKey string   `json:"action-loc-key,omitempty"` // ключ строки названия кнопки действия
+}
+
+// LocalizedAlert устанавливает текст уведомления, локализуемый на устройстве.
+func (p Payload) LocalizedAlert(alert LocalizedAlert) Payload {
+	p.aps()["alert"] = alert
+	return p
+}
+
+// Category устанавливает идентификатор категории уведомления, определяющей набор действий,
+// которые пользователь может выполнить с уведомлением.
+func (p Payload) Category(category string) Payload {
+	p.aps()["category"] = category
+	return p
+}
+
+// Custom добавляет в содержимое уведомления собственные данные приложения с указанным ключом.
+// Данные добавляются на верхний уровень содержимого, рядом со словарем aps, и не должны
+// использовать ключ "aps": такие данные игнорируются.
+func (p Payload) Custom(key string, value interface{}) Payload {
+	if key != "aps" {
+		p[key] = value
+	}
+	return p
+}
+
+// Sound описывает звук, проигрываемый при получении уведомления.
+type Sound string
+
+// DefaultSound описывает стандартный системный звук уведомления.
+const DefaultSound Sound = "default"
+
+// NamedSound возвращает звук, проигрываемый из файла с указанным именем, который находится в
+// бандле приложения или в каталоге Library/Sounds его контейнера. Для системного звука используйте
+// DefaultSound.
+func NamedSound(name string) Sound { return Sound(name) }
+
+// Sound устанавливает звук, проигрываемый при получении уведомления.
+func (p Payload) Sound(sound Sound) Payload {
+	p.aps()["sound"] = sound
+	return p
+}
+
+// Badge устанавливает число, отображаемое на иконке приложения. Для удаления числа с иконки
+// используйте ClearBadge, а чтобы оставить его без изменения — NoBadgeChange.
+func (p Payload) Badge(badge int) Payload {
+	p.aps()["badge"] = badge
+	return p
+}
+
+// ClearBadge убирает число с иконки приложения: в уведомление добавляется значение badge, равное 0.
+func (p Payload) ClearBadge() Payload { return p.Badge(0) }
+
+// NoBadgeChange оставляет число на иконке приложения без изменения: ключ badge удаляется из
+// уведомления, даже если он был установлен ранее. Это не то же самое, что ClearBadge, который
+// убирает число с иконки.
+func (p Payload) NoBadgeChange() Payload {
+	if aps, ok := p["aps"].(map[string]interface{}); ok {
+		delete(aps, "badge")
+	}
+	return p
+}
+
+// InterruptionLevel описывает важность уведомления и то, как система будет прерывать
+// пользователя при его получении (iOS 15).
+type InterruptionLevel string
+
+// Допустимые уровни важности уведомлений.
+const (
+	InterruptionPassive       InterruptionLevel = "passive"
+	InterruptionActive        InterruptionLevel = "active"
+	InterruptionTimeSensitive InterruptionLevel = "time-sensitive"
+	InterruptionCritical      InterruptionLevel = "critical"
+)
+
+// Communication помечает уведомление как коммуникационное (iOS 15): устанавливает идентификатор
+// разговора target-content-id и флаг mutable-content, чтобы расширение приложения могло связать
+// уведомление с намерением отправки сообщения. Такое уведомление обязательно должно содержать alert.
+func (p Payload) Communication(targetContentID string) Payload {
+	var aps = p.aps()
+	aps["target-content-id"] = targetContentID
+	aps["mutable-content"] = 1
+	return p
+}
+
+// InterruptionLevel устанавливает уровень важности уведомления.
+func (p Payload) InterruptionLevel(level InterruptionLevel) Payload {
+	p.aps()["interruption-level"] = level
+	return p
+}
+
+// RelevanceScore устанавливает значение от 0 до 1, по которому система выбирает уведомление,
+// выводимое в сводке первым.
+func (p Payload) RelevanceScore(score float64) Payload {
+	p.aps()["relevance-score"] = score
+	return p
+}
+
+// FilterCriteria устанавливает критерий, по которому система определяет, показывать ли
+// уведомление в текущем режиме фокусирования.
+func (p Payload) FilterCriteria(criteria string) Payload {
+	p.aps()["filter-criteria"] = criteria
+	return p
+}
+
+// validate проверяет корректность значений словаря aps, установленных с помощью методов Payload.
+func (p Payload) validate() error {
+	aps, ok := p["aps"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	if id, ok := aps["target-content-id"]; ok {
+		if id, ok := id.(string); !ok || id == "" {
+			return ErrTargetContentID
+		}
+		if _, ok := aps["alert"]; !ok {
+			return ErrAlertRequired
+		}
+	}
+	if flag, ok := aps["mutable-content"]; ok && flag != 1 && flag != float64(1) {
+		return ErrMutableContent // единственное допустимое значение, в том числе прочитанное из JSON
+	}
+	if level, ok := aps["interruption-level"]; ok {
+		if value, ok := level.(InterruptionLevel); ok {
+			level = string(value)
+		}
+		switch level {
+		case "passive", "active", "time-sensitive", "critical":
+		default:
+			return ErrInterruptionLevel
+		}
+	}
+	if score, ok := aps["relevance-score"]; ok {
+		if score, ok := toFloat(score); !ok || score < 0 || score > 1 {
+			return ErrRelevanceScore
+		}
+	}
+	if alert, ok := aps["alert"].(map[string]interface{}); ok {
+		for _, key := range []string{"loc-args", "title-loc-args"} {
+			if args, ok := alert[key]; ok && !isStringArray(args) {
+				return ErrLocArgs
+			}
+		}
+	}
+	return nil
+}
+
+// toFloat возвращает значение любого числового типа, в том числе прочитанное из JSON как json.Number,
+// в виде float64. Если значение не является числом, то возвращается false.
+func toFloat(value interface{}) (float64, bool) {
+	switch value := value.(type) {
+	case float64:
+		return value, true
+	case float32:
+		return float64(value), true
+	case int:
+		return float64(value), true
+	case int8:
+		return float64(value), true
+	case int16:
+		return float64(value), true
+	case int32:
+		return float64(value), true
+	case int64:
+		return float64(value), true
+	case uint:
+		return float64(value), true
+	case uint8:
+		return float64(value), true
+	case uint16:
+		return float64(value), true
+	case uint32:
+		return float64(value), true
+	case uint64:
+		return float64(value), true
+	case json.Number:
+		var result, err = value.Float64()
+		return result, err == nil
+	default:
+		return 0, false
+	}
+}
+
+// isStringArray возвращает true, если значение представляет собой массив строк, в том числе
+// прочитанный из JSON.
+func isStringArray(value interface{}) bool {
+	switch value := value.(type) {
+	case []string:
+		return true
+	case []interface{}:
+		for _, item := range value {
+			if _, ok := item.(string); !ok {
+				return false
+			}
+		}
+		return true
+	default:
+		return false
+	}
+}
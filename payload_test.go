@@ -0,0 +1,201 @@
+package apns
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestPayloadCommunication(t *testing.T) {
+	var payload = NewPayload().
+		Communication("thread-42").
+		InterruptionLevel(InterruptionTimeSensitive).
+		RelevanceScore(0.5)
+	payload.aps()["alert"] = map[string]interface{}{"title": "Alice", "body": "Hi!"}
+	ntf, err := (&Notification{Payload: payload}).convert()
+	if err != nil {
+		t.Fatal(err)
+	}
+	const expected = `{"aps":{"alert":{"body":"Hi!","title":"Alice"},` +
+		`"interruption-level":"time-sensitive","mutable-content":1,` +
+		`"relevance-score":0.5,"target-content-id":"thread-42"}}`
+	if string(ntf.Payload) != expected {
+		t.Errorf("bad payload:\n%s\nexpected:\n%s", ntf.Payload, expected)
+	}
+}
+
+func TestPayloadBuilder(t *testing.T) {
+	var payload = NewPayload().
+		Alert("Hello").
+		Badge(3).
+		Sound(DefaultSound).
+		ContentAvailable().
+		Category("MESSAGE").
+		Custom("thread", 42).
+		Custom("aps", "ignored")
+	ntf, err := (&Notification{Payload: payload}).convert()
+	if err != nil {
+		t.Fatal(err)
+	}
+	const expected = `{"aps":{"alert":"Hello","badge":3,"category":"MESSAGE",` +
+		`"content-available":1,"sound":"default"},"thread":42}`
+	if string(ntf.Payload) != expected {
+		t.Errorf("bad payload:\n%s\nexpected:\n%s", ntf.Payload, expected)
+	}
+}
+
+func TestPayloadLocalizedAlert(t *testing.T) {
+	var payload = NewPayload().LocalizedAlert(LocalizedAlert{
+		TitleLocKey:  "GAME_TITLE",
+		LocKey:       "GAME_PLAY_REQUEST_FORMAT",
+		LocArgs:      []string{"Jenna", "Frank"},
+		ActionLocKey: "PLAY",
+	})
+	ntf, err := (&Notification{Payload: payload}).convert()
+	if err != nil {
+		t.Fatal(err)
+	}
+	const expected = `{"aps":{"alert":{"title-loc-key":"GAME_TITLE",` +
+		`"loc-key":"GAME_PLAY_REQUEST_FORMAT","loc-args":["Jenna","Frank"],` +
+		`"action-loc-key":"PLAY"}}}`
+	if string(ntf.Payload) != expected {
+		t.Errorf("bad payload:\n%s\nexpected:\n%s", ntf.Payload, expected)
+	}
+	// словарь alert, прочитанный из JSON, проверяется на корректность аргументов
+	for data, expected := range map[string]error{
+		`{"payload":{"aps":{"alert":{"loc-key":"K","loc-args":["a","b"]}}}}`: nil,
+		`{"payload":{"aps":{"alert":{"loc-key":"K","loc-args":["a",1]}}}}`:   ErrLocArgs,
+		`{"payload":{"aps":{"alert":{"loc-key":"K","loc-args":"a"}}}}`:       ErrLocArgs,
+		`{"payload":{"aps":{"alert":{"title-loc-args":{"a":"b"}}}}}`:         ErrLocArgs,
+	} {
+		var ntf Notification
+		if err := json.Unmarshal([]byte(data), &ntf); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ntf.convert(); err != expected {
+			t.Errorf("%s: error %v, expected %v", data, err, expected)
+		}
+	}
+}
+
+func TestPayloadValidate(t *testing.T) {
+	// score возвращает содержимое с оценкой значимости произвольного типа
+	var score = func(value interface{}) Payload {
+		var payload = NewPayload().Alert("hi")
+		payload.aps()["relevance-score"] = value
+		return payload
+	}
+	var tests = []struct {
+		payload Payload
+		err     error
+	}{
+		{NewPayload().Communication("thread"), ErrAlertRequired},
+		{NewPayload().Communication(""), ErrTargetContentID},
+		{NewPayload().InterruptionLevel("loud"), ErrInterruptionLevel},
+		{NewPayload().RelevanceScore(1.5), ErrRelevanceScore},
+		{NewPayload().InterruptionLevel(InterruptionPassive).RelevanceScore(1), nil},
+		{score(1), nil}, // целое число
+		{score(uint8(0)), nil},
+		{score(2), ErrRelevanceScore},
+		{score(json.Number("0.25")), nil},
+		{score("0.5"), ErrRelevanceScore},
+	}
+	for i, test := range tests {
+		if _, err := (&Notification{Payload: test.payload}).convert(); err != test.err {
+			t.Errorf("%d: error %v, expected %v", i, err, test.err)
+		}
+	}
+	// значения, прочитанные из JSON, тоже должны проверяться
+	var ntf Notification
+	if err := json.Unmarshal([]byte(`{"payload":{"aps":{"alert":"hi",`+
+		`"interruption-level":"critical","relevance-score":0.1}}}`), &ntf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ntf.convert(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPayloadSound(t *testing.T) {
+	for sound, expected := range map[Sound]string{
+		DefaultSound:              `{"aps":{"sound":"default"}}`,
+		NamedSound("chime.aiff"):  `{"aps":{"sound":"chime.aiff"}}`,
+		NamedSound("Default.caf"): `{"aps":{"sound":"Default.caf"}}`,
+	} {
+		data, err := json.Marshal(NewPayload().Sound(sound))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != expected {
+			t.Errorf("bad payload %s, expected %s", data, expected)
+		}
+	}
+}
+
+func TestPayloadBadge(t *testing.T) {
+	var tests = []struct {
+		payload  Payload
+		expected string
+	}{
+		{NewPayload().Badge(3), `{"aps":{"badge":3}}`},
+		{NewPayload().ClearBadge(), `{"aps":{"badge":0}}`},
+		{NewPayload().NoBadgeChange(), `{}`},
+		{NewPayload().Badge(3).NoBadgeChange(), `{"aps":{}}`},
+		{NewPayload().Sound(DefaultSound).NoBadgeChange(), `{"aps":{"sound":"default"}}`},
+	}
+	for i, test := range tests {
+		data, err := json.Marshal(test.payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != test.expected {
+			t.Errorf("%d: bad payload %s, expected %s", i, data, test.expected)
+		}
+	}
+}
+
+func TestPayloadMutableContent(t *testing.T) {
+	var payload = NewPayload().Alert("Encrypted").ThreadID("chat-42").MutableContent()
+	ntf, err := (&Notification{Payload: payload}).convert()
+	if err != nil {
+		t.Fatal(err)
+	}
+	const expected = `{"aps":{"alert":"Encrypted","mutable-content":1,"thread-id":"chat-42"}}`
+	if string(ntf.Payload) != expected {
+		t.Errorf("bad payload:\n%s\nexpected:\n%s", ntf.Payload, expected)
+	}
+	// значение, прочитанное из JSON, тоже допустимо
+	var parsed Payload
+	if err := json.Unmarshal([]byte(expected), &parsed); err != nil {
+		t.Fatal(err)
+	}
+	if err := parsed.validate(); err != nil {
+		t.Errorf("parsed payload: %v", err)
+	}
+	for _, value := range []interface{}{true, 0, 2, "1"} {
+		payload.aps()["mutable-content"] = value
+		if _, err := (&Notification{Payload: payload}).convert(); err != ErrMutableContent {
+			t.Errorf("mutable-content %#v: error %v", value, err)
+		}
+	}
+}
+
+func TestPayloadTitledAlert(t *testing.T) {
+	for _, test := range []struct {
+		title, subtitle, body string
+		expected              string
+	}{
+		{"", "", "Hello", `{"aps":{"alert":"Hello"}}`},
+		{"Game", "", "Your turn", `{"aps":{"alert":{"body":"Your turn","title":"Game"}}}`},
+		{"Game", "Round 2", "Your turn",
+			`{"aps":{"alert":{"body":"Your turn","subtitle":"Round 2","title":"Game"}}}`},
+	} {
+		var payload = NewPayload().TitledAlert(test.title, test.subtitle, test.body)
+		ntf, err := (&Notification{Payload: payload}).convert()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(ntf.Payload) != test.expected {
+			t.Errorf("bad payload:\n%s\nexpected:\n%s", ntf.Payload, test.expected)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package apns
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"sync"
+)
+
+// queueStore описывает файл, в котором сохраняются еще не отправленные уведомления из очереди,
+// чтобы после аварийного завершения программы их можно было отправить повторно.
+//
+// Файл только дописывается: при помещении в очередь уведомления записываются в нем в формате
+// фрейма бинарного протокола, а после отправки на сервер для каждого из них дописывается отметка
+// об отправке с его идентификатором. Когда все записанные уведомления отправлены, файл очищается, а
+// если отправленные уведомления и отметки об их отправке накапливаются быстрее (очередь никогда не
+// пустеет), то после storeCompactRecords таких записей файл перезаписывается заново только с
+// неотправленными уведомлениями.
+// Данные не синхронизируются с диском принудительно, поэтому они переживают аварийное завершение
+// программы, но не обязательно сбой операционной системы.
+type queueStore struct {
+	file    *os.File            // файл с сохраненными уведомлениями
+	path    string              // путь к файлу
+	pending map[uint32]struct{} // идентификаторы записанных, но еще не отправленных уведомлений
+	list    []*notification     // записанные в файл уведомления в порядке записи
+	dead    int                 // количество записей отправленных уведомлений и отметок об отправке
+	compact int                 // количество таких записей, после которого файл перезаписывается
+	log     Logger              // лог для вывода ошибок записи
+	mu      sync.Mutex          // блокировка одновременной записи
+}
+
+// storeSent описывает команду отметки об отправке уведомления в файле очереди.
+const storeSent uint8 = 0
+
+// storeCompactRecords описывает количество записей об уже отправленных уведомлениях в файле
+// очереди, после которого файл перезаписывается только с неотправленными уведомлениями.
+const storeCompactRecords = 10000
+
+// openQueueStore открывает файл для сохранения очереди уведомлений, создавая его, если он не
+// существует, и возвращает все уведомления, которые были в нем сохранены, но так и не были
+// отправлены. Устаревшие уведомления пропускаются, а оборванная при аварийном завершении запись
+// в конце файла игнорируется. После чтения файл очищается: возвращенные уведомления нужно снова
+// поместить в очередь, чтобы они были записаны заново.
+func openQueueStore(path string, log Logger) (*queueStore, []*notification, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+	list, err := readQueueStore(bufio.NewReader(file))
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	if err = file.Truncate(0); err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	var store = &queueStore{
+		file:    file,
+		path:    path,
+		pending: make(map[uint32]struct{}),
+		compact: storeCompactRecords,
+		log:     log,
+	}
+	return store, list, nil
+}
+
+// readQueueStore читает из потока сохраненные уведомления и возвращает те из них, для которых нет
+// отметки об отправке, в порядке их записи.
+func readQueueStore(r io.Reader) ([]*notification, error) {
+	var (
+		list   []*notification
+		sent   = make(map[uint32]bool)
+		header = make([]byte, 5)
+	)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break // файл закончился или оборван посреди записи
+			}
+			return nil, err
+		}
+		var value = binary.BigEndian.Uint32(header[1:])
+		if header[0] == storeSent {
+			sent[value] = true
+			continue
+		}
+		var frame = make([]byte, value)
+		if _, err := io.ReadFull(r, frame); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			return nil, err
+		}
+		if ntf := decodeFrameItems(frame); ntf != nil {
+			list = append(list, ntf)
+		}
+	}
+	var result = list[:0]
+	for _, ntf := range list {
+		if !sent[ntf.ID] && !ntf.IsExpired() {
+			result = append(result, ntf)
+		}
+	}
+	return result, nil
+}
+
+// Append дописывает уведомления в файл.
+func (s *queueStore) Append(list []*notification) {
+	var buf bytes.Buffer
+	for _, ntf := range list {
+		ntf.WriteTo(&buf)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return // файл уже закрыт
+	}
+	if _, err := s.file.Write(buf.Bytes()); err != nil {
+		s.log.Println("Queue store error:", err)
+		return
+	}
+	for _, ntf := range list {
+		s.pending[ntf.ID] = struct{}{}
+	}
+	s.list = append(s.list, list...)
+}
+
+// Sent дописывает в файл отметки об отправке уведомлений. Если после этого в файле не осталось
+// неотправленных уведомлений, то он очищается, а если накопилось слишком много записей об уже
+// отправленных уведомлениях, то перезаписывается.
+func (s *queueStore) Sent(list []*notification) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return // файл уже закрыт
+	}
+	var buf bytes.Buffer
+	for _, ntf := range list {
+		if _, ok := s.pending[ntf.ID]; !ok {
+			continue // отметка уже записана при предыдущей отправке
+		}
+		delete(s.pending, ntf.ID)
+		buf.WriteByte(storeSent)
+		binary.Write(&buf, binary.BigEndian, ntf.ID)
+		s.dead += 2 // само уведомление и отметка о его отправке
+	}
+	var err error
+	switch {
+	case len(s.pending) == 0:
+		if err = s.file.Truncate(0); err == nil {
+			_, err = s.file.Seek(0, io.SeekStart)
+		}
+		s.list, s.dead = nil, 0
+	case s.dead >= s.compact:
+		s.dead = 0 // при ошибке перезапись повторяется после накопления новых записей
+		if err = s.rewrite(); err != nil {
+			s.log.Println("Queue store error:", err)
+			_, err = s.file.Write(buf.Bytes()) // отметки нужны в старом файле
+		}
+	case buf.Len() > 0:
+		_, err = s.file.Write(buf.Bytes())
+	}
+	if err != nil {
+		s.log.Println("Queue store error:", err)
+	}
+}
+
+// rewrite перезаписывает файл, оставляя в нем только неотправленные уведомления. Новый файл сначала
+// записывается под временным именем и только потом заменяет старый, поэтому при аварийном
+// завершении во время перезаписи сохраненные уведомления не теряются. Вызывается под блокировкой.
+func (s *queueStore) rewrite() error {
+	var (
+		buf  bytes.Buffer
+		live = s.list[:0]
+	)
+	for _, ntf := range s.list {
+		if _, ok := s.pending[ntf.ID]; ok {
+			live = append(live, ntf)
+			ntf.WriteTo(&buf)
+		}
+	}
+	for i := len(live); i < len(s.list); i++ {
+		s.list[i] = nil // освобождаем отправленные уведомления для сборщика мусора
+	}
+	s.list = live
+	var tmpPath = s.path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(buf.Bytes()); err == nil {
+		err = os.Rename(tmpPath, s.path)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	s.file.Close()
+	s.file = file
+	return nil
+}
+
+// Close закрывает файл. Неотправленные уведомления остаются в нем и будут прочитаны при следующем
+// открытии.
+func (s *queueStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	var err = s.file.Close()
+	s.file = nil
+	return err
+}
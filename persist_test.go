@@ -0,0 +1,154 @@
+package apns
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestClientPersistQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var (
+		config = &Config{PersistPath: filepath.Join(dir, "queue")}
+		tokens = testTokens(3)
+		ntf    = &Notification{Payload: NewPayload().Alert("test"), Priority: 5}
+	)
+
+	// первый клиент помещает уведомления в очередь, но завершается, не успев их отправить
+	client := newOfflineClient(t, config)
+	if err := client.Send(ntf, tokens...); err != nil {
+		t.Fatal(err)
+	}
+	client.Close(false)
+
+	// после перезапуска уведомления восстанавливаются и отправляются
+	client, err = NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := client.Pending(); n != len(tokens) {
+		t.Fatalf("%d messages restored, expected %d", n, len(tokens))
+	}
+	var conns = make(chan net.Conn, 1)
+	client.dialFunc = func(addr string) (net.Conn, error) {
+		clientConn, serverConn := net.Pipe()
+		conns <- serverConn
+		return clientConn, nil
+	}
+	client.ManualSend = true
+	var done = make(chan error, 1)
+	go func() { done <- client.DrainOnce() }()
+	var server = <-conns
+	for i, token := range tokens {
+		frame, err := readFrame(server)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ntf := decodeFrameItems(frame[5:])
+		if ntf == nil || ntf.TokenString() != token || ntf.ID != uint32(i+1) || ntf.Priority != 5 ||
+			string(ntf.Payload) != `{"aps":{"alert":"test"}}` {
+			t.Errorf("bad restored frame %x", frame)
+		}
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	// новые уведомления получают следующие идентификаторы
+	client.queue.AddNotification(ntf, testTokens(4)[3])
+	if last := client.queue.list[len(client.queue.list)-1]; last.ID != 4 {
+		t.Errorf("new message id %d, expected 4", last.ID)
+	}
+	client.Close(false)
+	server.Close()
+
+	// отправленные уведомления повторно не восстанавливаются, а неотправленное — восстанавливается
+	client = newOfflineClient(t, config)
+	defer client.Close(false)
+	if n := client.Pending(); n != 1 {
+		t.Errorf("%d messages restored after send, expected 1", n)
+	}
+}
+
+func TestQueueStoreTruncated(t *testing.T) {
+	var (
+		buf    bytes.Buffer
+		ntf    = &notification{ID: 1, Token: bytes.Repeat([]byte{1}, 32), Payload: []byte(`{}`)}
+		second = &notification{ID: 2, Token: bytes.Repeat([]byte{2}, 32), Payload: []byte(`{}`)}
+		old    = &notification{ID: 3, Token: bytes.Repeat([]byte{3}, 32), Payload: []byte(`{}`),
+			Expiration: uint32(time.Now().Add(-time.Hour).Unix())}
+	)
+	for _, ntf := range []*notification{ntf, old, second} {
+		ntf.WriteTo(&buf)
+	}
+	buf.Write([]byte{storeSent, 0, 0, 0, 2}) // второе уведомление отправлено
+	ntf.WriteTo(&buf)
+	buf.Truncate(buf.Len() - 5) // запись оборвана при аварийном завершении
+	list, err := readQueueStore(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].ID != 1 || !bytes.Equal(list[0].Token, ntf.Token) {
+		t.Errorf("bad restored list %v", list)
+	}
+}
+
+func TestQueueStoreCompact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var path = filepath.Join(dir, "queue")
+	store, _, err := openQueueStore(path, log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	store.compact = 4
+	var list []*notification
+	for i := 1; i <= 5; i++ {
+		list = append(list, &notification{ID: uint32(i), Token: bytes.Repeat([]byte{byte(i)}, 32),
+			Payload: []byte(`{}`)})
+	}
+	store.Append(list)
+	store.Sent(list[:1]) // две записи об отправленном уведомлении: файл только дописывается
+	var frameSize = list[0].Len()
+	if info, err := os.Stat(path); err != nil || info.Size() != int64(5*frameSize+5) {
+		t.Fatalf("file size before compaction %v (%v)", info.Size(), err)
+	}
+	store.Sent(list[2:3]) // четыре записи: файл перезаписывается
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != int64(3*frameSize) {
+		t.Errorf("file size after compaction %d, expected %d", info.Size(), 3*frameSize)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary file is left: %v", err)
+	}
+	// запись продолжается в новый файл
+	store.Sent(list[3:4])
+	store.Close()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	restored, err := readQueueStore(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(restored) != 2 || restored[0].ID != 2 || restored[1].ID != 5 {
+		t.Errorf("bad restored list %v", restored)
+	}
+}
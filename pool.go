@@ -8,18 +8,24 @@ import (
 // Пул байтовых буферов
 var pool sync.Pool
 
-// getBuffer возвращает пустой буфер байтов.
+// getBuffer возвращает пустой буфер байтов. Новый буфер сразу создается размером MaxFrameBuffer,
+// чтобы при заполнении фрейма уведомлениями память не выделялась повторно.
 func getBuffer() (buf *bytes.Buffer) {
 	if b := pool.Get(); b != nil {
 		buf = b.(*bytes.Buffer)
 		buf.Reset()
 	} else {
-		buf = new(bytes.Buffer)
+		buf = bytes.NewBuffer(make([]byte, 0, MaxFrameBuffer))
 	}
 	return buf
 }
 
-// putBuffer возвращает байтовый буфер в пул буферов.
+// putBuffer возвращает байтовый буфер в пул буферов. Буферы, выросшие сверх MaxFrameBuffer
+// (например, при сериализации большого количества уведомлений), в пул не возвращаются, чтобы
+// не удерживать лишнюю память.
 func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > 2*MaxFrameBuffer {
+		return
+	}
 	pool.Put(buf)
 }
@@ -0,0 +1,85 @@
+// Package prom предоставляет коллектор метрик клиента APNS для Prometheus.
+//
+// Коллектор вынесен в отдельный пакет, чтобы основной пакет apns не зависел от библиотеки
+// Prometheus: она нужна только тем, кто импортирует этот пакет.
+package prom
+
+import (
+	"strconv"
+
+	"github.com/mdigger/apns"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Collector описывает коллектор метрик клиента APNS. Значения метрик при каждом сборе читаются из
+// apns.Client.Stats, поэтому коллектор не хранит собственного состояния.
+type Collector struct {
+	client     *apns.Client
+	sent       *prometheus.Desc
+	errors     *prometheus.Desc
+	requeued   *prometheus.Desc
+	reconnects *prometheus.Desc
+	blocked    *prometheus.Desc
+	mismatched *prometheus.Desc
+	dropped    *prometheus.Desc
+	pending    *prometheus.Desc
+	scheduled  *prometheus.Desc
+	connected  *prometheus.Desc
+}
+
+// NewCollector возвращает коллектор метрик указанного клиента. Переданные метки добавляются ко
+// всем метрикам: они позволяют зарегистрировать коллекторы нескольких клиентов, например, для
+// разных приложений или окружений APNS. Метки могут быть nil.
+func NewCollector(client *apns.Client, labels prometheus.Labels) *Collector {
+	var desc = func(name, help string, variable ...string) *prometheus.Desc {
+		return prometheus.NewDesc("apns_"+name, help, variable, labels)
+	}
+	return &Collector{
+		client:     client,
+		sent:       desc("sent_total", "Notifications written to the APNS server, including resends."),
+		errors:     desc("errors_total", "Notifications rejected by the APNS server.", "status"),
+		requeued:   desc("requeued_total", "Notifications returned to the queue to be sent again."),
+		reconnects: desc("reconnects_total", "Reconnections to the APNS server."),
+		blocked:    desc("blocked_total", "Notifications skipped because of the token blocklist."),
+		mismatched: desc("mismatched_total", "Notifications skipped because of the token environment."),
+		dropped:    desc("results_dropped_total", "Send results dropped because the results channel was full."),
+		pending:    desc("pending", "Notifications waiting in the queue to be sent."),
+		scheduled:  desc("scheduled", "Notifications delayed until their send time."),
+		connected:  desc("connected", "Whether the client is connected to the APNS server."),
+	}
+}
+
+// Describe передает описания всех метрик коллектора.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{c.sent, c.errors, c.requeued, c.reconnects,
+		c.blocked, c.mismatched, c.dropped, c.pending, c.scheduled, c.connected} {
+		ch <- desc
+	}
+}
+
+// Collect передает текущие значения метрик клиента.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	var stats = c.client.Stats()
+	var counter = func(desc *prometheus.Desc, value uint64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, float64(value), labels...)
+	}
+	var gauge = func(desc *prometheus.Desc, value int) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, float64(value))
+	}
+	counter(c.sent, stats.Sent)
+	for status, count := range stats.ErrorsByStatus {
+		counter(c.errors, count, strconv.Itoa(int(status)))
+	}
+	counter(c.requeued, stats.Requeued)
+	counter(c.reconnects, stats.Reconnects)
+	counter(c.blocked, stats.Blocked)
+	counter(c.mismatched, stats.Mismatched)
+	counter(c.dropped, stats.ResultsDropped)
+	gauge(c.pending, stats.Pending)
+	gauge(c.scheduled, stats.Scheduled)
+	var connected int
+	if stats.Connected {
+		connected = 1
+	}
+	gauge(c.connected, connected)
+}
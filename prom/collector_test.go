@@ -0,0 +1,50 @@
+package prom
+
+import (
+	"testing"
+
+	"github.com/mdigger/apns"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestCollector(t *testing.T) {
+	client, err := apns.NewClient(new(apns.Config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close(false)
+	client.ManualSend = true // уведомления остаются в очереди
+	var ntf = &apns.Notification{Payload: apns.NewPayload().Alert("test")}
+	if err := client.Send(ntf, "f389410ae1b57972dbbf6eb0c05c2626ab69ede88f523d7eed49fa6e63a6c266"); err != nil {
+		t.Fatal(err)
+	}
+
+	var registry = prometheus.NewRegistry()
+	if err := registry.Register(NewCollector(client, prometheus.Labels{"app": "test"})); err != nil {
+		t.Fatal(err)
+	}
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var values = make(map[string]float64)
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			if labels := metric.GetLabel(); len(labels) == 0 || labels[0].GetValue() != "test" {
+				t.Errorf("%s: bad labels %v", family.GetName(), labels)
+			}
+			switch {
+			case metric.Counter != nil:
+				values[family.GetName()] = metric.GetCounter().GetValue()
+			case metric.Gauge != nil:
+				values[family.GetName()] = metric.GetGauge().GetValue()
+			}
+		}
+	}
+	if values["apns_pending"] != 1 || values["apns_sent_total"] != 0 || values["apns_connected"] != 0 {
+		t.Errorf("bad values %v", values)
+	}
+	if _, ok := values["apns_reconnects_total"]; !ok {
+		t.Error("reconnects counter is not collected")
+	}
+}
@@ -0,0 +1,27 @@
+package prom_test
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/mdigger/apns"
+	"github.com/mdigger/apns/prom"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+func ExampleNewCollector() {
+	config, err := apns.LoadConfig("config.json")
+	if err != nil {
+		log.Fatal(err)
+	}
+	client, err := apns.NewClient(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer client.Close(true)
+	// метки позволяют различать клиенты разных приложений
+	prometheus.MustRegister(prom.NewCollector(client, prometheus.Labels{"topic": config.BundleID}))
+	http.Handle("/metrics", promhttp.Handler())
+	log.Fatal(http.ListenAndServe(":9090", nil))
+}
@@ -1,36 +1,55 @@
 package apns
 
 import (
-	"encoding/hex"
 	"io"
 	"sync"
 	"time"
 )
 
 // notificationQueue описывает очередь сообщений на отправку. Уже отправленные уведомления так же хранятся
-// в этой очереди и периодически очищаются от тех, чье время кеширования истекло.
+// в этой очереди и периодически очищаются от тех, чье время кеширования истекло. Количество хранящихся
+// отправленных уведомлений, кроме того, не превышает размера кеша.
 type notificationQueue struct {
 	list       []*notification // список элементов
 	counter    uint32          // счетчик
 	idUnsended int             // индекс первого еще не отосланного уведомления
+	size       int             // размер кеша отправленных уведомлений
+	done       chan struct{}   // канал, закрываемый для остановки очистки кеша
+	store      *queueStore     // файл для сохранения неотправленных уведомлений (не обязателен)
+	scheduled  []*notification // уведомления, время отправки которых еще не наступило
+	timer      *time.Timer     // таймер перемещения запланированных уведомлений в очередь
+	wake       time.Time       // время срабатывания таймера
+	ready      func()          // функция, вызываемая после перемещения уведомлений в очередь
+	ids        map[uint32]bool // идентификаторы уведомлений в очереди, в кеше и среди отложенных
+	inflight   *notification   // первое полученное Get уведомление, еще не записанное на сервер
 	mu         sync.RWMutex    // блокировка асинхронного доступа
 }
 
 // newNotificationQueue возвращает новый инициализированную очередь на отправку и, одновременно, кеш уже
-// отправленных уведомлений. С этим интервалом CacheLifeTime данный список проверяется и из него автоматически
-// удаляются все отправленные сообщения, старше этого интервала.
-func newNotificationQueue() *notificationQueue {
+// отправленных уведомлений указанного размера. С интервалом cacheLifeTime данный список проверяется и из него
+// автоматически удаляются все отправленные сообщения, старше этого интервала. Проверка прекращается после
+// вызова Close.
+func newNotificationQueue(size int, cacheLifeTime time.Duration) *notificationQueue {
 	var q = &notificationQueue{
-		list: make([]*notification, 0, NotificationCacheSize),
+		list: make([]*notification, 0, size),
+		size: size,
+		done: make(chan struct{}),
+		ids:  make(map[uint32]bool, size),
 	}
 	go func() {
-	loop:
 		for { // бесконечный цикл проверки и очистки кеша
-			time.Sleep(CacheLifeTime)                     // спим заданное количество времени
-			var lifeTime = time.Now().Add(-CacheLifeTime) // время создания, после которого уведомления устарели
-			q.mu.RLock()
-			// перебираем все отправленные в обратном порядке, но только если первое не является отправленным
-			for i := q.idUnsended; i > 0; i-- {
+			select { // спим заданное количество времени
+			case <-time.After(cacheLifeTime):
+			case <-q.done:
+				return // очередь закрыта
+			}
+			var lifeTime = time.Now().Add(-cacheLifeTime) // время создания, после которого уведомления устарели
+			// поиск и удаление выполняются под одной блокировкой: иначе между ними Get или
+			// ResendFromID могли бы изменить список, и найденный индекс указывал бы не туда
+			q.mu.Lock()
+			// перебираем все отправленные в обратном порядке, но только если первое не является отправленным;
+			// уведомления, еще не записанные на сервер, не удаляются
+			for i := q.sentCount(); i > 0; i-- {
 				// список всегда упорядочен по дате, поэтому достаточно найти первое вхождение
 				// элемента, который уже "просрочен", а остальные - игнорировать
 				if q.list[i-1].Sended.After(lifeTime) {
@@ -38,24 +57,101 @@ func newNotificationQueue() *notificationQueue {
 				}
 				// мы нашли первое устаревшее уведомление, перебирая с конца
 				// значит все остальные перед ним тоже устаревшие
-				q.mu.RUnlock()
-				q.mu.Lock()
-				q.list = q.list[i:] // сохраняем очищенный список
-				q.idUnsended -= i   // сдвигаем индекс последнего отосланного уведомления на кол-во удаленных
-				q.mu.Unlock()
-				continue loop // все обработано - уходим на глобальный повтор
+				q.cut(i)          // сохраняем очищенный список
+				q.idUnsended -= i // сдвигаем индекс последнего отосланного уведомления на кол-во удаленных
+				break
 			}
-			q.mu.RUnlock()
+			q.mu.Unlock()
 		}
 	}()
 	return q
 }
 
+// Close останавливает периодическую очистку кеша отправленных уведомлений и закрывает файл
+// сохранения очереди, если он используется. Повторно вызывать Close нельзя.
+func (q *notificationQueue) Close() {
+	close(q.done)
+	q.mu.Lock()
+	if q.timer != nil {
+		q.timer.Stop()
+	}
+	q.mu.Unlock()
+	if q.store != nil {
+		q.store.Close()
+	}
+}
+
+// restore подключает к очереди файл для сохранения неотправленных уведомлений и помещает в очередь
+// уведомления, прочитанные из него, сохраняя их идентификаторы. Вызывается до начала работы с
+// очередью.
+func (q *notificationQueue) restore(store *queueStore, list []*notification) {
+	q.store = store
+	for _, ntf := range list {
+		if ntf.ID > q.counter {
+			q.counter = ntf.ID // новые идентификаторы не должны совпадать с восстановленными
+		}
+	}
+	q.Put(list...)
+}
+
+// MarkSent отмечает уведомления как отправленные на сервер, чтобы они не были отправлены повторно
+// после перезапуска программы. Без файла сохранения очереди ничего не делает.
+//
+// Уведомления, полученные с помощью Get, считаются записанными на сервер только после MarkSent:
+// до этого они не удаляются из кеша, чтобы при ошибке записи их можно было вернуть в очередь.
+// Поэтому кеш отправленных уведомлений сокращается до своего размера только здесь.
+func (q *notificationQueue) MarkSent(list ...*notification) {
+	if q.store != nil {
+		q.store.Sent(list)
+	}
+	if len(list) == 0 {
+		return
+	}
+	q.mu.Lock()
+	for _, ntf := range list {
+		if ntf != q.inflight {
+			continue
+		}
+		// записанными на сервер становятся все уведомления до последнего из переданных, а
+		// полученные после него остаются незаписанными
+		q.inflight = nil
+		var last = list[len(list)-1]
+		for i := q.idUnsended - 1; i >= 0; i-- {
+			if q.list[i] == last {
+				if i+1 < q.idUnsended {
+					q.inflight = q.list[i+1]
+				}
+				break
+			}
+		}
+		break
+	}
+	q.trim()
+	q.mu.Unlock()
+}
+
+// sentCount возвращает количество уведомлений в начале списка, которые уже записаны на сервер,
+// то есть предшествуют первому уведомлению, полученному с помощью Get, но еще не отмеченному
+// MarkSent. Вызывается под блокировкой.
+func (q *notificationQueue) sentCount() int {
+	if q.inflight == nil {
+		return q.idUnsended
+	}
+	for i := q.idUnsended - 1; i >= 0; i-- {
+		if q.list[i] == q.inflight {
+			return i
+		}
+	}
+	q.inflight = nil // уведомление уже удалено из списка (ResendFromID)
+	return q.idUnsended
+}
+
 // AddNotification генерирует и добавляет в очередь новое уведомление для каждого токена устройства,
 // переданного в параметрах. В качестве шаблона используется сообщение в формате Notification.
 // Если Notification содержит некорректные данные для уведомления, то возвращается ошибка и ни одного
-// сообщения при этом в очередь добавлено не будет. Также проверяется длина токена устройства:
-// если она не соответствует 32 байтам, то такие токены просто молча игнорируются.
+// сообщения при этом в очередь добавлено не будет. Если уведомление не помещается во фрейм размером
+// MaxFrameBuffer, то возвращается ошибка ErrNotificationTooLarge. Также проверяется длина токена
+// устройства: пустые токены и токены длиннее MaxTokenSize просто молча игнорируются.
 func (q *notificationQueue) AddNotification(ntf *Notification, tokens ...string) error {
 	if len(tokens) == 0 {
 		return nil
@@ -64,22 +160,102 @@ func (q *notificationQueue) AddNotification(ntf *Notification, tokens ...string)
 	if err != nil {
 		return err
 	}
-	q.mu.Lock()
+	if !fitsFrame(template, maxTokenLen(tokens)) {
+		return ErrNotificationTooLarge
+	}
+	_, err = q.add(template, tokens, nil)
+	return err
+}
+
+// AddNotificationStrict работает аналогично AddNotification, но возвращает список токенов
+// устройств, отклоненных из-за неверного формата, с указанием причины. Уведомления для остальных
+// токенов при этом добавляются в очередь.
+func (q *notificationQueue) AddNotificationStrict(ntf *Notification, tokens ...string) ([]TokenError, error) {
+	template, err := ntf.convert() // конвертируем сообщение во внутреннее представление
+	if err != nil {
+		return nil, err
+	}
+	valid, rejected := rejectTokens(tokens)
+	if !fitsFrame(template, maxTokenLen(valid)) {
+		return nil, ErrNotificationTooLarge
+	}
+	if _, err = q.add(template, valid, nil); err != nil {
+		return nil, err
+	}
+	return rejected, nil
+}
+
+// AddNotificationBytes работает аналогично AddNotification, но принимает токены устройств в бинарном
+// виде и не тратит время на их декодирование. Токены недопустимого размера молча игнорируются.
+// Переданные токены не копируются, поэтому их нельзя изменять после вызова.
+func (q *notificationQueue) AddNotificationBytes(ntf *Notification, tokens ...[]byte) error {
+	if len(tokens) == 0 {
+		return nil
+	}
+	template, err := ntf.convert() // конвертируем сообщение во внутреннее представление
+	if err != nil {
+		return err
+	}
+	var longest int
 	for _, token := range tokens {
-		btoken, err := hex.DecodeString(token)
+		if len(token) > longest {
+			longest = len(token)
+		}
+	}
+	if !fitsFrame(template, longest) {
+		return ErrNotificationTooLarge
+	}
+	_, err = q.addBytes(template, tokens, nil)
+	return err
+}
+
+// add добавляет в очередь копию уведомления для каждого токена устройства, переданного в параметрах,
+// и возвращает идентификаторы добавленных уведомлений в порядке следования токенов. Токены устройств
+// с неверным форматом или размером молча игнорируются, а вместо идентификатора для них возвращается 0.
+// Если задана функция проверки токенов, то токены, для которых она вернула false, так же пропускаются.
+//
+// Если у шаблона задан идентификатор (Notification.ID), то он сохраняется: в этом случае
+// уведомление может быть добавлено только для одного токена, иначе возвращается ошибка
+// ErrIDMultipleTokens, а если идентификатор уже используется — ErrDuplicateID. При ошибке ни одного
+// уведомления в очередь не добавляется.
+func (q *notificationQueue) add(template *notification, tokens []string, check func([]byte) bool) ([]uint32, error) {
+	var btokens = make([][]byte, len(tokens))
+	for i, token := range tokens {
+		btoken, err := decodeToken(token)
 		if err != nil {
-			continue // игнорируем неверные токены устройств
+			continue // игнорируем неверные токены устройств: пустой токен будет пропущен
 		}
-		if len(btoken) != 32 {
-			continue // игнорируем токены устройств с неверным размером
+		btokens[i] = btoken
+	}
+	return q.addBytes(template, btokens, check)
+}
+
+// addBytes работает аналогично add, но принимает токены устройств в бинарном виде.
+func (q *notificationQueue) addBytes(template *notification, tokens [][]byte, check func([]byte) bool) ([]uint32, error) {
+	var list = make([]*notification, 0, len(tokens))
+	var index = make([]int, 0, len(tokens)) // индексы токенов добавленных уведомлений
+	for i, token := range tokens {
+		if !validTokenSize(len(token)) {
+			continue // игнорируем токены неверного размера
+		}
+		if check != nil && !check(token) {
+			continue // игнорируем токены, не прошедшие проверку
 		}
-		var item = template.WithToken(btoken) // добавляем токен
-		q.counter++
-		item.ID = q.counter           // присваиваем уникальный идентификатор
-		q.list = append(q.list, item) // помещаем в список на отправку
+		list = append(list, template.WithToken(token)) // добавляем токен
+		index = append(index, i)
 	}
-	q.mu.Unlock()
-	return nil
+	if template.ID != 0 && len(list) > 1 {
+		return nil, ErrIDMultipleTokens
+	}
+	// помещаем в список на отправку с присвоением идентификаторов
+	if rejected := q.Put(list...); len(rejected) > 0 {
+		return nil, ErrDuplicateID
+	}
+	var ids = make([]uint32, len(tokens))
+	for i, ntf := range list {
+		ids[index[i]] = ntf.ID
+	}
+	return ids, nil
 }
 
 // IsHasToSend возвращает true, если в списке есть неотправленные уведомления.
@@ -90,18 +266,161 @@ func (q *notificationQueue) IsHasToSend() bool {
 	return result
 }
 
+// Unconfirmed возвращает количество отправленных уведомлений, которые еще не могут считаться
+// доставленными, т.к. с момента их отправки прошло меньше TimeoutDelivered.
+func (q *notificationQueue) Unconfirmed() int {
+	var (
+		since = time.Now().Add(-TimeoutDelivered)
+		count int
+	)
+	q.mu.RLock()
+	// список упорядочен по времени отправки, поэтому перебираем с конца до первого доставленного
+	for i := q.idUnsended; i > 0 && q.list[i-1].Sended.After(since); i-- {
+		count++
+	}
+	q.mu.RUnlock()
+	return count
+}
+
+// PendingCount возвращает количество еще не отправленных уведомлений в очереди.
+func (q *notificationQueue) PendingCount() int {
+	q.mu.RLock()
+	var result = len(q.list) - q.idUnsended
+	q.mu.RUnlock()
+	return result
+}
+
+// Requeue возвращает в очередь на отправку уже отправленное уведомление с указанным идентификатором
+// и все уведомления, отправленные после него. В отличие от ResendFromID, уведомления, отправленные
+// до него, остаются в кеше. Возвращает количество уведомлений, возвращенных в очередь, или 0, если
+// уведомление с таким идентификатором не найдено.
+func (q *notificationQueue) Requeue(id uint32) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i := q.idUnsended - 1; i >= 0; i-- { // скорее всего, уведомление отправлено недавно
+		if q.list[i].ID == id {
+			var count = q.idUnsended - i
+			q.idUnsended = i
+			q.inflight = nil // возвращенные уведомления снова не отправлены
+			return count
+		}
+	}
+	return 0
+}
+
+// Find возвращает уже отправленное уведомление с указанным идентификатором или nil, если такого
+// уведомления нет в кеше.
+func (q *notificationQueue) Find(id uint32) *notification {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	for i := q.idUnsended - 1; i >= 0; i-- {
+		if q.list[i].ID == id {
+			return q.list[i]
+		}
+	}
+	return nil
+}
+
+// Confirm удаляет из кеша отправленные уведомления, отправленные не позже since, и возвращает их в
+// порядке отправки. Удаляются только уведомления из начала списка: уведомления, повторно
+// отправленные после ошибки, находятся в нем после отправленных раньше них.
+func (q *notificationQueue) Confirm(since time.Time) []*notification {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var i, sent = 0, q.sentCount()
+	for i < sent && !q.list[i].Sended.After(since) {
+		i++
+	}
+	if i == 0 {
+		return nil
+	}
+	var result = append([]*notification(nil), q.list[:i]...)
+	q.cut(i)
+	q.idUnsended -= i
+	return result
+}
+
 // Put добавляет новые элементы в очередь на отправку. При добавлении автоматически назначается уникальный
-// идентификатор, если он не был назначен до этого.
-func (q *notificationQueue) Put(list ...*notification) {
+// идентификатор, если он не был назначен до этого, и запоминается время помещения в очередь. Уведомления,
+// время отправки которых (NotBefore) еще не наступило, откладываются и помещаются в очередь позже.
+//
+// Уже назначенный идентификатор сохраняется, но только если он не совпадает с идентификатором другого
+// уведомления в очереди, в кеше отправленных или среди отложенных. Уведомления с совпадающими
+// идентификаторами в очередь не добавляются и возвращаются в ответ. Автоматически назначаемые
+// идентификаторы пропускают значения, уже занятые такими уведомлениями.
+func (q *notificationQueue) Put(list ...*notification) (rejected []*notification) {
+	var (
+		now       = time.Now()
+		scheduled bool   // флаг наличия отложенных уведомлений
+		accepted  = list // уведомления, помещаемые в очередь
+	)
 	q.mu.Lock()
+	for i, item := range list {
+		if item.ID != 0 { // проверяем, что заданный идентификатор еще не используется
+			if q.ids[item.ID] {
+				if rejected == nil { // переданный список не изменяется
+					accepted = append([]*notification(nil), list[:i]...)
+				}
+				rejected = append(rejected, item)
+				continue
+			}
+			q.ids[item.ID] = true
+		}
+		if rejected != nil {
+			accepted = append(accepted, item)
+		}
+	}
+	list = accepted
 	for _, item := range list {
 		if item.ID == 0 {
-			q.counter++
-			item.ID = q.counter
+			item.ID = q.nextID()
+			q.ids[item.ID] = true
+		}
+		item.Enqueued = now
+		scheduled = scheduled || item.NotBefore.After(now)
+	}
+	if scheduled { // откладываем уведомления, время отправки которых еще не наступило
+		var ready = make([]*notification, 0, len(list))
+		for _, item := range list {
+			if item.NotBefore.After(now) {
+				q.schedule(item)
+			} else {
+				ready = append(ready, item)
+			}
 		}
+		list = ready
+		q.arm()
 	}
 	q.list = append(q.list, list...)
+	if q.store != nil && len(list) > 0 {
+		// записываем под блокировкой, чтобы уведомления не были отправлены раньше, чем сохранены
+		q.store.Append(list)
+	}
 	q.mu.Unlock()
+	return rejected
+}
+
+// nextID возвращает следующий свободный идентификатор для автоматического назначения уведомлению.
+// Вызывается под блокировкой.
+func (q *notificationQueue) nextID() uint32 {
+	for {
+		if q.counter++; q.counter == 0 {
+			q.counter++ // 0 не используется в качестве идентификатора
+		}
+		if !q.ids[q.counter] { // пропускаем идентификаторы, заданные вызывающей стороной
+			return q.counter
+		}
+	}
+}
+
+// cut удаляет из начала списка count уведомлений вместе с их идентификаторами. Индекс первого
+// неотправленного уведомления при этом не изменяется. Вызывается под блокировкой.
+func (q *notificationQueue) cut(count int) {
+	for i, ntf := range q.list[:count] {
+		delete(q.ids, ntf.ID)
+		q.list[i] = nil // освобождаем уведомления для сборщика мусора
+	}
+	q.list = q.list[count:]
 }
 
 // Get возвращает первое не отправленное уведомление из списка. Если в списке нет неотправленных
@@ -114,34 +433,56 @@ func (q *notificationQueue) Get() *notification {
 	var result = q.list[q.idUnsended] // получаем первое уведомление из очереди на отправку
 	result.Sended = time.Now()        // помечаем время отсылки
 	q.idUnsended++                    // увеличиваем счетчик на следующее
+	if q.inflight == nil {
+		q.inflight = result // до MarkSent уведомление не удаляется из кеша
+	}
 	q.mu.Unlock()
 	return result
 }
 
+// trim удаляет из кеша самые старые отправленные уведомления сверх его размера, даже если время
+// их хранения еще не истекло. Это ограничивает память, занимаемую кешем при очень интенсивной
+// отправке, но уведомления после удаленных уже не смогут быть отправлены повторно при ошибке в них.
+// Уведомления, полученные Get, но еще не отмеченные MarkSent, не удаляются. Вызывается под
+// блокировкой.
+func (q *notificationQueue) trim() {
+	var count = q.idUnsended - q.size
+	if sent := q.sentCount(); count > sent {
+		count = sent // еще не записанные на сервер уведомления остаются в кеше
+	}
+	if q.size <= 0 || count <= 0 {
+		return
+	}
+	q.cut(count)
+	q.idUnsended -= count
+}
+
 // ResendFromID находит в списке отправленных уведомление с таким идентификатором и переставляет указатель
-// на отправку на него. Возвращает true, если уведомление с таким идентификатором найдено в списке.
-// Все уведомления в списке до найденного удаляются.
+// на отправку на него. Возвращает количество уведомлений, которые будут отправлены повторно, или 0,
+// если уведомление с таким идентификатором не найдено в списке. Все уведомления в списке до
+// найденного удаляются.
 
 // Если в качестве второго параметра указано значение true, то найденное уведомление тоже исключается
 // и будут отправлены только уведомления, которые находятся в списке после него.
-func (q *notificationQueue) ResendFromID(id uint32, exclude bool) bool {
-	q.mu.RLock()
+func (q *notificationQueue) ResendFromID(id uint32, exclude bool) int {
+	// поиск и изменение списка выполняются под одной блокировкой: иначе между ними Get или Put
+	// могли бы изменить список, и найденный индекс указывал бы на другое уведомление
+	q.mu.Lock()
+	defer q.mu.Unlock()
 	for i := 0; i < q.idUnsended; i++ {
 		if q.list[i].ID != id { // находим сообщение с указанным идентификатором
 			continue
 		}
-		q.mu.RUnlock()
 		if exclude { // если указан флаг, что это уведомление нужно пропустить, то указываем на следующее
 			i++
 		}
-		q.mu.Lock()
-		q.list = q.list[i:] // удаляем все сообщения до найденного
-		q.idUnsended = 0    // в списке остались только еще не отправленные
-		q.mu.Unlock()
-		return true
+		var count = q.idUnsended - i
+		q.cut(i)         // удаляем все сообщения до найденного
+		q.idUnsended = 0 // в списке остались только еще не отправленные
+		q.inflight = nil
+		return count
 	}
-	q.mu.RUnlock()
-	return false
+	return 0
 }
 
 // WriteTo отправляет еще не отправленные сообщения в поток, и помечает их как отправленные в случае
@@ -150,41 +491,70 @@ func (q *notificationQueue) ResendFromID(id uint32, exclude bool) bool {
 // или пока не случится ошибка.
 //
 // Для оптимизации запись в поток сообщений ведется сразу блоками, а не по одному. Это позволяет
-// отправлять существенно больше сообщений за один раз, если они накопились в списке.
+// отправлять существенно больше сообщений за один раз, если они накопились в списке. Отправленными
+// считаются только уведомления из блоков, полностью записанных в поток: при ошибке остальные
+// остаются в очереди на отправку.
 func (q *notificationQueue) WriteTo(w io.Writer) (total int64, err error) {
+	return q.write(w, nil)
+}
+
+// WriteToIDs работает аналогично WriteTo, но дополнительно возвращает идентификаторы уведомлений,
+// которые были записаны в поток и помечены отправленными, в порядке их отправки. При ошибке
+// записи возвращаются идентификаторы только из блоков, записанных до нее: уведомления после них
+// остаются в очереди и, если сервер вернет ошибку для одного из записанных, окно повторной
+// отправки начинается внутри этого списка.
+func (q *notificationQueue) WriteToIDs(w io.Writer) (total int64, ids []uint32, err error) {
+	total, err = q.write(w, func(list []*notification) {
+		for _, ntf := range list {
+			ids = append(ids, ntf.ID)
+		}
+	})
+	return total, ids, err
+}
+
+// write записывает еще не отправленные уведомления в поток (см. WriteTo) и, если задана функция
+// sent, вызывает ее для уведомлений каждого успешно записанного блока.
+func (q *notificationQueue) write(w io.Writer, sent func([]*notification)) (total int64, err error) {
 	var buf = getBuffer() // получаем из пулла байтовый буфер
 	defer putBuffer(buf)  // освобождаем буфер после работы
-	var sended int        // количество отправленных
-	q.mu.RLock()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	defer q.trim() // выполняется до снятия блокировки
+	var (
+		start  = q.idUnsended // индекс первого уведомления в буфере
+		length = len(q.list)
+	)
+	// flush отсылает буфер сообщений и, если это удалось, помечает уведомления из него отправленными
+	var flush = func(end int) error {
+		n, err := buf.WriteTo(w)
+		total += n // увеличиваем счетчик количества отправленных данных
+		if err != nil {
+			return err
+		}
+		var now = time.Now()
+		for _, ntf := range q.list[start:end] {
+			ntf.Sended = now // помечаем время отправки
+		}
+		if sent != nil {
+			sent(q.list[start:end])
+		}
+		q.idUnsended = end // сдвигаем указатель еще не отправленных на следующее после последнего
+		start = end
+		return nil
+	}
 	// перебираем еще не отосланные сообщения
-	for i, length := q.idUnsended, len(q.list); i < length; i++ {
+	for i := start; i < length; i++ {
 		var ntf = q.list[i] // получаем уведомление на отправку из списка
-		// если после добавления этого уведомления буфер не переполнится, то добавляем его на отправку
-		if buf.Len()+ntf.Len() <= MaxFrameBuffer {
-			if _, err = ntf.WriteTo(buf); err != nil { // сохраняем бинарное представление уведомления в буфере
-				break // прерываем цикл при ошибке
-			}
-			ntf.Sended = time.Now() // помечаем время отправки
-			if i < length-1 {
-				continue // переходим к следующему элементу, если этот не последний
+		// если после добавления этого уведомления буфер переполнится, то сначала отправляем буфер
+		if buf.Len() > 0 && buf.Len()+ntf.Len() > MaxFrameBuffer {
+			if err = flush(i); err != nil {
+				return
 			}
 		}
-		// сюда мы попадаем, если буфер переполнен или мы добавили в него последний элемент списка
-		var n int64             // количество отправленных данных
-		n, err = buf.WriteTo(w) // отсылаем буфер сообщений
-		total += n              // увеличиваем счетчик количества отправленных данных
-		if err != nil {
-			break // прерываемся, если ошибка
-		}
-		sended = i // сохраняем индекс последнего отправленного уведомления
+		ntf.WriteTo(buf) // сохраняем бинарное представление уведомления в буфере
 	}
-	if q.idUnsended < sended {
-		q.mu.RUnlock()
-		q.mu.Lock()
-		q.idUnsended = sended + 1 // сдвигаем указатель еще не отправленных на следующее после последнего
-		q.mu.Unlock()
-		return
+	if buf.Len() > 0 { // отправляем то, что осталось в буфере
+		err = flush(length)
 	}
-	q.mu.RUnlock()
 	return
 }
@@ -0,0 +1,332 @@
+package apns
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// frameWriter запоминает размеры записанных блоков и возвращает ошибку, начиная с записи с
+// указанным номером.
+type frameWriter struct {
+	writes []int // размеры успешно записанных блоков
+	failAt int   // номер записи, с которой возвращается ошибка (0 — без ошибок)
+}
+
+func (w *frameWriter) Write(p []byte) (int, error) {
+	if w.failAt > 0 && len(w.writes)+1 >= w.failAt {
+		return 0, errors.New("write failed")
+	}
+	w.writes = append(w.writes, len(p))
+	return len(p), nil
+}
+
+func TestQueueWriteTo(t *testing.T) {
+	defer func(size int) { MaxFrameBuffer = size }(MaxFrameBuffer)
+	var size = (&notification{ID: 1, Token: make([]byte, 32), Payload: []byte(`{}`)}).Len()
+	for _, test := range []struct {
+		name     string
+		count    int   // количество уведомлений в очереди
+		sent     int   // количество уже отправленных до вызова
+		buffer   int   // размер буфера в уведомлениях
+		failAt   int   // номер неудачной записи
+		writes   []int // размеры записанных блоков в уведомлениях
+		unsended int   // ожидаемый индекс первого неотправленного уведомления
+	}{
+		{name: "single", count: 1, buffer: 3, writes: []int{1}, unsended: 1},
+		{name: "single after sent", count: 2, sent: 1, buffer: 3, writes: []int{1}, unsended: 2},
+		{name: "exact buffer", count: 3, buffer: 3, writes: []int{3}, unsended: 3},
+		{name: "buffer overflow", count: 4, buffer: 3, writes: []int{3, 1}, unsended: 4},
+		{name: "multi flush", count: 5, buffer: 2, writes: []int{2, 2, 1}, unsended: 5},
+		{name: "error", count: 5, buffer: 2, failAt: 2, writes: []int{2}, unsended: 2},
+		{name: "first error", count: 2, buffer: 2, failAt: 1, unsended: 0},
+		{name: "empty", count: 0, buffer: 2, unsended: 0},
+	} {
+		MaxFrameBuffer = test.buffer * size
+		var q = newNotificationQueue(10, time.Hour)
+		for i := 0; i < test.count; i++ {
+			q.Put(&notification{Token: bytes.Repeat([]byte{byte(i + 1)}, 32), Payload: []byte(`{}`)})
+		}
+		for i := 0; i < test.sent; i++ {
+			q.Get()
+		}
+		var w = &frameWriter{failAt: test.failAt}
+		_, err := q.WriteTo(w)
+		if (err != nil) != (test.failAt > 0) {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		}
+		if len(w.writes) != len(test.writes) {
+			t.Errorf("%s: %d writes, expected %d", test.name, len(w.writes), len(test.writes))
+		} else {
+			for i, n := range test.writes {
+				if w.writes[i] != n*size {
+					t.Errorf("%s: write %d has %d bytes, expected %d", test.name, i, w.writes[i], n*size)
+				}
+			}
+		}
+		if q.idUnsended != test.unsended {
+			t.Errorf("%s: idUnsended %d, expected %d", test.name, q.idUnsended, test.unsended)
+		}
+		if q.IsHasToSend() != (test.unsended < test.count) {
+			t.Errorf("%s: IsHasToSend %v", test.name, q.IsHasToSend())
+		}
+		q.Close()
+	}
+}
+
+func TestQueueWriteToIDs(t *testing.T) {
+	defer func(size int) { MaxFrameBuffer = size }(MaxFrameBuffer)
+	var size = (&notification{ID: 1, Token: make([]byte, 32), Payload: []byte(`{}`)}).Len()
+	MaxFrameBuffer = 2 * size
+	var q = newNotificationQueue(10, time.Hour)
+	defer q.Close()
+	for i := 0; i < 5; i++ {
+		q.Put(&notification{Token: make([]byte, 32), Payload: []byte(`{}`)})
+	}
+	q.Get() // первое уже отправлено
+	// второй блок не записывается: отправленными считаются только уведомления из первого
+	_, ids, err := q.WriteToIDs(&frameWriter{failAt: 2})
+	if err == nil {
+		t.Fatal("write error expected")
+	}
+	if fmt.Sprint(ids) != "[2 3]" {
+		t.Errorf("flushed %v, expected [2 3]", ids)
+	}
+	total, ids, err := q.WriteToIDs(new(frameWriter))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(ids) != "[4 5]" || total != int64(2*size) {
+		t.Errorf("flushed %v (%d bytes), expected [4 5]", ids, total)
+	}
+	// после ошибки в одном из записанных уведомлений повторно отправляются следующие за ним
+	if n := q.ResendFromID(ids[0], true); n != 1 {
+		t.Errorf("%d notifications resent, expected 1", n)
+	}
+	if _, ids, _ = q.WriteToIDs(new(frameWriter)); fmt.Sprint(ids) != "[5]" {
+		t.Errorf("resent %v, expected [5]", ids)
+	}
+}
+
+func TestQueueNotificationTooLarge(t *testing.T) {
+	client := newOfflineClient(t, new(Config)) // создается до изменения MaxPayloadSize
+	defer client.Close(false)
+	defer func(size int) { MaxPayloadSize = size }(MaxPayloadSize)
+	MaxPayloadSize = 2 * MaxFrameBuffer // содержимое такого размера не помещается во фрейм
+	var (
+		q      = newNotificationQueue(10, time.Hour)
+		token  = testTokens(1)[0]
+		huge   = &Notification{Payload: NewPayload().Alert(strings.Repeat("x", MaxFrameBuffer))}
+		fitted = &Notification{Payload: NewPayload().Alert(strings.Repeat("x", MaxFrameBuffer-200))}
+	)
+	defer q.Close()
+	if err := q.AddNotification(huge, token); err != ErrNotificationTooLarge {
+		t.Errorf("AddNotification error %v", err)
+	}
+	if _, err := q.AddNotificationStrict(huge, token); err != ErrNotificationTooLarge {
+		t.Errorf("AddNotificationStrict error %v", err)
+	}
+	if err := q.AddNotificationBytes(huge, make([]byte, 32)); err != ErrNotificationTooLarge {
+		t.Errorf("AddNotificationBytes error %v", err)
+	}
+	if n := q.PendingCount(); n != 0 {
+		t.Fatalf("%d large notifications queued", n)
+	}
+	if err := q.AddNotification(fitted, token); err != nil {
+		t.Fatal(err)
+	}
+	if ntf := q.Get(); ntf == nil || ntf.Len() > MaxFrameBuffer {
+		t.Errorf("queued notification does not fit into frame")
+	}
+
+	if _, err := client.SendTokens(huge, []string{token}); err != ErrNotificationTooLarge {
+		t.Errorf("SendTokens error %v", err)
+	}
+	if results := client.SendBatch([]BatchItem{{huge, token}}); results[0].Err != ErrNotificationTooLarge {
+		t.Errorf("SendBatch error %v", results[0].Err)
+	}
+	if _, _, err := client.SendFromReader(huge, strings.NewReader(token)); err != ErrNotificationTooLarge {
+		t.Errorf("SendFromReader error %v", err)
+	}
+	if n := client.Pending(); n != 0 {
+		t.Errorf("%d large notifications queued by client", n)
+	}
+}
+
+func TestQueueResendFromIDConcurrent(t *testing.T) {
+	var q = newNotificationQueue(1000, time.Hour)
+	defer q.Close()
+	var (
+		done = make(chan struct{})
+		sent = make(chan uint32, 100)
+	)
+	go func() { // отправка
+		defer close(sent)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if ntf := q.Get(); ntf != nil {
+				select {
+				case sent <- ntf.ID:
+				default:
+				}
+			}
+		}
+	}()
+	go func() { // добавление новых уведомлений
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			q.Put(&notification{Token: make([]byte, 32), Payload: []byte(`{}`)})
+			if q.PendingCount() > 100 {
+				time.Sleep(time.Microsecond)
+			}
+		}
+	}()
+	// ошибки от сервера для уже отправленных уведомлений
+	for i := 0; i < 1000; i++ {
+		q.ResendFromID(<-sent, i%2 == 0)
+	}
+	close(done)
+	for range sent {
+	}
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.idUnsended > len(q.list) {
+		t.Fatalf("idUnsended %d beyond list length %d", q.idUnsended, len(q.list))
+	}
+	for i := 1; i < len(q.list); i++ {
+		if q.list[i].ID <= q.list[i-1].ID {
+			t.Fatalf("list is not ordered by id: %d after %d", q.list[i].ID, q.list[i-1].ID)
+		}
+	}
+}
+
+func TestQueueExpireConcurrent(t *testing.T) {
+	var q = newNotificationQueue(0, time.Millisecond) // кеш очищается только по времени
+	defer q.Close()
+	var done = make(chan struct{})
+	go func() { // отправка с ошибками от сервера
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if ntf := q.Get(); ntf != nil && ntf.ID%7 == 0 {
+				q.ResendFromID(ntf.ID, true)
+			}
+		}
+	}()
+	for end := time.Now().Add(100 * time.Millisecond); time.Now().Before(end); {
+		q.Put(&notification{Token: make([]byte, 32), Payload: []byte(`{}`)})
+		q.mu.RLock()
+		var idUnsended, length = q.idUnsended, len(q.list)
+		q.mu.RUnlock()
+		if idUnsended < 0 || idUnsended > length {
+			close(done)
+			t.Fatalf("idUnsended %d out of list length %d", idUnsended, length)
+		}
+		time.Sleep(10 * time.Microsecond)
+	}
+	close(done)
+}
+
+func TestQueueIDIndex(t *testing.T) {
+	var q = newNotificationQueue(2, time.Hour)
+	defer q.Close()
+	var newNotification = func(id uint32) *notification {
+		return &notification{ID: id, Token: make([]byte, 32), Payload: []byte(`{}`)}
+	}
+	q.Put(newNotification(3))
+	var list = []*notification{newNotification(0), newNotification(0), newNotification(0)}
+	q.Put(list...)
+	if list[0].ID != 1 || list[1].ID != 2 || list[2].ID != 4 {
+		t.Errorf("assigned ids %d, %d, %d, expected 1, 2, 4", list[0].ID, list[1].ID, list[2].ID)
+	}
+	for ntf := q.Get(); ntf != nil; ntf = q.Get() { // в кеше остаются только два последних уведомления
+		q.MarkSent(ntf)
+	}
+	if len(q.ids) != len(q.list) {
+		t.Errorf("%d indexed ids for %d notifications", len(q.ids), len(q.list))
+	}
+	if rejected := q.Put(newNotification(1)); len(rejected) != 0 {
+		t.Error("id of notification removed from cache is rejected")
+	}
+	if rejected := q.Put(newNotification(4)); len(rejected) != 1 {
+		t.Error("id of cached notification is accepted")
+	}
+}
+
+func TestQueueTrimBySize(t *testing.T) {
+	const size = 100
+	var q = newNotificationQueue(size, time.Hour) // время хранения не истекает
+	defer q.Close()
+	var w = new(frameWriter)
+	for i := 0; i < 10000; i++ {
+		var list = make([]*notification, 10)
+		for j := range list {
+			list[j] = &notification{Token: make([]byte, 32), Payload: []byte(`{}`)}
+		}
+		q.Put(list...)
+		if i%2 == 0 {
+			q.MarkSent(q.Get()) // отправка по одному
+		}
+		if _, err := q.WriteTo(w); err != nil {
+			t.Fatal(err)
+		}
+		if q.idUnsended > size || len(q.list) > size {
+			t.Fatalf("cache grows: %d sent of %d", q.idUnsended, len(q.list))
+		}
+	}
+	if cap(q.list) > 4*size {
+		t.Errorf("cache capacity %d is not bounded", cap(q.list))
+	}
+	// последние отправленные уведомления остаются в кеше и могут быть отправлены повторно
+	var last = q.counter
+	if q.Find(last) == nil || q.Find(last-size+1) == nil {
+		t.Error("recent notifications are evicted")
+	}
+	if q.Find(last-size) != nil {
+		t.Error("old notification is not evicted")
+	}
+	if n := q.ResendFromID(last-size+1, false); n != size {
+		t.Errorf("%d notifications resent, expected %d", n, size)
+	}
+}
+
+func BenchmarkFrameBuffer(b *testing.B) {
+	var frame bytes.Buffer // фрейм максимального размера из уведомлений
+	var ntf = &notification{ID: 1, Token: make([]byte, 32), Payload: []byte(`{"aps":{"alert":"test"}}`)}
+	for frame.Len()+ntf.Len() <= MaxFrameBuffer {
+		ntf.WriteTo(&frame)
+	}
+	for _, test := range []struct {
+		name string
+		cold bool // пул очищается, как это делает сборщик мусора
+	}{{"warm", false}, {"cold", true}} {
+		b.Run(test.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if test.cold {
+					pool = sync.Pool{}
+				}
+				var buf = getBuffer()
+				for data := frame.Bytes(); len(data) > 0; data = data[ntf.Len():] {
+					buf.Write(data[:ntf.Len()]) // буфер заполняется по одному уведомлению
+				}
+				putBuffer(buf)
+			}
+		})
+	}
+}
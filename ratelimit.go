@@ -0,0 +1,57 @@
+package apns
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter ограничивает скорость отправки уведомлений по алгоритму token bucket: запас
+// уведомлений, которые можно отправить без ожидания, пополняется со скоростью limit уведомлений в
+// секунду и не превышает limit. Фрейм, в котором больше уведомлений, чем осталось в запасе, все
+// равно отправляется целиком, но только после ожидания, за которое запас был бы пополнен. Нулевое
+// значение готово к использованию: запас изначально полон.
+type rateLimiter struct {
+	tokens float64   // запас уведомлений (отрицательный, если он израсходован заранее)
+	last   time.Time // время последнего пополнения запаса
+	mu     sync.Mutex
+}
+
+// reserve расходует запас на n уведомлений при ограничении limit уведомлений в секунду и возвращает
+// время, которое нужно подождать перед их отправкой.
+func (l *rateLimiter) reserve(n, limit int, now time.Time) time.Duration {
+	var rate = float64(limit)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.last.IsZero() {
+		l.tokens = rate
+	} else if l.tokens += now.Sub(l.last).Seconds() * rate; l.tokens > rate {
+		l.tokens = rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / rate * float64(time.Second))
+}
+
+// waitRate ждет, если это необходимо для соблюдения ограничения RateLimit, перед отправкой фрейма из
+// n уведомлений. Время ожидания ответа от сервера продлевается на время ожидания, чтобы соединение
+// не было закрыто из-за простоя. Если клиент закрыт во время ожидания, то возвращается ошибка
+// ErrClientIsClosed.
+func (client *Client) waitRate(n int) error {
+	if client.RateLimit <= 0 {
+		return nil
+	}
+	var wait = client.limiter.reserve(n, client.RateLimit, time.Now())
+	if wait <= 0 {
+		return nil
+	}
+	client.conn.SetReadDeadline(time.Now().Add(wait + client.idleTimeout()))
+	select {
+	case <-time.After(wait):
+		return nil
+	case <-client.done:
+		return ErrClientIsClosed
+	}
+}
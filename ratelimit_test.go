@@ -0,0 +1,52 @@
+package apns
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	var (
+		limiter rateLimiter
+		now     = time.Now()
+	)
+	for i, step := range []struct {
+		n       int           // количество уведомлений во фрейме
+		elapsed time.Duration // время после предыдущего фрейма
+		wait    time.Duration // ожидаемое время ожидания
+	}{
+		{n: 60, wait: 0},                                  // изначально запас полон
+		{n: 60, wait: 200 * time.Millisecond},             // запас израсходован заранее
+		{n: 10, elapsed: 300 * time.Millisecond, wait: 0}, // запас пополнен
+		{n: 200, elapsed: time.Hour, wait: time.Second},   // запас не превышает ограничения
+		{n: 50, elapsed: 500 * time.Millisecond, wait: time.Second},
+	} {
+		now = now.Add(step.elapsed)
+		if wait := limiter.reserve(step.n, 100, now); wait != step.wait {
+			t.Errorf("step %d: wait %s, expected %s", i, wait, step.wait)
+		}
+	}
+}
+
+func TestClientRateLimit(t *testing.T) {
+	client, conns := newFakeClient(t)
+	defer client.Close(false)
+	client.RateLimit = 500
+	const count = 1000
+	if err := client.Send(&Notification{Payload: NewPayload().Alert("test")}, testTokens(count)...); err != nil {
+		t.Fatal(err)
+	}
+	var start = time.Now()
+	if err := client.DrainOnce(); err != nil {
+		t.Fatal(err)
+	}
+	var elapsed = time.Since(start)
+	if sent := len(nextFakeConn(t, client, conns).IDs(t)); sent != count {
+		t.Fatalf("%d sent, expected %d", sent, count)
+	}
+	// без ожидания отправляется только начальный запас, остальное — не быстрее RateLimit в секунду
+	var min = time.Duration(count-client.RateLimit) * time.Second / time.Duration(client.RateLimit)
+	if elapsed < min-10*time.Millisecond {
+		t.Errorf("%d notifications sent in %s with rate limit %d/s", count, elapsed, client.RateLimit)
+	}
+}
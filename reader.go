@@ -0,0 +1,102 @@
+package apns
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"strings"
+)
+
+// SendFromReader помещает в очередь на отправку уведомление для каждого токена устройства,
+// прочитанного из потока. Токены читаются построчно: по одному токену в шестнадцатеричном виде
+// в каждой строке, пустые строки пропускаются. Это позволяет отправлять уведомление очень большому
+// количеству устройств, не загружая все их токены в память, например, из файла или из результатов
+// запроса к базе данных.
+//
+// Чтение потока приостанавливается, пока в очереди не освободится место для очередного блока
+// токенов (см. MaxQueueSize, а если оно не задано — MaxQueueDepth), поэтому в режиме ManualSend
+// отправка должна выполняться параллельно. В отличие от Send, ожидание места выполняется
+// независимо от BlockWhenFull.
+// Строки, не являющиеся корректными токенами, пропускаются. Возвращается количество уведомлений,
+// помещенных в очередь, количество пропущенных строк с неверными токенами и ошибка чтения потока,
+// если она произошла.
+func (client *Client) SendFromReader(ntf *Notification, r io.Reader) (queued, skipped int, err error) {
+	client.warnIgnored(ntf.CollapseID)
+	template, err := ntf.convert() // конвертируем сообщение во внутреннее представление
+	if err != nil {
+		return 0, 0, err
+	}
+	if template, err = client.prepare(template); err != nil {
+		return 0, 0, err
+	}
+	var check = client.tokenFilter() // повторы отбрасываются во всем потоке, а не только в блоке
+
+	var limit = client.MaxQueueSize // ограничение количества неотправленных уведомлений
+	if limit <= 0 {
+		limit = MaxQueueDepth
+	}
+	var chunkSize = 100 // количество токенов, добавляемых в очередь за один раз
+	if chunkSize > limit {
+		chunkSize = limit
+	}
+	if chunkSize < 1 {
+		chunkSize = 1
+	}
+	var (
+		tokens  = make([]string, 0, chunkSize)
+		scanner = bufio.NewScanner(r)
+	)
+	// flush добавляет прочитанные токены в очередь, дождавшись в ней свободного места
+	var flush = func() error {
+		if client.closed.Is() {
+			return ErrClientIsClosed
+		}
+		err := client.waitQueueLimit(context.Background(), len(tokens), limit, true)
+		if err != nil {
+			return err
+		}
+		if client.closed.Is() {
+			return ErrClientIsClosed
+		}
+		if !fitsFrame(template, maxTokenLen(tokens)) {
+			return ErrNotificationTooLarge
+		}
+		ids, err := client.queue.add(template, tokens, check)
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			if id != 0 {
+				queued++
+			}
+		}
+		client.start(context.Background())
+		tokens = tokens[:0]
+		return nil
+	}
+	for scanner.Scan() {
+		var token = strings.TrimSpace(scanner.Text())
+		if token == "" {
+			continue // пропускаем пустые строки
+		}
+		if client.NormalizeTokens {
+			token = NormalizeToken(token)
+		}
+		if _, err := decodeToken(token); err != nil {
+			skipped++
+			continue // пропускаем неверные токены
+		}
+		if tokens = append(tokens, token); len(tokens) < chunkSize {
+			continue
+		}
+		if err := flush(); err != nil {
+			return queued, skipped, err
+		}
+	}
+	if len(tokens) > 0 {
+		if err := flush(); err != nil {
+			return queued, skipped, err
+		}
+	}
+	return queued, skipped, scanner.Err()
+}
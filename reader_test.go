@@ -0,0 +1,78 @@
+package apns
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestClientSendFromReader(t *testing.T) {
+	client, server := newTestClient(t)
+	client.MaxQueueSize = 3 // чтение ждет места в очереди и без BlockWhenFull
+	var (
+		tokens = testTokens(10)
+		lines  []string
+	)
+	for i, token := range tokens {
+		lines = append(lines, token)
+		if i%3 == 0 {
+			lines = append(lines, "not a token", "")
+		}
+	}
+	// следим за количеством неотправленных уведомлений в очереди
+	var (
+		maxPending int64
+		stop       = make(chan struct{})
+	)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if pending := int64(client.queue.PendingCount()); pending > atomic.LoadInt64(&maxPending) {
+				atomic.StoreInt64(&maxPending, pending)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	var received = make(chan error)
+	go func() {
+		var conn net.Conn
+		select {
+		case conn = <-server.conns:
+		case <-time.After(5 * time.Second):
+			received <- errors.New("client does not connect")
+			return
+		}
+		for range tokens {
+			time.Sleep(10 * time.Millisecond) // медленный сервер
+			if _, err := readFrame(conn); err != nil {
+				received <- err
+				return
+			}
+		}
+		received <- nil
+	}()
+	queued, skipped, err := client.SendFromReader(
+		&Notification{Payload: NewPayload().Sound(DefaultSound)},
+		strings.NewReader(strings.Join(lines, "\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if queued != len(tokens) || skipped != 4 {
+		t.Errorf("queued %d, skipped %d", queued, skipped)
+	}
+	if err := <-received; err != nil {
+		t.Fatal(err)
+	}
+	close(stop)
+	client.Close(false)
+	if pending := atomic.LoadInt64(&maxPending); pending > int64(client.MaxQueueSize) {
+		t.Errorf("%d notifications pending, max queue size %d", pending, client.MaxQueueSize)
+	}
+}
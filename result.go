@@ -0,0 +1,88 @@
+package apns
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// SendResult описывает результат отправки одного уведомления на сервер. Уведомление, время жизни
+// которого истекло до отправки, на сервер не отправляется: для него возвращается результат с
+// ошибкой ErrNotificationExpired.
+type SendResult struct {
+	ID       uint32    // идентификатор уведомления
+	Token    string    // токен устройства в шестнадцатеричном виде
+	Enqueued time.Time // время помещения уведомления в очередь на отправку
+	Sended   time.Time // время получения уведомления из очереди для отправки на сервер
+	Err      error     // ошибка, которую вернул сервер в ответ на уведомление
+}
+
+// QueueWait возвращает время, которое уведомление провело в очереди до начала отправки. Это
+// позволяет отличить задержку, вызванную переполнением очереди, от сетевой задержки.
+func (result SendResult) QueueWait() time.Duration {
+	return result.Sended.Sub(result.Enqueued)
+}
+
+// newSendResult возвращает результат отправки уведомления с указанной ошибкой.
+func newSendResult(ntf *notification, err error) SendResult {
+	return SendResult{
+		ID:       ntf.ID,
+		Token:    ntf.TokenString(),
+		Enqueued: ntf.Enqueued,
+		Sended:   ntf.Sended,
+		Err:      err,
+	}
+}
+
+// report передает результат отправки уведомления в канал Results, если он задан. Запись в канал
+// не блокирует отправку: если канал заполнен, то результат отбрасывается и увеличивается счетчик
+// отброшенных результатов.
+func (client *Client) report(result SendResult) {
+	client.summary.record(result)
+	if client.Results == nil {
+		return
+	}
+	select {
+	case client.Results <- result:
+	default:
+		atomic.AddUint64(&client.unreported, 1)
+	}
+}
+
+// ResultsDropped возвращает количество результатов отправки, не попавших в канал Results из-за
+// того, что он был заполнен.
+func (client *Client) ResultsDropped() uint64 {
+	return atomic.LoadUint64(&client.unreported)
+}
+
+// deliveredDelay возвращает время, по истечении которого отправленное уведомление считается
+// доставленным.
+func (client *Client) deliveredDelay() time.Duration {
+	if client.DeliveredDelay > 0 {
+		return client.DeliveredDelay
+	}
+	return TimeoutDelivered
+}
+
+// scheduleDelivered запускает подтверждение доставки только что отправленных уведомлений по
+// истечении DeliveredDelay, если задана функция OnDelivered.
+func (client *Client) scheduleDelivered() {
+	if client.OnDelivered == nil {
+		return
+	}
+	// небольшой запас, чтобы к этому времени ожидание истекло для всех уведомлений фрейма
+	time.AfterFunc(client.deliveredDelay()+time.Millisecond, client.confirmDelivered)
+}
+
+// confirmDelivered удаляет из кеша уведомления, на которые в течение DeliveredDelay после
+// отправки не пришла ошибка, и передает их идентификаторы в OnDelivered.
+func (client *Client) confirmDelivered() {
+	var list = client.queue.Confirm(time.Now().Add(-client.deliveredDelay()))
+	if len(list) == 0 {
+		return
+	}
+	var ids = make([]uint32, len(list))
+	for i, ntf := range list {
+		ids[i] = ntf.ID
+	}
+	client.OnDelivered(ids)
+}
@@ -0,0 +1,116 @@
+package apns
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQueueEnqueued(t *testing.T) {
+	var (
+		queue  = newNotificationQueue(NotificationCacheSize, CacheLifeTime)
+		before = time.Now()
+	)
+	queue.Put(&notification{Token: make([]byte, 32)})
+	var ntf = queue.Get()
+	if ntf.Enqueued.Before(before) || ntf.Enqueued.After(ntf.Sended) {
+		t.Errorf("bad enqueue time %v (put after %v, sended %v)", ntf.Enqueued, before, ntf.Sended)
+	}
+}
+
+func TestClientResults(t *testing.T) {
+	client, server := newTestClient(t)
+	var results = make(chan SendResult, 4)
+	client.Results = results
+	var (
+		payload = map[string]interface{}{"aps": map[string]interface{}{"alert": "test"}}
+		before  = time.Now()
+	)
+	if err := client.Send(&Notification{Payload: payload}, testTokens(2)...); err != nil {
+		t.Fatal(err)
+	}
+	conn := server.Accept(t)
+	for i := 0; i < 2; i++ {
+		if _, err := readFrame(conn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, token := range testTokens(2) {
+		var result = <-results
+		if result.ID != uint32(i+1) || result.Token != token || result.Err != nil {
+			t.Errorf("%d: bad result %+v", i, result)
+		}
+		if result.Enqueued.Before(before) || result.QueueWait() < 0 {
+			t.Errorf("%d: bad queue wait %v", i, result.QueueWait())
+		}
+	}
+	// сервер отклоняет второе уведомление
+	if _, err := conn.Write([]byte{8, 8, 0, 0, 0, 2}); err != nil {
+		t.Fatal(err)
+	}
+	server.Accept(t)
+	client.Close(false)
+	select {
+	case result := <-results:
+		if err, ok := result.Err.(APNsError); !ok || err.Status != 8 || result.ID != 2 {
+			t.Errorf("bad rejection result %+v", result)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no rejection result")
+	}
+	if client.ResultsDropped() != 0 {
+		t.Errorf("dropped %d results", client.ResultsDropped())
+	}
+}
+
+func TestClientOnDelivered(t *testing.T) {
+	client, conns := newFakeClient(t)
+	defer client.Close(false)
+	var delivered = make(chan []uint32, 10)
+	client.OnDelivered = func(ids []uint32) { delivered <- ids }
+	client.DeliveredDelay = 50 * time.Millisecond
+	var next = func() []uint32 {
+		select {
+		case ids := <-delivered:
+			return ids
+		case <-time.After(time.Second):
+			t.Fatal("OnDelivered is not called")
+			return nil
+		}
+	}
+
+	var ntf = &Notification{Payload: NewPayload().Alert("test")}
+	if err := client.Send(ntf, testTokens(3)...); err != nil {
+		t.Fatal(err)
+	}
+	var start = time.Now()
+	if err := client.DrainOnce(); err != nil {
+		t.Fatal(err)
+	}
+	var conn = nextFakeConn(t, client, conns)
+	if ids := next(); len(ids) != 3 || ids[0] != 1 || ids[2] != 3 {
+		t.Errorf("delivered %v, expected [1 2 3]", ids)
+	}
+	if elapsed := time.Since(start); elapsed < client.DeliveredDelay {
+		t.Errorf("delivered after %v, before the quiet period", elapsed)
+	}
+	if n := len(client.queue.list); n != 0 {
+		t.Errorf("%d delivered notifications left in the cache", n)
+	}
+
+	// отклоненное сервером уведомление доставленным не считается, а следующее за ним — после
+	// повторной отправки
+	if err := client.Send(ntf, testTokens(2)...); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.DrainOnce(); err != nil {
+		t.Fatal(err)
+	}
+	conn.InjectError(StatusInvalidToken, 4)
+	nextFakeConn(t, client, conns)
+	if err := client.DrainOnce(); err != nil {
+		t.Fatal(err)
+	}
+	if ids := next(); len(ids) != 1 || ids[0] != 5 {
+		t.Errorf("delivered %v, expected [5]", ids)
+	}
+}
@@ -0,0 +1,102 @@
+package apns
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+)
+
+// SendBuffer описывает буфер, который вызывающая сторона передает в Client.SendReuse для
+// сериализации уведомлений. Он сохраняет выделенную память и кодировщик JSON между вызовами, поэтому
+// повторные отправки через один и тот же буфер выделяют меньше памяти, чем Send. Нулевое значение
+// готово к использованию. Один и тот же буфер нельзя одновременно использовать в нескольких потоках.
+type SendBuffer struct {
+	buf   bytes.Buffer  // сериализованное содержимое уведомления
+	enc   *json.Encoder // кодировщик, пишущий в buf
+	hex   []byte        // токен устройства в шестнадцатеричном виде
+	token []byte        // декодированный токен устройства
+}
+
+// encode сериализует содержимое уведомления в буфер и возвращает его. Возвращаемые данные
+// действительны только до следующего использования буфера.
+func (b *SendBuffer) encode(payload Payload) ([]byte, error) {
+	if b.enc == nil {
+		b.enc = json.NewEncoder(&b.buf)
+	}
+	b.buf.Reset()
+	if err := b.enc.Encode(payload); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(b.buf.Bytes(), []byte{'\n'}), nil // Encode добавляет перевод строки
+}
+
+// decodeToken декодирует токен устройства в буфер и возвращает его или nil, если токен имеет
+// неверный формат. Возвращаемые данные действительны только до следующего использования буфера.
+func (b *SendBuffer) decodeToken(token string) []byte {
+	b.hex = append(b.hex[:0], token...)
+	if cap(b.token) < hex.DecodedLen(len(b.hex)) {
+		b.token = make([]byte, hex.DecodedLen(len(b.hex)))
+	}
+	n, err := hex.Decode(b.token[:cap(b.token)], b.hex)
+	if err != nil || !validTokenSize(n) {
+		return nil
+	}
+	return b.token[:n]
+}
+
+// SendReuse работает аналогично Send для одного токена устройства, но сериализует уведомление с
+// помощью переданного буфера. Из буфера в очередь копируются только содержимое уведомления и токен,
+// причем одним блоком памяти, а промежуточные данные остаются в буфере для следующего вызова. Это
+// имеет смысл только для очень интенсивной отправки уведомлений по одному, когда вызывающая
+// сторона уже управляет своими буферами, например, держит по буферу на каждый поток отправки.
+//
+// Клиент не сохраняет ссылок на буфер, поэтому после возврата его можно сразу использовать снова.
+// Функция PayloadValidator получает содержимое из буфера и не должна сохранять его после вызова.
+// Токен неверного формата, как и в Send, молча игнорируется.
+func (client *Client) SendReuse(buf *SendBuffer, ntf *Notification, token string) error {
+	client.warnIgnored(ntf.CollapseID)
+	if client.closed.Is() {
+		return ErrClientIsClosed
+	}
+	if err := ntf.Validate(); err != nil {
+		return err
+	}
+	payload, err := buf.encode(ntf.Payload)
+	if err != nil {
+		return err
+	}
+	// шаблон создается для одного уведомления, поэтому, в отличие от Send, он и помещается в очередь
+	template, err := ntf.compile(payload)
+	if err != nil {
+		return err
+	}
+	if err := client.checkPayload(payload); err != nil {
+		return err
+	}
+	if !template.hasExpiration() {
+		template.Expiration = client.defaultExpiration()
+	}
+	if client.NormalizeTokens {
+		token = NormalizeToken(token)
+	}
+	var btoken = buf.decodeToken(token)
+	if btoken == nil || !client.checkToken(btoken) {
+		return nil // токен игнорируется
+	}
+	if !fitsFrame(template, len(btoken)) {
+		return ErrNotificationTooLarge
+	}
+	if err := client.waitQueue(context.Background(), 1); err != nil {
+		return err
+	}
+	var data = make([]byte, len(btoken)+len(payload)) // токен и содержимое одним блоком
+	copy(data, btoken)
+	copy(data[len(btoken):], payload)
+	template.Token, template.Payload = data[:len(btoken):len(btoken)], data[len(btoken):]
+	if rejected := client.queue.Put(template); len(rejected) > 0 {
+		return ErrDuplicateID
+	}
+	client.start(context.Background())
+	return nil
+}
@@ -0,0 +1,79 @@
+package apns
+
+import (
+	"sort"
+	"time"
+)
+
+// schedule добавляет уведомление в список отложенных, упорядоченный по времени отправки.
+// Уведомления с одинаковым временем отправки сохраняют порядок добавления. Вызывается под
+// блокировкой.
+func (q *notificationQueue) schedule(ntf *notification) {
+	var i = sort.Search(len(q.scheduled), func(i int) bool {
+		return q.scheduled[i].NotBefore.After(ntf.NotBefore)
+	})
+	q.scheduled = append(q.scheduled, nil)
+	copy(q.scheduled[i+1:], q.scheduled[i:])
+	q.scheduled[i] = ntf
+}
+
+// arm взводит таймер на время отправки первого отложенного уведомления, если он еще не взведен на
+// более раннее время. Вызывается под блокировкой.
+func (q *notificationQueue) arm() {
+	if len(q.scheduled) == 0 {
+		return
+	}
+	var next = q.scheduled[0].NotBefore
+	if q.timer != nil {
+		if !q.wake.After(next) {
+			return // таймер сработает раньше или одновременно
+		}
+		q.timer.Stop()
+	}
+	q.wake = next
+	q.timer = time.AfterFunc(time.Until(next), q.release)
+}
+
+// release перемещает в очередь на отправку отложенные уведомления, время отправки которых
+// наступило, и снова взводит таймер для оставшихся. После перемещения вызывается функция ready.
+func (q *notificationQueue) release() {
+	select {
+	case <-q.done:
+		return // очередь закрыта
+	default:
+	}
+	var now = time.Now()
+	q.mu.Lock()
+	var count = sort.Search(len(q.scheduled), func(i int) bool {
+		return q.scheduled[i].NotBefore.After(now)
+	})
+	var list = q.scheduled[:count:count]
+	q.scheduled = q.scheduled[count:]
+	q.timer = nil
+	q.arm()
+	q.list = append(q.list, list...)
+	if q.store != nil && len(list) > 0 {
+		q.store.Append(list)
+	}
+	var ready = q.ready
+	q.mu.Unlock()
+	if len(list) > 0 && ready != nil {
+		ready()
+	}
+}
+
+// ScheduledCount возвращает количество отложенных уведомлений, время отправки которых еще не
+// наступило.
+func (q *notificationQueue) ScheduledCount() int {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	return len(q.scheduled)
+}
+
+// Scheduled возвращает количество уведомлений, отправка которых отложена до указанного в них
+// времени (Notification.NotBefore). Такие уведомления не учитываются в Pending, не сохраняются
+// в файле Config.PersistPath и не отправляются при закрытии клиента, даже если Close или Shutdown
+// ждут окончания отправки.
+func (client *Client) Scheduled() int {
+	return client.queue.ScheduledCount()
+}
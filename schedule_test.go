@@ -0,0 +1,89 @@
+package apns
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestQueueSchedule(t *testing.T) {
+	var q = newNotificationQueue(NotificationCacheSize, CacheLifeTime)
+	defer q.Close()
+	var ready = make(chan struct{}, 10)
+	q.ready = func() { ready <- struct{}{} }
+	var (
+		now  = time.Now()
+		list = make([]*notification, 4)
+	)
+	for i, delay := range []time.Duration{0, 80, 40, 40} { // в миллисекундах
+		list[i] = &notification{Token: make([]byte, 32), Payload: []byte(`{}`)}
+		if delay > 0 {
+			list[i].NotBefore = now.Add(delay * time.Millisecond)
+		}
+	}
+	q.Put(list...)
+	if ntf := q.Get(); ntf == nil || ntf.ID != 1 {
+		t.Fatalf("immediate notification %v", ntf)
+	}
+	if ntf := q.Get(); ntf != nil {
+		t.Fatalf("scheduled notification %d is sent early", ntf.ID)
+	}
+	if n := q.ScheduledCount(); n != 3 {
+		t.Fatalf("%d notifications scheduled, expected 3", n)
+	}
+	// уведомления помещаются в очередь по времени отправки, а с одинаковым временем — по порядку
+	for _, expected := range []string{"[3 4]", "[2]"} {
+		select {
+		case <-ready:
+		case <-time.After(time.Second):
+			t.Fatal("scheduled notifications are not released")
+		}
+		var ids []uint32
+		for ntf := q.Get(); ntf != nil; ntf = q.Get() {
+			if ntf.NotBefore.After(time.Now()) {
+				t.Errorf("notification %d is released early", ntf.ID)
+			}
+			ids = append(ids, ntf.ID)
+		}
+		if fmt.Sprint(ids) != expected {
+			t.Errorf("released %v, expected %s", ids, expected)
+		}
+	}
+	if q.ScheduledCount() != 0 {
+		t.Errorf("%d notifications left scheduled", q.ScheduledCount())
+	}
+}
+
+func TestClientNotBefore(t *testing.T) {
+	client, capture, err := NewCaptureClient(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close(false)
+	client.SendDelay = time.Millisecond
+	var notBefore = time.Now().Add(100 * time.Millisecond)
+	ids, err := client.SendIDs(&Notification{Payload: NewPayload().Alert("later"), NotBefore: notBefore},
+		testTokens(2)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.Scheduled() != 2 || client.Pending() != 0 {
+		t.Errorf("%d scheduled, %d pending", client.Scheduled(), client.Pending())
+	}
+	if err := client.Send(&Notification{Payload: NewPayload().Alert("now")}, testTokens(1)...); err != nil {
+		t.Fatal(err)
+	}
+	for len(capture.Notifications()) < 3 {
+		if time.Now().After(notBefore.Add(time.Second)) {
+			t.Fatalf("%d notifications captured", len(capture.Notifications()))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if time.Now().Before(notBefore) {
+		t.Error("scheduled notifications are sent early")
+	}
+	var list = capture.Notifications()
+	if list[0].ID != 3 || list[1].ID != ids[0] || list[2].ID != ids[1] {
+		t.Errorf("bad send order: %d, %d, %d", list[0].ID, list[1].ID, list[2].ID)
+	}
+}
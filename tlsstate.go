@@ -0,0 +1,90 @@
+package apns
+
+import (
+	"crypto/tls"
+	"fmt"
+	"time"
+)
+
+// TLSState описывает параметры установленного защищенного соединения с сервером APNS. Помимо
+// согласованных параметров TLS, он содержит сроки действия сертификатов сервера и клиента, что
+// позволяет системе мониторинга заранее предупредить об их истечении.
+type TLSState struct {
+	Version            uint16    // версия TLS (tls.VersionTLS12, tls.VersionTLS13 и т.д.)
+	CipherSuite        uint16    // набор шифров
+	NegotiatedProtocol string    // протокол, согласованный с помощью ALPN (пустой, если не согласован)
+	DidResume          bool      // флаг возобновления предыдущей TLS-сессии
+	ServerName         string    // имя сервера, по которому проверялся его сертификат
+	LocalAddr          string    // локальный адрес соединения
+	RemoteAddr         string    // адрес сервера
+	ServerNotAfter     time.Time // срок действия сертификата сервера
+	ClientNotAfter     time.Time // срок действия сертификата клиента (нулевое, если он неизвестен)
+}
+
+// newTLSState возвращает параметры установленного соединения. Сертификат клиента берется из
+// конфигурации: если он задан через Config.TLSConfig, то его срок действия остается неизвестным.
+func newTLSState(conn *tls.Conn, config *Config) TLSState {
+	var connState = conn.ConnectionState()
+	var state = TLSState{
+		Version:            connState.Version,
+		CipherSuite:        connState.CipherSuite,
+		NegotiatedProtocol: connState.NegotiatedProtocol,
+		DidResume:          connState.DidResume,
+		ServerName:         connState.ServerName,
+		LocalAddr:          conn.LocalAddr().String(),
+		RemoteAddr:         conn.RemoteAddr().String(),
+	}
+	if len(connState.PeerCertificates) > 0 {
+		state.ServerNotAfter = connState.PeerCertificates[0].NotAfter
+	}
+	if leaf := config.leaf(); leaf != nil {
+		state.ClientNotAfter = leaf.NotAfter
+	}
+	return state
+}
+
+// NotAfter возвращает ближайший из известных сроков действия сертификатов сервера и клиента или
+// нулевое время, если ни один из них не известен.
+func (s TLSState) NotAfter() time.Time {
+	switch {
+	case s.ClientNotAfter.IsZero():
+		return s.ServerNotAfter
+	case s.ServerNotAfter.IsZero() || s.ClientNotAfter.Before(s.ServerNotAfter):
+		return s.ClientNotAfter
+	default:
+		return s.ServerNotAfter
+	}
+}
+
+// String возвращает описание параметров соединения для вывода в лог.
+func (s TLSState) String() string {
+	var notAfter = func(t time.Time) string {
+		if t.IsZero() {
+			return "unknown"
+		}
+		return t.Format(time.RFC3339)
+	}
+	return fmt.Sprint("Connection state:",
+		"\n------------------------------------------------------------",
+		"\n  Local Address:       ", s.LocalAddr,
+		"\n  Remote Address:      ", s.RemoteAddr,
+		"\n  Server Name:         ", s.ServerName,
+		"\n  TLS version:         ", tls.VersionName(s.Version),
+		"\n  Did Resume:          ", s.DidResume,
+		"\n  Cipher Suite:        ", tls.CipherSuiteName(s.CipherSuite),
+		"\n  Protocol:            ", s.NegotiatedProtocol,
+		"\n  Server Cert Expires: ", notAfter(s.ServerNotAfter),
+		"\n  Client Cert Expires: ", notAfter(s.ClientNotAfter),
+		"\n------------------------------------------------------------")
+}
+
+// TLSState возвращает параметры текущего защищенного соединения клиента с сервером. Если
+// соединение не установлено (или установлено без TLS, например, в NewCaptureClient), то
+// возвращается false. Соединение, установленное Config.Connect, доступно сразу после его вызова.
+func (client *Client) TLSState() (TLSState, bool) {
+	tlsConn, ok := client.conn.current().(*tls.Conn)
+	if !ok || !client.conn.isConnected() {
+		return TLSState{}, false
+	}
+	return newTLSState(tlsConn, client.currentConfig()), true
+}
@@ -0,0 +1,159 @@
+package apns
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"unicode"
+)
+
+// Blocklist описывает список токенов устройств, которым не нужно отправлять уведомления: например,
+// пользователей, отказавшихся от уведомлений, или заведомо недействительные токены.
+type Blocklist interface {
+	// Contains возвращает true, если токен устройства находится в списке.
+	Contains(token []byte) bool
+}
+
+// Environment описывает окружение APNS: рабочее или отладочное (sandbox).
+type Environment uint8
+
+// Окружения APNS.
+const (
+	EnvironmentUnknown    Environment = iota // окружение не известно
+	EnvironmentProduction                    // рабочее окружение
+	EnvironmentSandbox                       // отладочное окружение
+)
+
+// String возвращает название окружения.
+func (env Environment) String() string {
+	switch env {
+	case EnvironmentProduction:
+		return "production"
+	case EnvironmentSandbox:
+		return "sandbox"
+	default:
+		return "unknown"
+	}
+}
+
+// Environment возвращает окружение APNS, с которым работает клиент.
+func (client *Client) Environment() Environment {
+	if client.currentConfig().Sandbox {
+		return EnvironmentSandbox
+	}
+	return EnvironmentProduction
+}
+
+// decodeToken возвращает бинарное представление токена устройства, заданного в шестнадцатеричном
+// виде. Если токен задан неверно или его размер недопустим, то возвращается ошибка ErrTokenSize.
+func decodeToken(token string) ([]byte, error) {
+	btoken, err := hex.DecodeString(token)
+	if err != nil || !validTokenSize(len(btoken)) {
+		return nil, ErrTokenSize
+	}
+	return btoken, nil
+}
+
+// TokenError описывает токен устройства, отклоненный из-за неверного формата.
+type TokenError struct {
+	Token string // отклоненный токен устройства
+	Err   error  // причина: ErrTokenHex или ErrTokenSize
+}
+
+// Error возвращает строковое представление ошибки.
+func (e TokenError) Error() string { return fmt.Sprintf("device token %q: %v", e.Token, e.Err) }
+
+// Unwrap возвращает причину, по которой токен отклонен.
+func (e TokenError) Unwrap() error { return e.Err }
+
+// parseToken работает аналогично decodeToken, но различает причины ошибки: для строки, не
+// являющейся шестнадцатеричным представлением, возвращается ErrTokenHex, а для токена, размер
+// которого недопустим, — ErrTokenSize.
+func parseToken(token string) ([]byte, error) {
+	btoken, err := hex.DecodeString(token)
+	if err != nil {
+		return nil, ErrTokenHex
+	}
+	if !validTokenSize(len(btoken)) {
+		return nil, ErrTokenSize
+	}
+	return btoken, nil
+}
+
+// rejectTokens разделяет токены устройств на корректные и отклоненные из-за неверного формата.
+func rejectTokens(tokens []string) (valid []string, rejected []TokenError) {
+	valid = make([]string, 0, len(tokens))
+	for _, token := range tokens {
+		if _, err := parseToken(token); err != nil {
+			rejected = append(rejected, TokenError{Token: token, Err: err})
+			continue
+		}
+		valid = append(valid, token)
+	}
+	return valid, rejected
+}
+
+// validTokenSize возвращает true, если токен устройства указанного размера можно отправить: он не
+// должен быть пустым или длиннее MaxTokenSize.
+func validTokenSize(size int) bool { return size > 0 && size <= MaxTokenSize }
+
+// NormalizeToken приводит токен устройства к стандартному шестнадцатеричному виду: удаляет
+// пробелы и угловые скобки и переводит символы в нижний регистр. Это позволяет использовать
+// токены, скопированные из логов устройства в формате описания NSData, например
+// "<f389410a e1b57972 ...>".
+func NormalizeToken(token string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '<' || r == '>' || unicode.IsSpace(r) {
+			return -1 // удаляем символ
+		}
+		return unicode.ToLower(r)
+	}, token)
+}
+
+// normalizeTokens возвращает список токенов, приведенных к стандартному виду, если включена опция
+// NormalizeTokens. В противном случае возвращается исходный список.
+func (client *Client) normalizeTokens(tokens []string) []string {
+	if !client.NormalizeTokens {
+		return tokens
+	}
+	var result = make([]string, len(tokens))
+	for i, token := range tokens {
+		result[i] = NormalizeToken(token)
+	}
+	return result
+}
+
+// checkToken проверяет токен устройства перед добавлением уведомления в очередь и возвращает false,
+// если уведомление для этого устройства отправлять не нужно.
+func (client *Client) checkToken(token []byte) bool {
+	if client.Blocklist != nil && client.Blocklist.Contains(token) {
+		atomic.AddUint64(&client.blocked, 1)
+		return false
+	}
+	if client.TokenEnvironment != nil {
+		env := client.TokenEnvironment(token)
+		if env != EnvironmentUnknown && env != client.Environment() {
+			atomic.AddUint64(&client.mismatched, 1)
+			return false
+		}
+	}
+	return true
+}
+
+// tokenFilter возвращает функцию проверки токенов устройств для одного вызова отправки. Если
+// включена опция DedupeTokens, то она, помимо checkToken, отбрасывает токены, уже встречавшиеся
+// в этом вызове.
+func (client *Client) tokenFilter() func([]byte) bool {
+	if !client.DedupeTokens {
+		return client.checkToken
+	}
+	var seen = make(map[string]struct{})
+	return func(token []byte) bool {
+		if _, ok := seen[string(token)]; ok {
+			return false // повторный токен
+		}
+		seen[string(token)] = struct{}{}
+		return client.checkToken(token)
+	}
+}
@@ -0,0 +1,216 @@
+package apns
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// testBlocklist описывает список заблокированных токенов в виде их строковых представлений.
+type testBlocklist map[string]bool
+
+func (b testBlocklist) Contains(token []byte) bool { return b[hex.EncodeToString(token)] }
+
+func TestClientBlocklist(t *testing.T) {
+	var tokens = testTokens(4)
+	client := newOfflineClient(t, new(Config))
+	client.Blocklist = testBlocklist{tokens[1]: true, tokens[3]: true}
+	var ntf = &Notification{Payload: NewPayload().Sound(DefaultSound)}
+	if err := client.Send(ntf, tokens...); err != nil {
+		t.Fatal(err)
+	}
+	if len(client.queue.list) != 2 ||
+		client.queue.list[0].TokenString() != tokens[0] ||
+		client.queue.list[1].TokenString() != tokens[2] {
+		t.Errorf("bad queue: %v", client.queue.list)
+	}
+	if client.BlockedCount() != 2 {
+		t.Errorf("blocked count %d, expected 2", client.BlockedCount())
+	}
+}
+
+func TestClientTokenEnvironment(t *testing.T) {
+	var tokens = testTokens(3)
+	client := newOfflineClient(t, &Config{Sandbox: true})
+	client.TokenEnvironment = func(token []byte) Environment {
+		return Environment(token[31] - 1) // по номеру токена: unknown, production, sandbox
+	}
+	var ntf = &Notification{Payload: NewPayload().Sound(DefaultSound)}
+	if err := client.Send(ntf, tokens...); err != nil {
+		t.Fatal(err)
+	}
+	if len(client.queue.list) != 2 ||
+		client.queue.list[0].TokenString() != tokens[0] ||
+		client.queue.list[1].TokenString() != tokens[2] {
+		t.Errorf("bad queue: %v", client.queue.list)
+	}
+	if client.MismatchedCount() != 1 {
+		t.Errorf("mismatched count %d, expected 1", client.MismatchedCount())
+	}
+}
+
+func TestClientNormalizeTokens(t *testing.T) {
+	const token = "f389410ae1b57972dbbf6eb0c05c2626ab69ede88f523d7eed49fa6e63a6c266"
+	var tokens = []string{
+		"<f389410a e1b57972 dbbf6eb0 c05c2626 ab69ede8 8f523d7e ed49fa6e 63a6c266>",
+		"F389410A E1B57972 DBBF6EB0 C05C2626 AB69EDE8 8F523D7E ED49FA6E 63A6C266",
+		" " + token + "\n",
+	}
+	for _, normalize := range []bool{false, true} {
+		client := newOfflineClient(t, new(Config))
+		client.NormalizeTokens = normalize
+		if err := client.Send(&Notification{Payload: NewPayload().Sound(DefaultSound)},
+			tokens...); err != nil {
+			t.Fatal(err)
+		}
+		if !normalize {
+			if len(client.queue.list) != 0 {
+				t.Errorf("not normalized tokens queued: %v", client.queue.list)
+			}
+			continue
+		}
+		if len(client.queue.list) != len(tokens) {
+			t.Fatalf("%d notifications queued, expected %d", len(client.queue.list), len(tokens))
+		}
+		for i, ntf := range client.queue.list {
+			if ntf.TokenString() != token {
+				t.Errorf("%d: bad token %s", i, ntf.TokenString())
+			}
+		}
+	}
+}
+
+func TestClientDedupeTokens(t *testing.T) {
+	var (
+		token  = testTokens(2)[1]
+		other  = testTokens(1)[0]
+		tokens = []string{token, strings.ToUpper(token), other, token}
+	)
+	for _, dedupe := range []bool{false, true} {
+		client := newOfflineClient(t, new(Config))
+		client.DedupeTokens = dedupe
+		ids, err := client.SendIDs(&Notification{Payload: NewPayload().Sound(DefaultSound)}, tokens...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var expected = "[1 2 3 4]"
+		if dedupe {
+			expected = "[1 0 2 0]"
+		}
+		if result := fmt.Sprint(ids); result != expected {
+			t.Errorf("dedupe %v: ids %s, expected %s", dedupe, result, expected)
+		}
+		if dedupe && (len(client.queue.list) != 2 ||
+			client.queue.list[0].TokenString() != token ||
+			client.queue.list[1].TokenString() != other) {
+			t.Errorf("bad queue: %v", client.queue.list)
+		}
+		// повторы отбрасываются только в пределах одного вызова
+		if ids, _ = client.SendIDs(&Notification{Payload: NewPayload().Sound(DefaultSound)}, token); ids[0] == 0 {
+			t.Errorf("dedupe %v: token is skipped in the next call", dedupe)
+		}
+	}
+}
+
+func TestClientSendStrict(t *testing.T) {
+	var (
+		valid = testTokens(1)[0]
+		ntf   = &Notification{Payload: NewPayload().Sound(DefaultSound)}
+		bad   = map[string]error{
+			valid[1:]:                            ErrTokenHex,  // нечетная длина
+			"zz" + valid[2:]:                     ErrTokenHex,  // недопустимые символы
+			strings.Repeat("ab", MaxTokenSize+1): ErrTokenSize, // больше MaxTokenSize
+			"":                                   ErrTokenSize, // пустой
+		}
+		tokens = []string{valid}
+	)
+	for token := range bad {
+		tokens = append(tokens, token)
+	}
+	client := newOfflineClient(t, new(Config))
+	rejected, err := client.SendStrict(ntf, tokens...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rejected) != len(bad) {
+		t.Fatalf("%d tokens rejected, expected %d", len(rejected), len(bad))
+	}
+	for _, item := range rejected {
+		if !errors.Is(item, bad[item.Token]) {
+			t.Errorf("token %q rejected with %v, expected %v", item.Token, item.Err, bad[item.Token])
+		}
+	}
+	if count := client.queue.PendingCount(); count != 1 {
+		t.Errorf("%d notifications queued, expected 1", count)
+	}
+	// очередь без клиента возвращает тот же результат
+	var queue = newNotificationQueue(NotificationCacheSize, CacheLifeTime)
+	defer queue.Close()
+	if rejected, err = queue.AddNotificationStrict(ntf, tokens...); err != nil {
+		t.Fatal(err)
+	}
+	if len(rejected) != len(bad) || queue.PendingCount() != 1 {
+		t.Errorf("queue: %d tokens rejected, %d queued", len(rejected), queue.PendingCount())
+	}
+}
+
+func TestQueueAddNotificationBytes(t *testing.T) {
+	var (
+		ntf    = &Notification{Payload: NewPayload().Sound(DefaultSound)}
+		tokens = testTokens(2)
+		queues [2]*notificationQueue
+	)
+	for i := range queues {
+		queues[i] = newNotificationQueue(NotificationCacheSize, CacheLifeTime)
+		defer queues[i].Close()
+	}
+	if err := queues[0].AddNotification(ntf, append(tokens, "bad")...); err != nil {
+		t.Fatal(err)
+	}
+	var btokens = [][]byte{{}} // пустой токен пропускается
+	for _, token := range tokens {
+		btoken, _ := hex.DecodeString(token)
+		btokens = append(btokens, btoken)
+	}
+	if err := queues[1].AddNotificationBytes(ntf, btokens...); err != nil {
+		t.Fatal(err)
+	}
+	for i := range queues {
+		if count := queues[i].PendingCount(); count != len(tokens) {
+			t.Fatalf("queue %d: %d notifications queued, expected %d", i, count, len(tokens))
+		}
+	}
+	for i := range tokens {
+		if token, expected := queues[1].list[i].TokenString(), tokens[i]; token != expected {
+			t.Errorf("%d: token %s, expected %s", i, token, expected)
+		}
+	}
+}
+
+func TestClientLongToken(t *testing.T) {
+	client := newOfflineClient(t, new(Config))
+	var token = bytes.Repeat([]byte{0xab}, 100)
+	if err := client.Send(&Notification{Payload: NewPayload().Sound(DefaultSound)},
+		hex.EncodeToString(token)); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if _, err := client.queue.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	frame, err := readFrame(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// первым элементом фрейма идет токен устройства с двухбайтовой длиной
+	if frame[5] != 1 || binary.BigEndian.Uint16(frame[6:8]) != uint16(len(token)) {
+		t.Fatalf("bad token item header: % x", frame[5:8])
+	}
+	if !bytes.Equal(frame[8:8+len(token)], token) {
+		t.Errorf("bad token in frame: % x", frame[8:8+len(token)])
+	}
+}
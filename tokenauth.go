@@ -0,0 +1,91 @@
+package apns
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TokenAuth описывает авторизацию на сервере APNS с помощью токенов провайдера (JWT), подписанных
+// ключом, созданным в личном кабинете разработчика Apple. В отличие от сертификата, один ключ
+// позволяет отправлять уведомления для всех приложений команды разработчиков.
+//
+// Токен генерируется при первом обращении и используется повторно, пока не пройдет
+// TokenRefreshInterval: Apple отклоняет токены старше одного часа, но и не позволяет обновлять их
+// слишком часто. TokenAuth можно одновременно использовать из разных потоков.
+type TokenAuth struct {
+	Key    *ecdsa.PrivateKey // ключ для подписи токенов (ES256)
+	KeyID  string            // идентификатор ключа
+	TeamID string            // идентификатор команды разработчиков
+
+	token  string     // последний сгенерированный токен
+	issued time.Time  // время генерации токена
+	mu     sync.Mutex // блокировка доступа к токену
+}
+
+// NewTokenAuth возвращает авторизацию с помощью токенов, используя ключ в формате .p8 (PEM с ключом
+// PKCS #8), его идентификатор и идентификатор команды разработчиков. Если ключ не удалось разобрать
+// или это не ключ ECDSA, то возвращается ошибка ErrTokenAuthKey.
+func NewTokenAuth(p8 []byte, keyID, teamID string) (*TokenAuth, error) {
+	var block, _ = pem.Decode(p8)
+	if block == nil {
+		return nil, ErrTokenAuthKey
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, ErrTokenAuthKey
+	}
+	ecdsaKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, ErrTokenAuthKey
+	}
+	return &TokenAuth{Key: ecdsaKey, KeyID: keyID, TeamID: teamID}, nil
+}
+
+// Token возвращает действующий токен провайдера для заголовка authorization. Если токен еще не
+// был сгенерирован или устарел, то генерируется новый.
+func (auth *TokenAuth) Token() (string, error) {
+	auth.mu.Lock()
+	defer auth.mu.Unlock()
+	if auth.token != "" && time.Since(auth.issued) < TokenRefreshInterval {
+		return auth.token, nil
+	}
+	var now = time.Now()
+	token, err := auth.sign(now)
+	if err != nil {
+		return "", err
+	}
+	auth.token, auth.issued = token, now
+	return token, nil
+}
+
+// sign генерирует новый токен провайдера с указанным временем выпуска.
+func (auth *TokenAuth) sign(issued time.Time) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "ES256", "kid": auth.KeyID})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{"iss": auth.TeamID, "iat": issued.Unix()})
+	if err != nil {
+		return "", err
+	}
+	var encoding = base64.RawURLEncoding
+	var unsigned = encoding.EncodeToString(header) + "." + encoding.EncodeToString(claims)
+	var digest = sha256.Sum256([]byte(unsigned))
+	r, s, err := ecdsa.Sign(rand.Reader, auth.Key, digest[:])
+	if err != nil {
+		return "", err
+	}
+	// подпись ES256 состоит из значений r и s, дополненных до 32 байт каждое
+	var signature = make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+	return strings.Join([]string{unsigned, encoding.EncodeToString(signature)}, "."), nil
+}
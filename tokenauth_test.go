@@ -0,0 +1,128 @@
+package apns
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testTokenAuthKey возвращает новый ключ ECDSA и его представление в формате .p8.
+func testTokenAuthKey(t *testing.T) (*ecdsa.PrivateKey, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+}
+
+// parseTestToken проверяет подпись токена провайдера и возвращает его заголовок и утверждения.
+func parseTestToken(t *testing.T, key *ecdsa.PrivateKey, token string) (header, claims map[string]interface{}) {
+	var parts = strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("bad token %q", token)
+	}
+	var encoding = base64.RawURLEncoding
+	for i, v := range []*map[string]interface{}{&header, &claims} {
+		data, err := encoding.DecodeString(parts[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = json.Unmarshal(data, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	signature, err := encoding.DecodeString(parts[2])
+	if err != nil || len(signature) != 64 {
+		t.Fatalf("bad signature %q", parts[2])
+	}
+	var (
+		digest = sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		r      = new(big.Int).SetBytes(signature[:32])
+		s      = new(big.Int).SetBytes(signature[32:])
+	)
+	if !ecdsa.Verify(&key.PublicKey, digest[:], r, s) {
+		t.Error("token signature is not valid")
+	}
+	return header, claims
+}
+
+func TestTokenAuth(t *testing.T) {
+	key, p8 := testTokenAuthKey(t)
+	auth, err := NewTokenAuth(p8, "ABC123DEFG", "DEF123GHIJ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var start = time.Now().Unix()
+	token, err := auth.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, claims := parseTestToken(t, key, token)
+	if header["alg"] != "ES256" || header["kid"] != "ABC123DEFG" {
+		t.Errorf("bad header %v", header)
+	}
+	if iat, _ := claims["iat"].(float64); claims["iss"] != "DEF123GHIJ" ||
+		int64(iat) < start || int64(iat) > time.Now().Unix() {
+		t.Errorf("bad claims %v", claims)
+	}
+	if again, _ := auth.Token(); again != token {
+		t.Error("token is not cached")
+	}
+	// делаем токен устаревшим
+	auth.issued = auth.issued.Add(-TokenRefreshInterval)
+	fresh, err := auth.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fresh == token {
+		t.Error("stale token is not re-signed")
+	}
+	parseTestToken(t, key, fresh)
+	if time.Since(auth.issued) > time.Minute {
+		t.Errorf("bad issue time %v", auth.issued)
+	}
+
+	if _, err := NewTokenAuth([]byte("bad key"), "", ""); err != ErrTokenAuthKey {
+		t.Errorf("bad key error %v", err)
+	}
+}
+
+func TestHTTP2ClientTokenAuth(t *testing.T) {
+	key, p8 := testTokenAuthKey(t)
+	auth, err := NewTokenAuth(p8, "ABC123DEFG", "DEF123GHIJ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var conns int64
+	client, server := newHTTP2TestServer(func(w http.ResponseWriter, r *http.Request) {
+		var value = r.Header.Get("authorization")
+		if !strings.HasPrefix(value, "bearer ") {
+			t.Errorf("bad authorization header %q", value)
+			return
+		}
+		if header, _ := parseTestToken(t, key, strings.TrimPrefix(value, "bearer ")); header["kid"] != "ABC123DEFG" {
+			t.Errorf("bad token header %v", header)
+		}
+	}, &conns)
+	defer server.Close()
+	defer client.Close()
+	client.TokenAuth = auth
+
+	if _, err := client.Push(&Notification{Payload: NewPayload().Alert("test")}, testTokens(1)[0]); err != nil {
+		t.Fatal(err)
+	}
+}
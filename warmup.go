@@ -0,0 +1,122 @@
+package apns
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+// Warmup заранее устанавливает n соединений с сервером, чтобы отправка редких, но больших пакетов
+// уведомлений не тратила время на установку соединения. Первое из них становится текущим, а
+// остальные остаются запасными: когда текущее соединение закрывается после ошибки или простоя,
+// вместо установки нового используется запасное. Уже установленные соединения учитываются, поэтому
+// повторный вызов только дополняет их количество до n. При ошибке установки соединения она
+// возвращается сразу, а уже установленные соединения сохраняются.
+//
+// Как и текущее, запасные соединения закрываются после простоя IdleTimeout или при закрытии их
+// сервером. Если включена проверка KeepAlive, то она не только восстанавливает текущее соединение,
+// но и дополняет количество запасных до заданного последним вызовом Warmup.
+func (client *Client) Warmup(n int) error {
+	if client.closed.Is() {
+		return ErrClientIsClosed
+	}
+	if n < 1 {
+		return nil
+	}
+	client.conn.warmup(n - 1)
+	var err = client.conn.fill()
+	client.keepAlive()
+	return err
+}
+
+// Connections возвращает количество установленных соединений с сервером: текущего, если оно
+// установлено, и запасных (см. Warmup).
+func (client *Client) Connections() int {
+	return client.conn.count()
+}
+
+// warmup задает количество запасных соединений, которое поддерживается fill.
+func (conn *apnsConn) warmup(spares int) {
+	conn.mu.Lock()
+	conn.warm = spares
+	conn.mu.Unlock()
+}
+
+// count возвращает количество установленных соединений: текущего и запасных.
+func (conn *apnsConn) count() int {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	var count = len(conn.spares)
+	if conn.Conn != nil && conn.connected.Is() {
+		count++
+	}
+	return count
+}
+
+// fill устанавливает недостающие соединения: текущее, если оно не установлено, и запасные до
+// количества warm.
+func (conn *apnsConn) fill() error {
+	for {
+		conn.mu.Lock()
+		var missing = conn.warm - len(conn.spares)
+		if conn.Conn == nil || !conn.connected.Is() {
+			missing++
+		}
+		conn.mu.Unlock()
+		if missing <= 0 {
+			return nil
+		}
+		netConn, err := conn.client.dial()
+		if err != nil {
+			return err
+		}
+		conn.mu.Lock()
+		if conn.client.closed.Is() {
+			conn.mu.Unlock()
+			netConn.Close()
+			return ErrClientIsClosed
+		}
+		if conn.Conn == nil || !conn.connected.Is() {
+			if conn.Conn != nil {
+				conn.Conn.Close()
+				atomic.AddUint64(&conn.client.reconnects, 1)
+			}
+			conn.Conn = netConn
+			conn.connected.Set(true)
+			conn.closed.Set(false)
+		} else {
+			conn.spares = append(conn.spares, netConn)
+		}
+		conn.mu.Unlock()
+		go conn.handleReads(netConn) // для запасного соединения отслеживает его закрытие
+	}
+}
+
+// takeSpare возвращает первое запасное соединение, удаляя его из списка, или nil, если запасных
+// соединений нет. Вызывается под блокировкой.
+func (conn *apnsConn) takeSpare() net.Conn {
+	if len(conn.spares) == 0 {
+		return nil
+	}
+	var spare = conn.spares[0]
+	conn.spares = append(conn.spares[:0], conn.spares[1:]...)
+	return spare
+}
+
+// dropSpare удаляет из списка запасных и закрывает соединение. Вызывается под блокировкой.
+func (conn *apnsConn) dropSpare(netConn net.Conn) {
+	for i, spare := range conn.spares {
+		if spare == netConn {
+			conn.spares = append(conn.spares[:i], conn.spares[i+1:]...)
+			netConn.Close()
+			return
+		}
+	}
+}
+
+// closeSpares закрывает все запасные соединения. Вызывается под блокировкой.
+func (conn *apnsConn) closeSpares() {
+	for _, spare := range conn.spares {
+		spare.Close()
+	}
+	conn.spares = nil
+}